@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/volmedo/almendruco.git/internal/blobstore"
+)
+
+// newBlobStore returns the blob store configured in cfg, or nil if there is none
+func newBlobStore(cfg BlobsConfig) (blobstore.Store, error) {
+	switch cfg.Backend {
+	case "none", "":
+		return nil, nil
+
+	case "dir":
+		key, err := base64.StdEncoding.DecodeString(cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("bad key: %w", err)
+		}
+
+		return blobstore.NewDirStore(cfg.Dir, cfg.BaseURL, key, cfg.TTL)
+
+	case "s3":
+		return blobstore.NewS3Store(cfg.Bucket, cfg.Prefix, cfg.Endpoint, cfg.TTL)
+
+	default:
+		return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+}
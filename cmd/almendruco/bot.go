@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/volmedo/almendruco.git/internal/notifier"
+	"github.com/volmedo/almendruco.git/internal/raices"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// runBot handles bot commands, either by long-polling Telegram for updates or, if webhook
+// is true, by serving a webhook that Telegram delivers updates to
+func runBot(webhook bool) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	r, err := newRepo(cfg)
+	if err != nil {
+		return fmt.Errorf("unable to initialize repository: %w", err)
+	}
+	defer closeRepo(r)
+
+	rc, err := raices.NewClient(cfg.Raices.BaseURL, cfg.Raices.AppVersion, nil)
+	if err != nil {
+		return fmt.Errorf("error creating Raíces client: %w", err)
+	}
+
+	b, err := notifier.NewTelegramBot(cfg.Telegram.BaseURL, cfg.Telegram.BotToken, cfg.Telegram.WebhookSecret, r, rc, nil)
+	if err != nil {
+		return fmt.Errorf("error creating bot: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if !webhook {
+		log.Println("Polling for updates...")
+		return b.Poll(ctx)
+	}
+
+	svr := &http.Server{Addr: cfg.Telegram.WebhookAddr, Handler: b}
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Serving webhook on %s...", cfg.Telegram.WebhookAddr)
+		if err := svr.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("webhook server failed: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return svr.Shutdown(shutdownCtx)
+}
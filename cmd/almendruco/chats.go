@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/volmedo/almendruco.git/internal/raices"
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+const chatsUsage = `usage: %[1]s chats <command> [flags] [args]
+
+Commands:
+  list [-json]                                    List chats and the accounts they are subscribed to
+  add [-label <label>] [-skip-login] <chat> <user> <pass>
+                                                  Subscribe a chat to an account. Use - as pass to read it from stdin
+  remove <chat> [user]                            Unsubscribe a chat from an account, or from all of them
+  set-cursor <chat> <user> <message>              Set the last message notified to a chat for an account
+  test-login [-json] <chat> [user]                Check the stored credentials of a chat still work
+`
+
+// chatsCmd operates the chats in the repository from the command line
+type chatsCmd struct {
+	repo   repo.Repo
+	raices raices.Client
+	in     io.Reader
+	out    io.Writer
+}
+
+type accountRow struct {
+	ChatID              string     `json:"chatId"`
+	User                string     `json:"user"`
+	Label               string     `json:"label,omitempty"`
+	LastNotifiedMessage uint64     `json:"lastNotifiedMessage"`
+	LoginFailures       int        `json:"loginFailures,omitempty"`
+	DisabledAt          *time.Time `json:"disabledAt,omitempty"`
+	DisabledReason      string     `json:"disabledReason,omitempty"`
+}
+
+type loginRow struct {
+	ChatID string `json:"chatId"`
+	User   string `json:"user"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+func runChats(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, chatsUsage, appName)
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	r, err := newRepo(cfg)
+	if err != nil {
+		return fmt.Errorf("unable to initialize repository: %w", err)
+	}
+	defer closeRepo(r)
+
+	rc, err := raices.NewClient(cfg.Raices.BaseURL, cfg.Raices.AppVersion, nil)
+	if err != nil {
+		return fmt.Errorf("error creating Raíces client: %w", err)
+	}
+
+	cmd := &chatsCmd{repo: r, raices: rc, in: os.Stdin, out: os.Stdout}
+
+	return cmd.run(context.Background(), args)
+}
+
+func (cc *chatsCmd) run(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "list":
+		return cc.list(ctx, args[1:])
+	case "add":
+		return cc.add(ctx, args[1:])
+	case "remove":
+		return cc.remove(ctx, args[1:])
+	case "set-cursor":
+		return cc.setCursor(ctx, args[1:])
+	case "test-login":
+		return cc.testLogin(ctx, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func (cc *chatsCmd) list(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print output as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	chats, err := cc.repo.GetChats(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to fetch chats from repo: %w", err)
+	}
+
+	rows := []accountRow{}
+	for _, c := range chats {
+		for _, a := range c.Accounts {
+			row := accountRow{
+				ChatID:              c.ID,
+				User:                a.Credentials.User,
+				Label:               a.Label,
+				LastNotifiedMessage: a.LastNotifiedMessage,
+				LoginFailures:       a.LoginFailures,
+				DisabledReason:      c.DisabledReason,
+			}
+			if c.Disabled() {
+				at := c.DisabledAt
+				row.DisabledAt = &at
+			}
+
+			rows = append(rows, row)
+		}
+	}
+
+	if *asJSON {
+		return cc.printJSON(rows)
+	}
+
+	tw := tabwriter.NewWriter(cc.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHAT\tUSER\tLABEL\tLAST NOTIFIED\tDISABLED")
+	for _, r := range rows {
+		disabled := ""
+		if r.DisabledAt != nil {
+			disabled = fmt.Sprintf("%s (%s)", r.DisabledAt.Format(time.RFC3339), r.DisabledReason)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", r.ChatID, r.User, r.Label, r.LastNotifiedMessage, disabled)
+	}
+
+	return tw.Flush()
+}
+
+func (cc *chatsCmd) add(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	label := fs.String("label", "", "label to tag the messages of the account with")
+	skipLogin := fs.Bool("skip-login", false, "do not check the credentials with a login in Raíces")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 3 {
+		return errors.New("add needs a chat, a user and a password")
+	}
+
+	chatID, user, pass := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+	if _, err := strconv.ParseUint(chatID, 10, 64); err != nil {
+		return fmt.Errorf("bad chat %s: %w", chatID, err)
+	}
+
+	if pass == "-" {
+		line, err := bufio.NewReader(cc.in).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("unable to read password: %w", err)
+		}
+
+		pass = strings.TrimRight(line, "\r\n")
+	}
+
+	creds := repo.Credentials{User: user, Pass: pass}
+	if !*skipLogin {
+		if err := cc.raices.CheckCredentials(ctx, creds); err != nil {
+			return fmt.Errorf("login failed: %w", err)
+		}
+	}
+
+	chat, err := cc.repo.GetChat(ctx, chatID)
+	if err != nil && !errors.Is(err, repo.ErrChatNotFound) {
+		return fmt.Errorf("unable to fetch chat from repo: %w", err)
+	}
+
+	account, _ := chat.Account(user)
+	account.Credentials = creds
+	account.LoginFailures = 0
+	if *label != "" {
+		account.Label = *label
+	}
+
+	if err := cc.repo.SaveAccount(ctx, chatID, account); err != nil {
+		return fmt.Errorf("unable to save account: %w", err)
+	}
+
+	fmt.Fprintf(cc.out, "Chat %s subscribed to user %s\n", chatID, user)
+
+	return nil
+}
+
+func (cc *chatsCmd) remove(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("remove needs a chat and, optionally, a user")
+	}
+
+	chatID := args[0]
+	if len(args) == 1 {
+		if err := cc.repo.DeleteChat(ctx, chatID); err != nil {
+			return fmt.Errorf("unable to delete chat: %w", err)
+		}
+
+		fmt.Fprintf(cc.out, "Chat %s removed\n", chatID)
+
+		return nil
+	}
+
+	user := args[1]
+	chat, err := cc.repo.GetChat(ctx, chatID)
+	if err != nil {
+		return fmt.Errorf("unable to fetch chat from repo: %w", err)
+	}
+
+	if !chat.RemoveAccount(user) {
+		return fmt.Errorf("chat %s: %w", chatID, repo.ErrAccountNotFound)
+	}
+
+	if len(chat.Accounts) == 0 {
+		err = cc.repo.DeleteChat(ctx, chatID)
+	} else {
+		err = cc.repo.DeleteAccount(ctx, chatID, user)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to remove account from chat: %w", err)
+	}
+
+	fmt.Fprintf(cc.out, "Chat %s unsubscribed from user %s\n", chatID, user)
+
+	return nil
+}
+
+func (cc *chatsCmd) setCursor(ctx context.Context, args []string) error {
+	if len(args) != 3 {
+		return errors.New("set-cursor needs a chat, a user and a message")
+	}
+
+	chatID, user := args[0], args[1]
+	last, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad message %s: %w", args[2], err)
+	}
+
+	// UpdateLastNotifiedMessage would not move the cursor back
+	if err := cc.repo.SetLastNotifiedMessage(ctx, chatID, user, last); err != nil {
+		return fmt.Errorf("unable to update last notified message: %w", err)
+	}
+
+	fmt.Fprintf(cc.out, "Last notified message of user %s in chat %s set to %d\n", user, chatID, last)
+
+	return nil
+}
+
+func (cc *chatsCmd) testLogin(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("test-login", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print output as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errors.New("test-login needs a chat and, optionally, a user")
+	}
+
+	chatID := fs.Arg(0)
+	chat, err := cc.repo.GetChat(ctx, chatID)
+	if err != nil {
+		return fmt.Errorf("unable to fetch chat from repo: %w", err)
+	}
+
+	accounts := chat.Accounts
+	if fs.NArg() == 2 {
+		a, ok := chat.Account(fs.Arg(1))
+		if !ok {
+			return fmt.Errorf("chat %s: %w", chatID, repo.ErrAccountNotFound)
+		}
+
+		accounts = []repo.Account{a}
+	}
+
+	rows := []loginRow{}
+	failed := 0
+	for _, a := range accounts {
+		row := loginRow{ChatID: chatID, User: a.Credentials.User, OK: true}
+		if err := cc.raices.CheckCredentials(ctx, a.Credentials); err != nil {
+			row.OK = false
+			row.Error = err.Error()
+			failed++
+		}
+
+		rows = append(rows, row)
+	}
+
+	if *asJSON {
+		if err := cc.printJSON(rows); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(cc.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CHAT\tUSER\tLOGIN\tERROR")
+		for _, r := range rows {
+			status := "OK"
+			if !r.OK {
+				status = "FAILED"
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.ChatID, r.User, status, r.Error)
+		}
+
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("login failed for %d accounts", failed)
+	}
+
+	return nil
+}
+
+func (cc *chatsCmd) printJSON(v interface{}) error {
+	enc := json.NewEncoder(cc.out)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
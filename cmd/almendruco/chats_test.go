@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+type memRepo struct {
+	repo.Repo
+	chats map[string]repo.Chat
+}
+
+func (mr *memRepo) GetChats(ctx context.Context) ([]repo.Chat, error) {
+	chats := []repo.Chat{}
+	for _, c := range mr.chats {
+		chats = append(chats, c)
+	}
+
+	sort.Slice(chats, func(i, j int) bool { return chats[i].ID < chats[j].ID })
+
+	return chats, nil
+}
+
+func (mr *memRepo) GetChat(ctx context.Context, chatID string) (repo.Chat, error) {
+	c, ok := mr.chats[chatID]
+	if !ok {
+		return repo.Chat{}, repo.ErrChatNotFound
+	}
+
+	c.Accounts = append([]repo.Account(nil), c.Accounts...)
+	return c, nil
+}
+
+func (mr *memRepo) SaveAccount(ctx context.Context, chatID string, a repo.Account) error {
+	c := mr.chats[chatID]
+	c.ID = chatID
+	if old, ok := c.Account(a.Credentials.User); ok {
+		a.LastNotifiedMessage = old.LastNotifiedMessage
+	}
+	c.SetAccount(a)
+	mr.chats[chatID] = c
+	return nil
+}
+
+func (mr *memRepo) DeleteAccount(ctx context.Context, chatID, user string) error {
+	c := mr.chats[chatID]
+	if !c.RemoveAccount(user) {
+		return repo.ErrAccountNotFound
+	}
+
+	mr.chats[chatID] = c
+	return nil
+}
+
+func (mr *memRepo) DeleteChat(ctx context.Context, chatID string) error {
+	if _, ok := mr.chats[chatID]; !ok {
+		return repo.ErrChatNotFound
+	}
+
+	delete(mr.chats, chatID)
+	return nil
+}
+
+func (mr *memRepo) SetLastNotifiedMessage(ctx context.Context, chatID, user string, lastNotifiedMessage uint64) error {
+	c, ok := mr.chats[chatID]
+	if !ok {
+		return repo.ErrAccountNotFound
+	}
+
+	a, ok := c.Account(user)
+	if !ok {
+		return repo.ErrAccountNotFound
+	}
+
+	a.LastNotifiedMessage = lastNotifiedMessage
+	c.SetAccount(a)
+
+	return nil
+}
+
+func (fc *fakeRaicesClient) CheckCredentials(ctx context.Context, creds repo.Credentials) error {
+	if creds.Pass == "wrong" {
+		return errors.New("bad credentials")
+	}
+
+	return nil
+}
+
+func newTestChatsCmd(in string) (*chatsCmd, *memRepo, *bytes.Buffer) {
+	mr := &memRepo{chats: map[string]repo.Chat{
+		"1": {ID: "1", Accounts: []repo.Account{
+			{Label: "Lucía", Credentials: repo.Credentials{User: "user1", Pass: "pass"}, LastNotifiedMessage: 10},
+			{Credentials: repo.Credentials{User: "user2", Pass: "wrong"}, LastNotifiedMessage: 20},
+		}},
+	}}
+	out := &bytes.Buffer{}
+
+	return &chatsCmd{repo: mr, raices: &fakeRaicesClient{}, in: strings.NewReader(in), out: out}, mr, out
+}
+
+func TestChatsList(t *testing.T) {
+	cc, _, out := newTestChatsCmd("")
+
+	require.NoError(t, cc.run(context.Background(), []string{"list"}))
+
+	expected := "CHAT  USER   LABEL  LAST NOTIFIED  DISABLED\n" +
+		"1     user1  Lucía  10             \n" +
+		"1     user2         20             \n"
+	assert.Equal(t, expected, out.String())
+}
+
+func TestChatsListDisabled(t *testing.T) {
+	cc, mr, out := newTestChatsCmd("")
+
+	c := mr.chats["1"]
+	c.DisabledAt = time.Date(2021, time.November, 11, 10, 30, 0, 0, time.UTC)
+	c.DisabledReason = "bot blocked by the user"
+	mr.chats["1"] = c
+
+	require.NoError(t, cc.run(context.Background(), []string{"list"}))
+
+	assert.Contains(t, out.String(), "2021-11-11T10:30:00Z (bot blocked by the user)")
+}
+
+func TestChatsListJSON(t *testing.T) {
+	cc, _, out := newTestChatsCmd("")
+
+	require.NoError(t, cc.run(context.Background(), []string{"list", "-json"}))
+
+	assert.Contains(t, out.String(), `"label": "Lucía"`)
+	assert.NotContains(t, out.String(), "pass", "Expected passwords not to be printed")
+}
+
+func TestChatsAdd(t *testing.T) {
+	cc, mr, _ := newTestChatsCmd("s3cr3t\n")
+
+	err := cc.run(context.Background(), []string{"add", "-label", "Pablo", "2", "user3", "-"})
+	require.NoError(t, err)
+
+	expected := repo.Chat{ID: "2", Accounts: []repo.Account{
+		{Label: "Pablo", Credentials: repo.Credentials{User: "user3", Pass: "s3cr3t"}},
+	}}
+	assert.Equal(t, expected, mr.chats["2"])
+
+	err = cc.run(context.Background(), []string{"add", "3", "user3", "wrong"})
+	assert.Error(t, err)
+	assert.NotContains(t, mr.chats, "3")
+}
+
+func TestChatsRemove(t *testing.T) {
+	cc, mr, _ := newTestChatsCmd("")
+
+	require.NoError(t, cc.run(context.Background(), []string{"remove", "1", "user2"}))
+	assert.Len(t, mr.chats["1"].Accounts, 1)
+
+	require.NoError(t, cc.run(context.Background(), []string{"remove", "1"}))
+	assert.Empty(t, mr.chats)
+}
+
+func TestChatsSetCursor(t *testing.T) {
+	cc, mr, _ := newTestChatsCmd("")
+
+	require.NoError(t, cc.run(context.Background(), []string{"set-cursor", "1", "user2", "0"}))
+
+	a, _ := mr.chats["1"].Account("user2")
+	assert.Equal(t, uint64(0), a.LastNotifiedMessage)
+
+	err := cc.run(context.Background(), []string{"set-cursor", "1", "user9", "0"})
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+}
+
+func TestChatsTestLogin(t *testing.T) {
+	cc, _, out := newTestChatsCmd("")
+
+	require.NoError(t, cc.run(context.Background(), []string{"test-login", "1", "user1"}))
+	assert.Contains(t, out.String(), "OK")
+
+	out.Reset()
+	err := cc.run(context.Background(), []string{"test-login", "1"})
+	assert.Error(t, err)
+	assert.Contains(t, out.String(), "FAILED")
+}
@@ -1,15 +1,85 @@
 package main
 
+import "time"
+
 type config struct {
-	Raices   RaicesConfig
-	Telegram TelegramConfig
+	// Workers is the maximum number of Raíces accounts processed concurrently
+	Workers int `default:"4"`
+	// Jitter is the maximum random delay before processing each Raíces account
+	Jitter time.Duration `default:"0s"`
+
+	Repo        RepoConfig
+	Raices      RaicesConfig
+	Telegram    TelegramConfig
+	Credentials CredentialsConfig
+	Blobs       BlobsConfig
+	Serve       ServeConfig
 }
 
+// RepoConfig selects where chats are stored. Backend can be "dynamodb", whose table is
+// scanned in ScanSegments parallel segments, or "bolt", an embedded database kept in the
+// file at Path. A bolt database can only be open in one
+// process at a time, so a daemon using it should also run the bot (see ServeConfig).
+type RepoConfig struct {
+	Backend      string `default:"dynamodb"`
+	ScanSegments int    `default:"1"`
+	Path         string `default:"almendruco.db"`
+}
+
+// RaicesConfig points to the Raíces instance at BaseURL. AppVersion is the version of the
+// pasendroid app sent when logging in, raices.DefaultAppVersion if empty, which needs to be
+// raised when Raíces stops accepting it. If PersistSessions is true, the sessions of the accounts are kept in the repository,
+// so that they are reused across runs instead of logging in every time. The dynamodb
+// backend keeps them in the almendruco-sessions table, whose hash key is the string
+// attribute "user".
 type RaicesConfig struct {
-	BaseURL string `default:"https://raices.madrid.org"`
+	BaseURL         string `default:"https://raices.madrid.org"`
+	AppVersion      string
+	PersistSessions bool
 }
 
 type TelegramConfig struct {
-	BaseURL  string `default:"https://api.telegram.org"`
-	BotToken string `required:"true"`
+	BaseURL       string `default:"https://api.telegram.org"`
+	BotToken      string `required:"true"`
+	WebhookAddr   string `default:":8080"`
+	WebhookSecret string
+}
+
+// CredentialsConfig controls how Raíces credentials are encrypted at rest.
+// Cipher can be "none", "aesgcm" (Key is the AES key) or "envelope" (data keys are
+// generated by the KMS key KMSKeyID or, if it is empty, wrapped with Key locally).
+// Keys are base64-encoded.
+type CredentialsConfig struct {
+	Cipher   string `default:"none"`
+	Key      string
+	KMSKeyID string
+}
+
+// BlobsConfig selects where attachments too big for Telegram are stored, to send a link
+// to download them instead. Links expire after TTL. Backend can be "none", "dir" or "s3".
+// The "dir" backend keeps files in the directory Dir and only works in the daemon, which
+// serves them on HealthAddr (see ServeConfig) through links signed with Key, base64-encoded.
+// BaseURL is the public URL where HealthAddr can be reached. The "s3" backend keeps files
+// under Prefix in Bucket, in AWS S3 or the S3-compatible service at Endpoint if it is set.
+type BlobsConfig struct {
+	Backend  string        `default:"none"`
+	TTL      time.Duration `default:"168h"`
+	Dir      string        `default:"blobs"`
+	BaseURL  string
+	Key      string
+	Bucket   string
+	Prefix   string
+	Endpoint string
+}
+
+// ServeConfig controls the standalone daemon mode. Runs are scheduled with the cron
+// expression in Schedule if it is set, or every Interval otherwise. If Bot is true, the
+// daemon also polls Telegram for bot commands.
+type ServeConfig struct {
+	Interval   time.Duration `default:"15m"`
+	Schedule   string
+	RunOnStart bool          `default:"true"`
+	RunTimeout time.Duration `default:"10m"`
+	HealthAddr string        `default:":8081"`
+	Bot        bool
 }
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"strconv"
+	"os"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/kelseyhightower/envconfig"
@@ -11,77 +12,111 @@ import (
 	"github.com/volmedo/almendruco.git/internal/notifier"
 	"github.com/volmedo/almendruco.git/internal/raices"
 	"github.com/volmedo/almendruco.git/internal/repo"
-	"github.com/volmedo/almendruco.git/internal/repo/dynamodbrepo"
 )
 
 const appName = "almendruco"
 
 func main() {
-	lambda.Start(lambdaHandler)
+	if len(os.Args) < 2 {
+		lambda.Start(lambdaHandler)
+		return
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "bot":
+		err = runBot(false)
+	case "webhook":
+		err = runBot(true)
+	case "serve":
+		err = serve()
+	case "chats":
+		err = runChats(os.Args[2:])
+	case "migrate-credentials":
+		err = migrateCredentials()
+	default:
+		fmt.Fprintf(os.Stderr, "usage: %s [serve|bot|webhook|chats|migrate-credentials]\n", appName)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func lambdaHandler() error {
+func loadConfig() (config, error) {
 	cfg := config{}
 	if err := envconfig.Process(appName, &cfg); err != nil {
-		return fmt.Errorf("configuration processing failed: %w", err)
+		return config{}, fmt.Errorf("configuration processing failed: %w", err)
 	}
 
-	r, err := dynamodbrepo.NewRepo()
+	return cfg, nil
+}
+
+// newPipeline builds the pipeline that notifies new messages with the dependencies configured in cfg
+func newPipeline(cfg config) (*pipeline, error) {
+	r, err := newRepo(cfg)
 	if err != nil {
-		return fmt.Errorf("unable to initialize repository: %w", err)
+		return nil, fmt.Errorf("unable to initialize repository: %w", err)
 	}
 
-	rc, err := raices.NewClient(cfg.Raices.BaseURL)
-	if err != nil {
-		return fmt.Errorf("error creating Raíces client: %w", err)
+	var sessions repo.SessionStore
+	if cfg.Raices.PersistSessions {
+		sessions = r
 	}
 
-	n, err := notifier.NewTelegramNotifier(cfg.Telegram.BaseURL, cfg.Telegram.BotToken)
+	rc, err := raices.NewClient(cfg.Raices.BaseURL, cfg.Raices.AppVersion, sessions)
 	if err != nil {
-		return fmt.Errorf("error creating notifier: %w", err)
+		return nil, fmt.Errorf("error creating Raíces client: %w", err)
 	}
 
-	if err := notifyMessages(r, rc, n); err != nil {
-		return fmt.Errorf("error notifying messages: %w", err)
+	blobs, err := newBlobStore(cfg.Blobs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize blob store: %w", err)
 	}
 
-	log.Println("Success!")
+	limits := notifier.NewRateLimits()
+	n, err := notifier.NewTelegramNotifier(cfg.Telegram.BaseURL, cfg.Telegram.BotToken, blobs, limits)
+	if err != nil {
+		return nil, fmt.Errorf("error creating notifier: %w", err)
+	}
 
-	return nil
+	return &pipeline{
+		repo:     r,
+		raices:   rc,
+		notifier: n,
+		blobs:    blobs,
+		limits:   limits,
+		workers:  cfg.Workers,
+		jitter:   cfg.Jitter,
+	}, nil
 }
 
-func notifyMessages(r repo.Repo, rc raices.Client, n notifier.Notifier) error {
-	chats, err := r.GetChats()
-	if err != nil {
-		return fmt.Errorf("unable to fetch chats from repo: %s", err)
-	}
+// lambdaPipeline is built in the first invocation and reused while the Lambda is warm, so
+// that Raíces sessions are reused too. Invocations of an instance never overlap.
+var lambdaPipeline *pipeline
 
-	for _, c := range chats {
-		chatID, err := strconv.ParseUint(c.ID, 10, 64)
+func lambdaHandler(ctx context.Context) (runReport, error) {
+	if lambdaPipeline == nil {
+		cfg, err := loadConfig()
 		if err != nil {
-			return fmt.Errorf("bad chatID %s: %w", c.ID, err)
+			return runReport{}, err
 		}
 
-		msgs, err := rc.FetchMessages(c.Credentials, c.LastNotifiedMessage)
+		p, err := newPipeline(cfg)
 		if err != nil {
-			return fmt.Errorf("error fetching messages from Raíces: %s", err)
+			return runReport{}, err
 		}
+		lambdaPipeline = p
+	}
 
-		if len(msgs) != 0 {
-			last, err := n.Notify(notifier.ChatID(chatID), msgs)
-			if err != nil {
-				// Notify notifies messages until it encounters an error, so even in the case of an error
-				// happening we can still update last notified message to avoid notifying again messages
-				// that have already been notified
-				_ = r.UpdateLastNotifiedMessage(strconv.FormatUint(chatID, 10), last)
-				return fmt.Errorf("error notifying messages: %s", err)
-			}
-
-			if err := r.UpdateLastNotifiedMessage(strconv.FormatUint(chatID, 10), last); err != nil {
-				return fmt.Errorf("error updating last notified message: %s", err)
-			}
-		}
+	report, err := lambdaPipeline.run(ctx)
+	if err != nil {
+		log.Printf("Stopped! %d succeeded, %d failed, %d skipped", report.Succeeded, report.Failed, report.Skipped)
+		return report, fmt.Errorf("error notifying messages: %w", err)
 	}
 
-	return nil
+	log.Printf("Done! %d succeeded, %d failed, %d skipped", report.Succeeded, report.Failed, report.Skipped)
+
+	return report, nil
 }
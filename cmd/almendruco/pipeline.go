@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/volmedo/almendruco.git/internal/blobstore"
+	"github.com/volmedo/almendruco.git/internal/notifier"
+	"github.com/volmedo/almendruco.git/internal/raices"
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+const (
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+	statusSkipped   = "skipped"
+
+	// persistMargin is the time reserved before the deadline of a run to persist the
+	// last notified messages after work has been stopped
+	persistMargin = 5 * time.Second
+)
+
+// runReport summarizes the outcome of a run for every chat subscription
+type runReport struct {
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Skipped   int          `json:"skipped"`
+	Chats     []chatReport `json:"chats"`
+}
+
+// chatReport is the outcome of notifying the messages of an account to a chat. A chat is
+// skipped when it has no new messages to be notified, or when the account is suspended
+// because its credentials were rejected too many times.
+type chatReport struct {
+	ChatID   string `json:"chatId"`
+	User     string `json:"user"`
+	Status   string `json:"status"`
+	Notified int    `json:"notified"`
+	Error    string `json:"error,omitempty"`
+}
+
+// pipeline notifies new messages to every subscribed chat. Accounts are processed
+// concurrently by up to workers goroutines, each one waiting a random delay of up to
+// jitter before starting, so that requests to Raíces are spread over time.
+type pipeline struct {
+	repo     repo.Repo
+	raices   raices.Client
+	notifier notifier.Notifier
+	blobs    blobstore.Store
+	limits   *notifier.RateLimits
+	workers  int
+	jitter   time.Duration
+}
+
+// run notifies new messages to every subscribed chat. Errors are isolated to the chats they
+// affect, so the run only fails as a whole if chats cannot be fetched from the repo, or if
+// Raíces rejects the app version. In the latter case, which needs the version in the
+// configuration to be raised, accounts are not tried anymore once the rejection has been
+// confirmed, and the report is returned along with an error matching raices.ErrVersionRejected.
+// If ctx has a deadline, fetching and notifying messages stops persistMargin before it, so
+// that there is still time left to persist the last notified messages.
+func (p *pipeline) run(ctx context.Context) (runReport, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-persistMargin))
+		defer cancel()
+	}
+
+	chats, err := p.repo.GetChats(ctx)
+	if err != nil {
+		return runReport{}, fmt.Errorf("unable to fetch chats from repo: %s", err)
+	}
+
+	chats = enabledChats(chats)
+
+	// Messages of chats subscribed to several accounts are tagged so that they can be told apart
+	multiple := map[string]bool{}
+	for _, c := range chats {
+		multiple[c.ID] = len(c.Accounts) > 1
+	}
+
+	feeds := repo.Feeds(chats)
+	guard := &versionGuard{raices: p.raices}
+	delays := p.delays(len(feeds))
+	results := make([][]chatReport, len(feeds))
+	jobs := make(chan int)
+
+	workers := p.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				select {
+				case <-ctx.Done():
+				case <-time.After(delays[i]):
+				}
+
+				if err := ctx.Err(); err != nil {
+					results[i] = reportFeed(feeds[i], statusSkipped, fmt.Sprintf("not tried, the run was stopped: %s", err))
+					continue
+				}
+
+				if err := guard.rejected(); err != nil {
+					results[i] = reportFeed(feeds[i], statusFailed, fmt.Sprintf("not tried, Raíces rejects the app version: %s", err))
+					continue
+				}
+
+				var err error
+				results[i], err = p.notifyFeed(ctx, feeds[i], multiple)
+				guard.check(ctx, err)
+			}
+		}()
+	}
+
+	for i := range feeds {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	report := runReport{Chats: []chatReport{}}
+	for _, feedResults := range results {
+		for _, cr := range feedResults {
+			switch cr.Status {
+			case statusSucceeded:
+				report.Succeeded++
+			case statusFailed:
+				report.Failed++
+				log.Printf("error notifying messages of user %s to chat %s: %s", cr.User, cr.ChatID, cr.Error)
+			case statusSkipped:
+				report.Skipped++
+			}
+
+			report.Chats = append(report.Chats, cr)
+		}
+	}
+
+	if err := guard.rejected(); err != nil {
+		log.Printf("Raíces rejects the app version, it needs to be updated in the configuration: %s", err)
+		return report, fmt.Errorf("app version needs to be updated: %w", err)
+	}
+
+	return report, nil
+}
+
+// versionGuard keeps track of whether Raíces rejects the app version during a run, in which
+// case every login fails. Rejections can only be told from the description of errors, so
+// they are confirmed with a probe first.
+type versionGuard struct {
+	raices raices.Client
+
+	mu     sync.Mutex
+	probed bool
+	err    error
+}
+
+// check probes the app version the first time err looks like a version rejection
+func (vg *versionGuard) check(ctx context.Context, err error) {
+	if !errors.Is(err, raices.ErrVersionRejected) {
+		return
+	}
+
+	vg.mu.Lock()
+	defer vg.mu.Unlock()
+
+	if vg.probed {
+		return
+	}
+	vg.probed = true
+
+	perr := vg.raices.ProbeVersion(ctx)
+	if errors.Is(perr, raices.ErrVersionRejected) {
+		vg.err = perr
+		return
+	}
+
+	if perr != nil {
+		log.Printf("unable to probe app version: %s", perr)
+	}
+}
+
+// rejected returns the error Raíces rejected the app version with, or nil if it has not
+func (vg *versionGuard) rejected() error {
+	vg.mu.Lock()
+	defer vg.mu.Unlock()
+
+	return vg.err
+}
+
+// delays returns a random delay of up to p.jitter for each of n feeds
+func (p *pipeline) delays(n int) []time.Duration {
+	delays := make([]time.Duration, n)
+	if p.jitter <= 0 {
+		return delays
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := range delays {
+		delays[i] = time.Duration(rnd.Int63n(int64(p.jitter)))
+	}
+
+	return delays
+}
+
+// notifyFeed fetches the new messages of an account and notifies them to every chat subscribed
+// to it. Subscriptions whose account is suspended are skipped, without logging in to Raíces.
+// It also returns the error fetching messages failed with, if any.
+func (p *pipeline) notifyFeed(ctx context.Context, f repo.Feed, multiple map[string]bool) ([]chatReport, error) {
+	reports := make([]chatReport, 0, len(f.Subscriptions))
+
+	active := repo.Feed{Credentials: f.Credentials}
+	for _, s := range f.Subscriptions {
+		if s.Suspended() {
+			reports = append(reports, chatReport{
+				ChatID: s.ChatID,
+				User:   f.Credentials.User,
+				Status: statusSkipped,
+				Error:  fmt.Sprintf("login suspended after %d failed logins, credentials need to be updated", s.LoginFailures),
+			})
+			continue
+		}
+
+		active.Subscriptions = append(active.Subscriptions, s)
+	}
+
+	if len(active.Subscriptions) == 0 {
+		return reports, nil
+	}
+
+	msgs, err := p.raices.FetchMessages(ctx, active.Credentials, active.LastNotifiedMessage())
+	if err != nil {
+		if errors.Is(err, raices.ErrInvalidCredentials) {
+			for _, s := range active.Subscriptions {
+				p.loginFailed(active.Credentials.User, s, subscriptionLabel(s, active.Credentials.User, multiple))
+			}
+		}
+
+		return append(reports, reportFeed(active, statusFailed, fmt.Sprintf("error fetching messages from Raíces: %s", err))...), err
+	}
+
+	for _, s := range active.Subscriptions {
+		if s.LoginFailures > 0 {
+			p.setLoginFailures(s.ChatID, active.Credentials.User, 0)
+		}
+
+		label := subscriptionLabel(s, f.Credentials.User, multiple)
+		cr := chatReport{ChatID: s.ChatID, User: f.Credentials.User}
+		notified, err := p.notifySubscription(ctx, f.Credentials, s, label, msgs)
+		cr.Notified = notified
+		switch {
+		case err != nil:
+			cr.Status = statusFailed
+			cr.Error = err.Error()
+		case notified == 0:
+			cr.Status = statusSkipped
+		default:
+			cr.Status = statusSucceeded
+		}
+
+		reports = append(reports, cr)
+	}
+
+	return reports, nil
+}
+
+// reportFeed reports every subscription of f with the given status and reason
+func reportFeed(f repo.Feed, status, reason string) []chatReport {
+	reports := make([]chatReport, 0, len(f.Subscriptions))
+	for _, s := range f.Subscriptions {
+		reports = append(reports, chatReport{
+			ChatID: s.ChatID,
+			User:   f.Credentials.User,
+			Status: status,
+			Error:  reason,
+		})
+	}
+
+	return reports
+}
+
+// subscriptionLabel returns the label messages are tagged with for a subscription. Chats
+// subscribed to several accounts fall back to the user when the account has no label.
+func subscriptionLabel(s repo.Subscription, user string, multiple map[string]bool) string {
+	if s.Label == "" && multiple[s.ChatID] {
+		return user
+	}
+
+	return s.Label
+}
+
+// notifySubscription notifies to the subscribed chat the messages it has not been notified yet
+// and returns how many of them were notified. Messages already read in Raíces are left out if
+// the chat only wants unread ones, and delivered messages are marked as read if it asks so.
+// Otherwise, messages come with a button to mark them as read.
+func (p *pipeline) notifySubscription(ctx context.Context, creds repo.Credentials, s repo.Subscription, label string, msgs []raices.Message) (int, error) {
+	user := creds.User
+	chatID, err := strconv.ParseUint(s.ChatID, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad chatID %s: %w", s.ChatID, err)
+	}
+
+	// latest is the newest message, the cursor moves up to it even if it is left out
+	var latest uint64
+	pending := make([]raices.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if m.ID <= s.LastNotifiedMessage {
+			continue
+		}
+
+		latest = m.ID
+		if s.OnlyUnread && !m.ReadDate.IsZero() {
+			continue
+		}
+		pending = append(pending, m)
+	}
+
+	if len(pending) == 0 {
+		if latest != 0 {
+			return 0, p.persist(s.ChatID, user, latest)
+		}
+		return 0, nil
+	}
+
+	deliveries, err := p.repo.GetDeliveries(ctx, s.ChatID, user)
+	if err != nil {
+		return 0, fmt.Errorf("error getting delivery ledger: %s", err)
+	}
+
+	readUser := user
+	if s.MarkRead {
+		readUser = ""
+	}
+
+	ledger := newSubscriptionLedger(p.repo, s.ChatID, user, deliveries)
+	last, err := p.notifier.Notify(ctx, notifier.ChatID(chatID), label, readUser, pending, ledger)
+	notified := countUpTo(pending, last)
+
+	if s.MarkRead {
+		p.markRead(ctx, creds, s.ChatID, pending, last)
+	}
+
+	if errors.Is(err, notifier.ErrRecipientGone) {
+		p.disable(s.ChatID, err)
+	}
+
+	if err != nil {
+		// Notify notifies messages until it encounters an error, so even in the case of an error
+		// happening we can still update last notified message to avoid notifying again messages
+		// that have already been notified
+		if last != 0 {
+			if perr := p.persist(s.ChatID, user, last); perr != nil {
+				log.Printf("chat %s, user %s: %s", s.ChatID, user, perr)
+			}
+		}
+		return notified, fmt.Errorf("error notifying messages: %w", err)
+	}
+
+	// Messages left out after the last notified one are skipped too
+	if err := p.persist(s.ChatID, user, latest); err != nil {
+		return notified, err
+	}
+
+	return notified, nil
+}
+
+// markRead marks as read in Raíces the messages up to last that had not been read yet.
+// Failures are only logged, as the messages have been delivered anyway.
+func (p *pipeline) markRead(ctx context.Context, creds repo.Credentials, chatID string, msgs []raices.Message, last uint64) {
+	for _, m := range msgs {
+		if m.ID > last || ctx.Err() != nil {
+			return
+		}
+
+		if !m.ReadDate.IsZero() {
+			continue
+		}
+
+		if err := p.raices.MarkRead(ctx, creds, m.ID); err != nil {
+			log.Printf("chat %s, user %s: unable to mark message %d as read: %s", chatID, creds.User, m.ID, err)
+		}
+	}
+}
+
+// persist updates the last notified message of a subscription and prunes the deliveries
+// that the cursor has moved past. It does so even if the context of the run is done,
+// otherwise messages that have already been notified would be notified again in the next run.
+// If the cursor cannot be updated, the delivery ledger still prevents sending them twice.
+func (p *pipeline) persist(chatID, user string, last uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), persistMargin)
+	defer cancel()
+
+	if err := p.repo.UpdateLastNotifiedMessage(ctx, chatID, user, last); err != nil {
+		return fmt.Errorf("error updating last notified message: %s", err)
+	}
+
+	if err := p.repo.PruneDeliveries(ctx, chatID, user, last); err != nil {
+		log.Printf("chat %s, user %s: error pruning delivery ledger: %s", chatID, user, err)
+	}
+
+	return nil
+}
+
+// disable disables a chat that cannot be reached anymore, so that it is skipped in the next
+// runs until the user sends /start to the bot again
+func (p *pipeline) disable(chatID string, reason error) {
+	ctx, cancel := context.WithTimeout(context.Background(), persistMargin)
+	defer cancel()
+
+	if err := p.repo.DisableChat(ctx, chatID, reason.Error(), time.Now()); err != nil {
+		log.Printf("chat %s: unable to disable chat: %s", chatID, err)
+		return
+	}
+
+	log.Printf("chat %s: disabled: %s", chatID, reason)
+}
+
+// loginFailed counts a login of the account of a subscription rejected because of bad
+// credentials. The chat is warned once, when the account gets suspended.
+func (p *pipeline) loginFailed(user string, s repo.Subscription, label string) {
+	failures := s.LoginFailures + 1
+	if !p.setLoginFailures(s.ChatID, user, failures) || failures != repo.MaxLoginFailures {
+		return
+	}
+
+	log.Printf("chat %s, user %s: login suspended after %d failed logins", s.ChatID, user, failures)
+
+	chatID, err := strconv.ParseUint(s.ChatID, 10, 64)
+	if err != nil {
+		log.Printf("chat %s: bad chatID: %s", s.ChatID, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), persistMargin)
+	defer cancel()
+
+	err = p.notifier.NotifyLoginSuspended(ctx, notifier.ChatID(chatID), user, label)
+	if errors.Is(err, notifier.ErrRecipientGone) {
+		p.disable(s.ChatID, err)
+		return
+	}
+	if err != nil {
+		log.Printf("chat %s, user %s: unable to warn about suspended login: %s", s.ChatID, user, err)
+	}
+}
+
+// setLoginFailures updates the count of failed logins of the account of a subscription, even
+// if the context of the run is done, and reports whether it succeeded
+func (p *pipeline) setLoginFailures(chatID, user string, failures int) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), persistMargin)
+	defer cancel()
+
+	if err := p.repo.UpdateLoginFailures(ctx, chatID, user, failures); err != nil {
+		log.Printf("chat %s, user %s: error updating login failures: %s", chatID, user, err)
+		return false
+	}
+
+	return true
+}
+
+// enabledChats returns the chats that are not disabled
+func enabledChats(chats []repo.Chat) []repo.Chat {
+	enabled := make([]repo.Chat, 0, len(chats))
+	for _, c := range chats {
+		if !c.Disabled() {
+			enabled = append(enabled, c)
+		}
+	}
+
+	return enabled
+}
+
+// subscriptionLedger is the delivery ledger of a subscription. Deliveries are recorded in
+// the repository as soon as they happen, even if the context of the run is done.
+type subscriptionLedger struct {
+	repo      repo.Repo
+	chatID    string
+	user      string
+	delivered map[repo.Delivery]bool
+}
+
+func newSubscriptionLedger(r repo.Repo, chatID, user string, deliveries []repo.Delivery) *subscriptionLedger {
+	delivered := make(map[repo.Delivery]bool, len(deliveries))
+	for _, d := range deliveries {
+		delivered[d] = true
+	}
+
+	return &subscriptionLedger{repo: r, chatID: chatID, user: user, delivered: delivered}
+}
+
+func (sl *subscriptionLedger) Delivered(d repo.Delivery) bool {
+	return sl.delivered[d]
+}
+
+func (sl *subscriptionLedger) Record(ctx context.Context, d repo.Delivery) error {
+	recordCtx, cancel := context.WithTimeout(context.Background(), persistMargin)
+	defer cancel()
+
+	if err := sl.repo.RecordDelivery(recordCtx, sl.chatID, sl.user, d); err != nil {
+		return err
+	}
+
+	sl.delivered[d] = true
+
+	return nil
+}
+
+// countUpTo returns the number of messages with an ID lower than or equal to last
+func countUpTo(msgs []raices.Message, last uint64) int {
+	count := 0
+	for _, m := range msgs {
+		if m.ID <= last {
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/volmedo/almendruco.git/internal/notifier"
+	"github.com/volmedo/almendruco.git/internal/raices"
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+type fakeRepo struct {
+	repo.Repo
+	sync.Mutex
+	chats      []repo.Chat
+	cursors    map[string]uint64
+	deliveries map[string][]repo.Delivery
+	disabled   map[string]string
+	failures   map[string]int
+}
+
+func (fr *fakeRepo) GetChats(ctx context.Context) ([]repo.Chat, error) {
+	return fr.chats, nil
+}
+
+func (fr *fakeRepo) UpdateLastNotifiedMessage(ctx context.Context, chatID, user string, lastNotifiedMessage uint64) error {
+	fr.Lock()
+	defer fr.Unlock()
+
+	fr.cursors[chatID+"/"+user] = lastNotifiedMessage
+	return nil
+}
+
+func (fr *fakeRepo) UpdateLoginFailures(ctx context.Context, chatID, user string, failures int) error {
+	fr.Lock()
+	defer fr.Unlock()
+
+	if fr.failures == nil {
+		fr.failures = map[string]int{}
+	}
+
+	fr.failures[chatID+"/"+user] = failures
+	return nil
+}
+
+func (fr *fakeRepo) DisableChat(ctx context.Context, chatID, reason string, at time.Time) error {
+	fr.Lock()
+	defer fr.Unlock()
+
+	if fr.disabled == nil {
+		fr.disabled = map[string]string{}
+	}
+
+	fr.disabled[chatID] = reason
+	return nil
+}
+
+func (fr *fakeRepo) GetDeliveries(ctx context.Context, chatID, user string) ([]repo.Delivery, error) {
+	fr.Lock()
+	defer fr.Unlock()
+
+	return fr.deliveries[chatID+"/"+user], nil
+}
+
+func (fr *fakeRepo) RecordDelivery(ctx context.Context, chatID, user string, d repo.Delivery) error {
+	fr.Lock()
+	defer fr.Unlock()
+
+	if fr.deliveries == nil {
+		fr.deliveries = map[string][]repo.Delivery{}
+	}
+
+	fr.deliveries[chatID+"/"+user] = append(fr.deliveries[chatID+"/"+user], d)
+	return nil
+}
+
+func (fr *fakeRepo) PruneDeliveries(ctx context.Context, chatID, user string, upTo uint64) error {
+	fr.Lock()
+	defer fr.Unlock()
+
+	kept := []repo.Delivery{}
+	for _, d := range fr.deliveries[chatID+"/"+user] {
+		if d.MessageID > upTo {
+			kept = append(kept, d)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(fr.deliveries, chatID+"/"+user)
+		return nil
+	}
+
+	fr.deliveries[chatID+"/"+user] = kept
+	return nil
+}
+
+type fakeRaicesClient struct {
+	raices.Client
+	sync.Mutex
+	fetches map[string]int
+	// outdated makes Raíces reject the app version in every login
+	outdated bool
+	probes   int
+	// read holds the messages that have already been read in Raíces
+	read   map[uint64]bool
+	marked map[string][]uint64
+}
+
+func (fc *fakeRaicesClient) FetchMessages(ctx context.Context, creds repo.Credentials, lastNotifiedMessage uint64) ([]raices.Message, error) {
+	fc.Lock()
+	fc.fetches[creds.User]++
+	fc.Unlock()
+
+	if fc.outdated {
+		return []raices.Message{}, fmt.Errorf("login failed: %w", versionRejected)
+	}
+
+	if creds.Pass == "wrong" {
+		return []raices.Message{}, fmt.Errorf("login failed: %w", raices.ErrInvalidCredentials)
+	}
+
+	msgs := []raices.Message{}
+	for id := lastNotifiedMessage + 1; id <= 3; id++ {
+		m := raices.Message{ID: id}
+		if fc.read[id] {
+			m.ReadDate = time.Date(2021, time.November, 11, 10, 30, 0, 0, time.UTC)
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+func (fc *fakeRaicesClient) MarkRead(ctx context.Context, creds repo.Credentials, messageID uint64) error {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if fc.marked == nil {
+		fc.marked = map[string][]uint64{}
+	}
+
+	fc.marked[creds.User] = append(fc.marked[creds.User], messageID)
+	return nil
+}
+
+var versionRejected = &raices.StatusError{Code: "E", Description: "Versión no válida, actualice la aplicación"}
+
+func (fc *fakeRaicesClient) ProbeVersion(ctx context.Context) error {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.probes++
+	if fc.outdated {
+		return versionRejected
+	}
+
+	return nil
+}
+
+type fakeNotifier struct {
+	sync.Mutex
+	notified  map[notifier.ChatID][]uint64
+	failing   notifier.ChatID
+	gone      notifier.ChatID
+	suspended []notifier.ChatID
+	readUsers map[notifier.ChatID]string
+}
+
+func (fn *fakeNotifier) Notify(ctx context.Context, chatID notifier.ChatID, label, readUser string, msgs []raices.Message, ledger notifier.Ledger) (uint64, error) {
+	fn.Lock()
+	defer fn.Unlock()
+
+	if fn.readUsers == nil {
+		fn.readUsers = map[notifier.ChatID]string{}
+	}
+	fn.readUsers[chatID] = readUser
+
+	if chatID == fn.failing {
+		return 0, errors.New("chat not reachable")
+	}
+
+	if chatID == fn.gone {
+		return 0, &notifier.APIError{Code: 403, Description: "Forbidden: bot was blocked by the user"}
+	}
+
+	var last uint64
+	for _, m := range msgs {
+		d := repo.Delivery{MessageID: m.ID}
+		if !ledger.Delivered(d) {
+			fn.notified[chatID] = append(fn.notified[chatID], m.ID)
+			if err := ledger.Record(ctx, d); err != nil {
+				return last, err
+			}
+		}
+		last = m.ID
+	}
+
+	return last, nil
+}
+
+func (fn *fakeNotifier) NotifyLoginSuspended(ctx context.Context, chatID notifier.ChatID, user, label string) error {
+	fn.Lock()
+	defer fn.Unlock()
+
+	fn.suspended = append(fn.suspended, chatID)
+	return nil
+}
+
+func account(user, pass string, last uint64) repo.Account {
+	return repo.Account{Credentials: repo.Credentials{User: user, Pass: pass}, LastNotifiedMessage: last}
+}
+
+func TestNotifyMessages(t *testing.T) {
+	fr := &fakeRepo{
+		chats: []repo.Chat{
+			{ID: "1", Accounts: []repo.Account{account("shared", "pass", 0)}},
+			{ID: "2", Accounts: []repo.Account{account("shared", "pass", 2), account("broken", "wrong", 0)}},
+			{ID: "3", Accounts: []repo.Account{account("other", "pass", 3)}},
+			{ID: "4", Accounts: []repo.Account{account("other", "pass", 1)}},
+		},
+		cursors: map[string]uint64{},
+	}
+	fc := &fakeRaicesClient{fetches: map[string]int{}}
+	fn := &fakeNotifier{notified: map[notifier.ChatID][]uint64{}, failing: 4}
+
+	report, err := (&pipeline{repo: fr, raices: fc, notifier: fn, workers: 2}).run(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]int{"shared": 1, "broken": 1, "other": 1}, fc.fetches)
+	assert.Equal(t, map[notifier.ChatID][]uint64{1: {1, 2, 3}, 2: {3}}, fn.notified)
+	assert.Equal(t, map[string]uint64{"1/shared": 3, "2/shared": 3}, fr.cursors)
+
+	assert.Equal(t, 2, report.Succeeded)
+	assert.Equal(t, 2, report.Failed)
+	assert.Equal(t, 1, report.Skipped)
+
+	statuses := map[string]string{}
+	for _, cr := range report.Chats {
+		statuses[cr.ChatID+"/"+cr.User] = cr.Status
+	}
+
+	expected := map[string]string{
+		"1/shared": statusSucceeded,
+		"2/shared": statusSucceeded,
+		"2/broken": statusFailed,
+		"3/other":  statusSkipped,
+		"4/other":  statusFailed,
+	}
+	assert.Equal(t, expected, statuses)
+}
+
+func TestNotifyMessagesSuspendsRejectedLogins(t *testing.T) {
+	failing := account("failing", "wrong", 0)
+	failing.LoginFailures = repo.MaxLoginFailures - 1
+	suspended := account("suspended", "wrong", 0)
+	suspended.LoginFailures = repo.MaxLoginFailures
+	recovered := account("recovered", "pass", 0)
+	recovered.LoginFailures = 1
+
+	fr := &fakeRepo{
+		chats: []repo.Chat{
+			{ID: "1", Accounts: []repo.Account{failing}},
+			{ID: "2", Accounts: []repo.Account{suspended}},
+			{ID: "3", Accounts: []repo.Account{recovered}},
+		},
+		cursors: map[string]uint64{},
+	}
+	fc := &fakeRaicesClient{fetches: map[string]int{}}
+	fn := &fakeNotifier{notified: map[notifier.ChatID][]uint64{}}
+
+	report, err := (&pipeline{repo: fr, raices: fc, notifier: fn, workers: 1}).run(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]int{"failing": 1, "recovered": 1}, fc.fetches, "Expected suspended accounts not to log in")
+	assert.Equal(t, map[string]int{"1/failing": repo.MaxLoginFailures, "3/recovered": 0}, fr.failures)
+	assert.Equal(t, []notifier.ChatID{1}, fn.suspended)
+
+	assert.Equal(t, 1, report.Succeeded)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, 1, report.Skipped)
+}
+
+func TestNotifyMessagesStopsWhenVersionIsRejected(t *testing.T) {
+	fr := &fakeRepo{
+		chats: []repo.Chat{
+			{ID: "1", Accounts: []repo.Account{account("user1", "pass", 0)}},
+			{ID: "2", Accounts: []repo.Account{account("user2", "pass", 0)}},
+			{ID: "3", Accounts: []repo.Account{account("user3", "pass", 0)}},
+		},
+		cursors: map[string]uint64{},
+	}
+	fc := &fakeRaicesClient{fetches: map[string]int{}, outdated: true}
+	fn := &fakeNotifier{notified: map[notifier.ChatID][]uint64{}}
+
+	report, err := (&pipeline{repo: fr, raices: fc, notifier: fn, workers: 1}).run(context.Background())
+	assert.ErrorIs(t, err, raices.ErrVersionRejected)
+
+	assert.Equal(t, map[string]int{"user1": 1}, fc.fetches, "Expected no more logins once the version is rejected")
+	assert.Equal(t, 1, fc.probes)
+	assert.Equal(t, 3, report.Failed)
+	assert.Empty(t, fr.failures, "Expected version rejections not to count as login failures")
+}
+
+func TestLambdaHandlerReturnsReportWhenVersionIsRejected(t *testing.T) {
+	fr := &fakeRepo{
+		chats: []repo.Chat{
+			{ID: "1", Accounts: []repo.Account{account("user1", "pass", 0)}},
+			{ID: "2", Accounts: []repo.Account{account("user2", "pass", 0)}},
+		},
+		cursors: map[string]uint64{},
+	}
+	fc := &fakeRaicesClient{fetches: map[string]int{}, outdated: true}
+	fn := &fakeNotifier{notified: map[notifier.ChatID][]uint64{}}
+
+	lambdaPipeline = &pipeline{repo: fr, raices: fc, notifier: fn, workers: 1}
+	defer func() { lambdaPipeline = nil }()
+
+	report, err := lambdaHandler(context.Background())
+	assert.ErrorIs(t, err, raices.ErrVersionRejected)
+	assert.Equal(t, 2, report.Failed)
+}
+
+func TestNotifyMessagesReadOptions(t *testing.T) {
+	fr := &fakeRepo{
+		chats: []repo.Chat{
+			{ID: "1", Accounts: []repo.Account{account("reader", "pass", 0)}, MarkRead: true, OnlyUnread: true},
+			{ID: "2", Accounts: []repo.Account{account("plain", "pass", 0)}},
+			// Every new message was already read, so the cursor moves without notifying anything
+			{ID: "3", Accounts: []repo.Account{account("reader", "pass", 2)}, OnlyUnread: true},
+		},
+		cursors: map[string]uint64{},
+	}
+	fc := &fakeRaicesClient{fetches: map[string]int{}, read: map[uint64]bool{2: true, 3: true}}
+	fn := &fakeNotifier{notified: map[notifier.ChatID][]uint64{}}
+
+	report, err := (&pipeline{repo: fr, raices: fc, notifier: fn, workers: 1}).run(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, map[notifier.ChatID][]uint64{1: {1}, 2: {1, 2, 3}}, fn.notified)
+	assert.Equal(t, map[string]uint64{"1/reader": 3, "2/plain": 3, "3/reader": 3}, fr.cursors)
+	assert.Equal(t, map[string][]uint64{"reader": {1}}, fc.marked, "Expected only unread messages to be marked as read")
+	assert.Equal(t, map[notifier.ChatID]string{1: "", 2: "plain"}, fn.readUsers, "Expected a read button only if messages are not marked as read")
+
+	assert.Equal(t, 2, report.Succeeded)
+	assert.Equal(t, 1, report.Skipped)
+}
+
+func TestNotifyMessagesManyWorkers(t *testing.T) {
+	chats := []repo.Chat{}
+	for i := 1; i <= 50; i++ {
+		chats = append(chats, repo.Chat{
+			ID:       strconv.Itoa(i),
+			Accounts: []repo.Account{account("user"+strconv.Itoa(i), "pass", 0)},
+		})
+	}
+
+	fr := &fakeRepo{chats: chats, cursors: map[string]uint64{}}
+	fc := &fakeRaicesClient{fetches: map[string]int{}}
+	fn := &fakeNotifier{notified: map[notifier.ChatID][]uint64{}}
+
+	report, err := (&pipeline{repo: fr, raices: fc, notifier: fn, workers: 8, jitter: time.Millisecond}).run(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, 50, report.Succeeded)
+	assert.Len(t, report.Chats, 50)
+	assert.Len(t, fr.cursors, 50)
+}
+
+func TestNotifyMessagesDisablesGoneChats(t *testing.T) {
+	fr := &fakeRepo{
+		chats: []repo.Chat{
+			{ID: "1", Accounts: []repo.Account{account("user1", "pass", 0)}},
+			{ID: "2", Accounts: []repo.Account{account("user2", "pass", 0)}},
+			{ID: "3", Accounts: []repo.Account{account("user3", "pass", 0)}, DisabledAt: time.Now(), DisabledReason: "chat not found"},
+		},
+		cursors: map[string]uint64{},
+	}
+	fc := &fakeRaicesClient{fetches: map[string]int{}}
+	fn := &fakeNotifier{notified: map[notifier.ChatID][]uint64{}, gone: 2}
+
+	report, err := (&pipeline{repo: fr, raices: fc, notifier: fn, workers: 1}).run(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, report.Succeeded)
+	assert.Equal(t, 1, report.Failed)
+	assert.Len(t, report.Chats, 2, "Expected disabled chats to be skipped")
+	assert.Equal(t, map[string]int{"user1": 1, "user2": 1}, fc.fetches)
+
+	require.Contains(t, fr.disabled, "2")
+	assert.Contains(t, fr.disabled["2"], "bot was blocked")
+	assert.NotContains(t, fr.disabled, "1")
+}
+
+func TestNotifyMessagesSkipsDelivered(t *testing.T) {
+	fr := &fakeRepo{
+		chats:   []repo.Chat{{ID: "1", Accounts: []repo.Account{account("user", "pass", 0)}}},
+		cursors: map[string]uint64{},
+		// A previous run delivered message 2 but could not update the cursor
+		deliveries: map[string][]repo.Delivery{"1/user": {{MessageID: 2}}},
+	}
+	fc := &fakeRaicesClient{fetches: map[string]int{}}
+	fn := &fakeNotifier{notified: map[notifier.ChatID][]uint64{}}
+
+	report, err := (&pipeline{repo: fr, raices: fc, notifier: fn, workers: 1}).run(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, report.Succeeded)
+	assert.Equal(t, map[notifier.ChatID][]uint64{1: {1, 3}}, fn.notified)
+	assert.Equal(t, map[string]uint64{"1/user": 3}, fr.cursors)
+	assert.Empty(t, fr.deliveries["1/user"], "Expected deliveries to be pruned")
+}
+
+// slowNotifier notifies the first message and then hangs until ctx is done
+type slowNotifier struct{}
+
+func (slowNotifier) Notify(ctx context.Context, chatID notifier.ChatID, label, readUser string, msgs []raices.Message, ledger notifier.Ledger) (uint64, error) {
+	<-ctx.Done()
+	return msgs[0].ID, ctx.Err()
+}
+
+func (slowNotifier) NotifyLoginSuspended(ctx context.Context, chatID notifier.ChatID, user, label string) error {
+	return nil
+}
+
+func TestNotifyMessagesPersistsBeforeDeadline(t *testing.T) {
+	fr := &fakeRepo{
+		chats:   []repo.Chat{{ID: "1", Accounts: []repo.Account{account("user", "pass", 0)}}},
+		cursors: map[string]uint64{},
+	}
+	fc := &fakeRaicesClient{fetches: map[string]int{}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), persistMargin+50*time.Millisecond)
+	defer cancel()
+
+	report, err := (&pipeline{repo: fr, raices: fc, notifier: slowNotifier{}, workers: 1}).run(ctx)
+	require.NoError(t, err)
+
+	assert.NoError(t, ctx.Err(), "Expected work to stop before the deadline")
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, map[string]uint64{"1/user": 1}, fr.cursors)
+}
+
+func TestNotifyMessagesSkipsFeedsOnceStopped(t *testing.T) {
+	fr := &fakeRepo{
+		chats: []repo.Chat{
+			{ID: "1", Accounts: []repo.Account{account("user1", "pass", 0)}},
+			{ID: "2", Accounts: []repo.Account{account("user2", "pass", 0)}},
+		},
+		cursors: map[string]uint64{},
+	}
+	fc := &fakeRaicesClient{fetches: map[string]int{}}
+	fn := &fakeNotifier{notified: map[notifier.ChatID][]uint64{}}
+
+	// Chats are fetched before the run is stopped, but feeds wait for their jitter
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	report, err := (&pipeline{repo: fr, raices: fc, notifier: fn, workers: 1, jitter: time.Hour}).run(ctx)
+	require.NoError(t, err)
+
+	assert.Empty(t, fc.fetches, "Expected no logins once the run is stopped")
+	assert.Equal(t, 2, report.Skipped)
+	for _, cr := range report.Chats {
+		assert.Contains(t, cr.Error, "not tried")
+	}
+}
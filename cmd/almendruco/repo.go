@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+
+	"github.com/volmedo/almendruco.git/internal/repo"
+	"github.com/volmedo/almendruco.git/internal/repo/boltrepo"
+	"github.com/volmedo/almendruco.git/internal/repo/credcipher"
+	"github.com/volmedo/almendruco.git/internal/repo/dynamodbrepo"
+)
+
+// newRepo returns the repository configured in cfg, with credentials encryption applied
+func newRepo(cfg config) (repo.Repo, error) {
+	r, err := newBackend(cfg.Repo)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newCipher(cfg.Credentials)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize credentials cipher: %w", err)
+	}
+
+	if c == nil {
+		return r, nil
+	}
+
+	return repo.NewEncryptedRepo(r, c), nil
+}
+
+// closeRepo releases the resources held by r, like the file of an embedded database
+func closeRepo(r repo.Repo) {
+	c, ok := r.(io.Closer)
+	if !ok {
+		return
+	}
+
+	if err := c.Close(); err != nil {
+		log.Printf("unable to close repository: %s", err)
+	}
+}
+
+// newBackend returns the repository backend configured in cfg
+func newBackend(cfg RepoConfig) (repo.Repo, error) {
+	switch cfg.Backend {
+	case "dynamodb", "":
+		return dynamodbrepo.NewRepo(cfg.ScanSegments)
+	case "bolt":
+		return boltrepo.NewRepo(cfg.Path)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+}
+
+// newCipher returns the cipher configured in cfg, or nil if credentials are not encrypted
+func newCipher(cfg CredentialsConfig) (repo.CredentialCipher, error) {
+	switch cfg.Cipher {
+	case "none", "":
+		return nil, nil
+
+	case "aesgcm":
+		key, err := base64.StdEncoding.DecodeString(cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("bad key: %w", err)
+		}
+
+		return credcipher.NewAESGCM(key)
+
+	case "envelope":
+		if cfg.KMSKeyID != "" {
+			s, err := session.NewSession()
+			if err != nil {
+				return nil, fmt.Errorf("session creation failed: %s", err)
+			}
+
+			return credcipher.NewEnvelope(credcipher.NewKMSKeyService(kms.New(s), cfg.KMSKeyID)), nil
+		}
+
+		key, err := base64.StdEncoding.DecodeString(cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("bad key: %w", err)
+		}
+
+		ks, err := credcipher.NewLocalKeyService(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return credcipher.NewEnvelope(ks), nil
+
+	default:
+		return nil, fmt.Errorf("unknown cipher %q", cfg.Cipher)
+	}
+}
+
+// migrateCredentials encrypts the credentials that are still stored in plain text
+func migrateCredentials() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	c, err := newCipher(cfg.Credentials)
+	if err != nil {
+		return fmt.Errorf("unable to initialize credentials cipher: %w", err)
+	}
+
+	if c == nil {
+		return fmt.Errorf("credentials cipher not configured")
+	}
+
+	r, err := newBackend(cfg.Repo)
+	if err != nil {
+		return fmt.Errorf("unable to initialize repository: %w", err)
+	}
+	defer closeRepo(r)
+
+	migrated, err := repo.EncryptPlaintextCredentials(context.Background(), r, c)
+	if err != nil {
+		return fmt.Errorf("migration failed after encrypting %d chats: %w", migrated, err)
+	}
+
+	fmt.Printf("Encrypted credentials of %d chats\n", migrated)
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/volmedo/almendruco.git/internal/blobstore"
+	"github.com/volmedo/almendruco.git/internal/notifier"
+)
+
+const healthPath = "/healthz"
+
+// schedule returns the next time a run should start after t
+type schedule interface {
+	Next(t time.Time) time.Time
+}
+
+type intervalSchedule time.Duration
+
+func (is intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(is))
+}
+
+func newSchedule(cfg ServeConfig) (schedule, error) {
+	if cfg.Schedule != "" {
+		s, err := cron.ParseStandard(cfg.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("bad schedule %q: %w", cfg.Schedule, err)
+		}
+
+		return s, nil
+	}
+
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("bad interval %s", cfg.Interval)
+	}
+
+	return intervalSchedule(cfg.Interval), nil
+}
+
+// health keeps track of the outcome of the last run to report it in the health endpoint
+type health struct {
+	mu      sync.Mutex
+	started time.Time
+	lastRun time.Time
+	report  *runReport
+	err     error
+}
+
+type healthResponse struct {
+	Status  string     `json:"status"`
+	Started time.Time  `json:"started"`
+	LastRun *time.Time `json:"lastRun,omitempty"`
+	Report  *runReport `json:"report,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+func (h *health) record(report runReport, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastRun = time.Now()
+	h.report = &report
+	h.err = err
+}
+
+// ServeHTTP reports the daemon as unhealthy if its last run failed as a whole.
+// Errors affecting only some chats are part of the report but do not make it unhealthy.
+func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	status := http.StatusOK
+	resp := healthResponse{Status: "ok", Started: h.started, Report: h.report}
+	if !h.lastRun.IsZero() {
+		lastRun := h.lastRun
+		resp.LastRun = &lastRun
+	}
+	if h.err != nil {
+		status = http.StatusServiceUnavailable
+		resp.Status = "failing"
+		resp.Error = h.err.Error()
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// serve runs the pipeline on schedule until a SIGINT or SIGTERM is received. A run in
+// progress when the signal arrives is stopped, and its last notified messages persisted,
+// before exiting.
+func serve() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	p, err := newPipeline(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeRepo(p.repo)
+
+	sched, err := newSchedule(cfg.Serve)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var polling sync.WaitGroup
+	if cfg.Serve.Bot {
+		// The bot shares the repository of the pipeline, so that both can work on an
+		// embedded database that only one process can open, and its rate limits, so that
+		// together they do not send more than the Bot API allows
+		b, err := notifier.NewTelegramBot(cfg.Telegram.BaseURL, cfg.Telegram.BotToken, cfg.Telegram.WebhookSecret, p.repo, p.raices, p.limits)
+		if err != nil {
+			return fmt.Errorf("error creating bot: %w", err)
+		}
+
+		polling.Add(1)
+		go func() {
+			defer polling.Done()
+
+			log.Println("Polling for updates...")
+			if err := b.Poll(ctx); err != nil {
+				log.Printf("bot polling failed: %s", err)
+			}
+		}()
+	}
+
+	h := &health{started: time.Now()}
+	mux := http.NewServeMux()
+	mux.Handle(healthPath, h)
+	if files, ok := p.blobs.(http.Handler); ok {
+		mux.Handle(blobstore.FilesPath, files)
+	}
+	svr := &http.Server{Addr: cfg.Serve.HealthAddr, Handler: mux}
+	go func() {
+		log.Printf("Serving health endpoint on %s%s...", cfg.Serve.HealthAddr, healthPath)
+		if err := svr.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("health endpoint failed: %s", err)
+		}
+	}()
+
+	next := time.Now()
+	if !cfg.Serve.RunOnStart {
+		next = sched.Next(next)
+	}
+
+	for {
+		log.Printf("Next run at %s", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Println("Shutting down...")
+
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			err := svr.Shutdown(shutdownCtx)
+
+			// The repo is closed on return, so the update being handled by the bot must be done with it
+			polling.Wait()
+
+			return err
+		case <-timer.C:
+		}
+
+		runCtx, cancel := context.WithTimeout(ctx, cfg.Serve.RunTimeout)
+		report, err := p.run(runCtx)
+		cancel()
+
+		if err != nil {
+			log.Printf("error notifying messages: %s", err)
+		} else {
+			log.Printf("Done! %d succeeded, %d failed, %d skipped", report.Succeeded, report.Failed, report.Skipped)
+		}
+
+		h.record(report, err)
+
+		next = sched.Next(time.Now())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSchedule(t *testing.T) {
+	now := time.Date(2021, time.November, 11, 10, 7, 0, 0, time.UTC)
+
+	s, err := newSchedule(ServeConfig{Interval: 15 * time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(15*time.Minute), s.Next(now))
+
+	s, err = newSchedule(ServeConfig{Interval: 15 * time.Minute, Schedule: "0 8-20 * * 1-5"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2021, time.November, 11, 11, 0, 0, 0, time.UTC), s.Next(now))
+
+	_, err = newSchedule(ServeConfig{Schedule: "every now and then"})
+	assert.Error(t, err)
+}
+
+func TestHealth(t *testing.T) {
+	h := &health{started: time.Now()}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, healthPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	h.record(runReport{Failed: 1}, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, healthPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"failed":1`)
+
+	h.record(runReport{}, errors.New("repo unreachable"))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, healthPath, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "repo unreachable")
+}
+
+func TestHealthConcurrentRecords(t *testing.T) {
+	h := &health{started: time.Now()}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			h.record(runReport{}, errors.New("repo unreachable"))
+			h.record(runReport{}, nil)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, healthPath, nil))
+		if w.Code == http.StatusServiceUnavailable {
+			assert.Contains(t, w.Body.String(), "failing")
+		} else {
+			assert.Contains(t, w.Body.String(), `"status":"ok"`)
+		}
+	}
+	<-done
+}
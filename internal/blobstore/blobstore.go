@@ -0,0 +1,43 @@
+// Package blobstore keeps the files that cannot be delivered through Telegram, like
+// attachments over the upload size limit of the Bot API, and hands out links to download
+// them that expire after some time.
+package blobstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Store stores files and returns links to download them
+type Store interface {
+	// Put stores the contents of r as a file called name and returns a link to download it,
+	// along with the time the link expires
+	Put(ctx context.Context, name string, r io.Reader) (string, time.Time, error)
+}
+
+// newKey returns a random key under which to store a file called name. The random part makes
+// the key impossible to guess and keeps files with the same name apart.
+func newKey(name string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("unable to generate key: %w", err)
+	}
+
+	return hex.EncodeToString(id) + "/" + cleanName(name), nil
+}
+
+// cleanName removes any path from a file name
+func cleanName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "file"
+	}
+
+	return name
+}
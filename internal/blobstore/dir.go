@@ -0,0 +1,192 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FilesPath is the path under which a directory store serves its files
+	FilesPath = "/files/"
+
+	expiresParam   = "expires"
+	signatureParam = "signature"
+)
+
+// dirStore keeps files in a local directory and serves them itself, through links signed
+// with an HMAC key so that they cannot be forged or used after they expire
+type dirStore struct {
+	dir     string
+	baseURL *url.URL
+	key     []byte
+	ttl     time.Duration
+
+	// now returns the current time, it is only replaced in tests
+	now func() time.Time
+}
+
+// NewDirStore returns a Store that keeps files in dir for ttl. The returned store is also an
+// http.Handler that serves the files under FilesPath, and links point to it at baseURL,
+// which is the public URL where the handler is reachable. Links are signed with key.
+func NewDirStore(dir, baseURL string, key []byte, ttl time.Duration) (Store, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return &dirStore{}, fmt.Errorf("bad baseURL %q", baseURL)
+	}
+
+	if len(key) < 16 {
+		return &dirStore{}, fmt.Errorf("key must be at least 16 bytes long")
+	}
+
+	if ttl <= 0 {
+		return &dirStore{}, fmt.Errorf("bad ttl %s", ttl)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return &dirStore{}, fmt.Errorf("unable to create directory: %w", err)
+	}
+
+	return &dirStore{dir: dir, baseURL: u, key: key, ttl: ttl, now: time.Now}, nil
+}
+
+func (ds *dirStore) Put(ctx context.Context, name string, r io.Reader) (string, time.Time, error) {
+	ds.removeExpired()
+
+	key, err := newKey(name)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	p := filepath.Join(ds.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to create directory: %w", err)
+	}
+
+	if err := writeFile(p, r); err != nil {
+		_ = os.RemoveAll(filepath.Dir(p))
+		return "", time.Time{}, fmt.Errorf("unable to write file: %w", err)
+	}
+
+	expires := ds.now().Add(ds.ttl).Truncate(time.Second)
+
+	u := *ds.baseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + FilesPath + key
+	q := url.Values{}
+	q.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(signatureParam, ds.sign(key, expires.Unix()))
+	u.RawQuery = q.Encode()
+
+	return u.String(), expires, nil
+}
+
+// ServeHTTP serves the file a link points to, as long as the link is valid and has not expired
+func (ds *dirStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	i := strings.Index(r.URL.Path, FilesPath)
+	if i == -1 {
+		http.NotFound(w, r)
+		return
+	}
+	key := r.URL.Path[i+len(FilesPath):]
+
+	expires, err := strconv.ParseInt(r.URL.Query().Get(expiresParam), 10, 64)
+	if err != nil || !ds.validKey(key) {
+		http.NotFound(w, r)
+		return
+	}
+
+	signature := r.URL.Query().Get(signatureParam)
+	if !hmac.Equal([]byte(signature), []byte(ds.sign(key, expires))) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if ds.now().Unix() > expires {
+		http.Error(w, "link expired", http.StatusGone)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(ds.dir, filepath.FromSlash(key)))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	name := filepath.Base(f.Name())
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+func (ds *dirStore) sign(key string, expires int64) string {
+	mac := hmac.New(sha256.New, ds.key)
+	fmt.Fprintf(mac, "%s\n%d", key, expires)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validKey reports whether key has the form of the keys returned by newKey, so that
+// nothing outside of the directory can be served
+func (ds *dirStore) validKey(key string) bool {
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 || parts[1] != cleanName(parts[1]) {
+		return false
+	}
+
+	id, err := hex.DecodeString(parts[0])
+	return err == nil && len(id) == 16
+}
+
+// removeExpired removes the files whose links have already expired. Errors are ignored, as
+// files are only left behind until the next try.
+func (ds *dirStore) removeExpired() {
+	entries, err := os.ReadDir(ds.dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || ds.now().Sub(info.ModTime()) <= ds.ttl {
+			continue
+		}
+
+		_ = os.RemoveAll(filepath.Join(ds.dir, e.Name()))
+	}
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
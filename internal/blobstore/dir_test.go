@@ -0,0 +1,105 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDirStore(t *testing.T) *dirStore {
+	s, err := NewDirStore(t.TempDir(), "https://example.com/almendruco", []byte("0123456789abcdef"), time.Hour)
+	require.NoError(t, err)
+
+	return s.(*dirStore)
+}
+
+// get requests link from the store and returns the response
+func get(ds *dirStore, link string) *http.Response {
+	r := httptest.NewRequest(http.MethodGet, link, nil)
+	w := httptest.NewRecorder()
+	ds.ServeHTTP(w, r)
+
+	return w.Result()
+}
+
+func TestDirStore(t *testing.T) {
+	ds := newTestDirStore(t)
+	now := time.Date(2021, time.Month(11), 11, 0, 0, 0, 0, time.UTC)
+	ds.now = func() time.Time { return now }
+
+	link, expires, err := ds.Put(context.Background(), "../circular de noviembre.pdf", strings.NewReader("contents"))
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour), expires)
+	assert.True(t, strings.HasPrefix(link, "https://example.com/almendruco/files/"), link)
+	assert.Contains(t, link, "/circular%20de%20noviembre.pdf?")
+
+	resp := get(ds, link)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "contents", string(body))
+	assert.Equal(t, `attachment; filename="circular de noviembre.pdf"`, resp.Header.Get("Content-Disposition"))
+
+	// Tampered links are rejected
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	q := u.Query()
+	q.Set(expiresParam, "9999999999")
+	u.RawQuery = q.Encode()
+	assert.Equal(t, http.StatusForbidden, get(ds, u.String()).StatusCode)
+
+	// Expired links are rejected
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, http.StatusGone, get(ds, link).StatusCode)
+}
+
+func TestDirStoreRejectsPathsOutsideDir(t *testing.T) {
+	ds := newTestDirStore(t)
+
+	for _, key := range []string{"../dir.go", "00112233445566778899aabbccddeeff/../../x", "nothex/file"} {
+		expires := time.Now().Add(time.Hour).Unix()
+		q := url.Values{}
+		q.Set(expiresParam, strconv.FormatInt(expires, 10))
+		q.Set(signatureParam, ds.sign(key, expires))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.URL.Path = FilesPath + key
+		r.URL.RawQuery = q.Encode()
+		w := httptest.NewRecorder()
+		ds.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusNotFound, w.Code, key)
+	}
+}
+
+func TestDirStoreRemovesExpiredFiles(t *testing.T) {
+	ds := newTestDirStore(t)
+
+	link, _, err := ds.Put(context.Background(), "old.pdf", strings.NewReader("old"))
+	require.NoError(t, err)
+
+	ds.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, _, err = ds.Put(context.Background(), "new.pdf", strings.NewReader("new"))
+	require.NoError(t, err)
+
+	// The link has expired anyway, so check that the file is gone with a fresh signature
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	key := strings.TrimPrefix(u.Path, "/almendruco"+FilesPath)
+	expires := ds.now().Add(time.Hour).Unix()
+	q := url.Values{}
+	q.Set(expiresParam, strconv.FormatInt(expires, 10))
+	q.Set(signatureParam, ds.sign(key, expires))
+	u.RawQuery = q.Encode()
+
+	assert.Equal(t, http.StatusNotFound, get(ds, u.String()).StatusCode)
+}
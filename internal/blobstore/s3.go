@@ -0,0 +1,96 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// maxPresignTTL is the longest time a presigned S3 link can be valid
+const maxPresignTTL = 7 * 24 * time.Hour
+
+// s3Store keeps files in an S3 bucket and returns presigned links to them. Files are not
+// removed when their links expire, a lifecycle rule of the bucket should take care of that.
+type s3Store struct {
+	client   s3iface.S3API
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+	ttl      time.Duration
+}
+
+// NewS3Store returns a Store that keeps files under prefix in bucket, with links valid for
+// ttl. If endpoint is not empty, it is used instead of AWS S3, which allows using any
+// S3-compatible service.
+func NewS3Store(bucket, prefix, endpoint string, ttl time.Duration) (Store, error) {
+	cfg := aws.NewConfig()
+	if endpoint != "" {
+		// Compatible services seldom support virtual hosted-style buckets
+		cfg = cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+
+	s, err := session.NewSession(cfg)
+	if err != nil {
+		return &s3Store{}, fmt.Errorf("session creation failed: %s", err)
+	}
+
+	return NewS3StoreWithClient(s3.New(s), bucket, prefix, ttl)
+}
+
+func NewS3StoreWithClient(client s3iface.S3API, bucket, prefix string, ttl time.Duration) (Store, error) {
+	if bucket == "" {
+		return &s3Store{}, fmt.Errorf("bucket is required")
+	}
+
+	if ttl <= 0 || ttl > maxPresignTTL {
+		return &s3Store{}, fmt.Errorf("bad ttl %s, it must be positive and up to %s", ttl, maxPresignTTL)
+	}
+
+	return &s3Store{
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+		bucket:   bucket,
+		prefix:   prefix,
+		ttl:      ttl,
+	}, nil
+}
+
+func (ss *s3Store) Put(ctx context.Context, name string, r io.Reader) (string, time.Time, error) {
+	key, err := newKey(name)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	key = path.Join(ss.prefix, key)
+
+	_, err = ss.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to upload file: %w", err)
+	}
+
+	req, _ := ss.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:                     aws.String(ss.bucket),
+		Key:                        aws.String(key),
+		ResponseContentDisposition: aws.String(mime.FormatMediaType("attachment", map[string]string{"filename": cleanName(name)})),
+	})
+
+	expires := time.Now().Add(ss.ttl)
+	link, err := req.Presign(ss.ttl)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to presign link: %w", err)
+	}
+
+	return link, expires, nil
+}
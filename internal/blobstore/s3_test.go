@@ -0,0 +1,63 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3Store(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string]string{}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPut, r.Method)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		mu.Lock()
+		objects[r.URL.Path] = string(body)
+		mu.Unlock()
+	}))
+	defer svr.Close()
+
+	s, err := session.NewSession(aws.NewConfig().
+		WithEndpoint(svr.URL).
+		WithS3ForcePathStyle(true).
+		WithRegion("eu-west-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")))
+	require.NoError(t, err)
+
+	ss, err := NewS3StoreWithClient(s3.New(s), "bucket", "attachments", time.Hour)
+	require.NoError(t, err)
+
+	link, expires, err := ss.Put(context.Background(), "circular.pdf", strings.NewReader("contents"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expires, time.Minute)
+
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(u.Path, "/bucket/attachments/"), u.Path)
+	assert.True(t, strings.HasSuffix(u.Path, "/circular.pdf"), u.Path)
+	assert.Equal(t, "3600", u.Query().Get("X-Amz-Expires"))
+	assert.Equal(t, `attachment; filename=circular.pdf`, u.Query().Get("response-content-disposition"))
+
+	assert.Equal(t, map[string]string{u.Path: "contents"}, objects)
+}
+
+func TestS3StoreRejectsLongTTL(t *testing.T) {
+	_, err := NewS3StoreWithClient(nil, "bucket", "", 8*24*time.Hour)
+	assert.Error(t, err)
+}
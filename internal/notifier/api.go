@@ -0,0 +1,336 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// maxAttempts is the number of times a request is sent before giving up on it when the
+	// Bot API keeps rate limiting it or failing with server errors
+	maxAttempts = 4
+	// retryBaseDelay is the delay before the first retry of a failed request. It doubles
+	// with every retry, unless the Bot API says how long to wait.
+	retryBaseDelay = time.Second
+
+	// The Bot API allows around 30 messages per second overall and one per second in each
+	// chat, with some room for short bursts
+	globalRate  = 25
+	globalBurst = 5
+	chatRate    = 1
+	chatBurst   = 3
+
+	// idleLimiterAge is how long the limiter of a chat is kept after its last request. By
+	// then it has refilled its burst, so a new one will behave just the same.
+	idleLimiterAge = time.Minute
+)
+
+var (
+	// ErrBotBlocked is returned when the user has blocked the bot
+	ErrBotBlocked = errors.New("bot blocked by the user")
+
+	// ErrChatNotFound is returned when the chat does not exist, e.g. because it has been deleted
+	ErrChatNotFound = errors.New("chat not found")
+
+	// ErrUserDeactivated is returned when the user of a private chat deleted their account
+	ErrUserDeactivated = errors.New("user is deactivated")
+
+	// ErrRecipientGone is returned when messages cannot be delivered to a chat anymore,
+	// for any of the reasons above or because the bot was kicked from the chat
+	ErrRecipientGone = errors.New("recipient gone")
+
+	// ErrTooManyRequests is returned when the Bot API keeps rate limiting requests after all retries
+	ErrTooManyRequests = errors.New("too many requests")
+
+	// ErrBadMarkup is returned when the Bot API cannot parse the HTML of a text
+	ErrBadMarkup = errors.New("bad markup")
+)
+
+// APIError is an error returned by the Bot API. It can be compared with errors.Is to the
+// errors above to find out its cause.
+type APIError struct {
+	Code        int
+	Description string
+	RetryAfter  time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Bot API error %d: %s", e.Code, e.Description)
+}
+
+func (e *APIError) Is(target error) bool {
+	desc := strings.ToLower(e.Description)
+	switch target {
+	case ErrBotBlocked:
+		return e.Code == http.StatusForbidden && strings.Contains(desc, "bot was blocked")
+	case ErrUserDeactivated:
+		return e.Code == http.StatusForbidden && strings.Contains(desc, "user is deactivated")
+	case ErrChatNotFound:
+		return strings.Contains(desc, "chat not found")
+	case ErrRecipientGone:
+		return e.Is(ErrBotBlocked) || e.Is(ErrUserDeactivated) || e.Is(ErrChatNotFound) ||
+			(e.Code == http.StatusForbidden && strings.Contains(desc, "bot was kicked"))
+	case ErrTooManyRequests:
+		return e.Code == http.StatusTooManyRequests
+	case ErrBadMarkup:
+		return e.Code == http.StatusBadRequest && strings.Contains(desc, "can't parse entities")
+	}
+
+	return false
+}
+
+// apiResponse is the envelope of every Bot API response
+type apiResponse struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	ErrorCode   int             `json:"error_code,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Parameters  *struct {
+		RetryAfter int `json:"retry_after,omitempty"`
+	} `json:"parameters,omitempty"`
+}
+
+// RateLimits keeps requests to the Bot API within its rate limits. The limits apply to the
+// bot as a whole, so every Notifier and Bot of the same bot must share the same RateLimits.
+type RateLimits struct {
+	global    *rate.Limiter
+	chatLimit rate.Limit
+	mu        sync.Mutex
+	chats     map[ChatID]*chatLimiter
+	swept     time.Time
+}
+
+// chatLimiter is the limiter of a chat along with the time of its last request
+type chatLimiter struct {
+	*rate.Limiter
+	lastUsed time.Time
+}
+
+// NewRateLimits returns RateLimits with the limits of the Bot API
+func NewRateLimits() *RateLimits {
+	return &RateLimits{
+		global:    rate.NewLimiter(globalRate, globalBurst),
+		chatLimit: chatRate,
+		chats:     map[ChatID]*chatLimiter{},
+	}
+}
+
+// wait blocks until a request for chatID is allowed or ctx is done
+func (rl *RateLimits) wait(ctx context.Context, chatID ChatID) error {
+	if err := rl.chatLimiter(chatID).Wait(ctx); err != nil {
+		return err
+	}
+
+	return rl.global.Wait(ctx)
+}
+
+// chatLimiter returns the limiter of chatID. The limiters of chats that have been idle for
+// idleLimiterAge are dropped every now and then, so that they do not pile up.
+func (rl *RateLimits) chatLimiter(chatID ChatID) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.swept) >= idleLimiterAge {
+		for id, l := range rl.chats {
+			if now.Sub(l.lastUsed) >= idleLimiterAge {
+				delete(rl.chats, id)
+			}
+		}
+		rl.swept = now
+	}
+
+	l, ok := rl.chats[chatID]
+	if !ok {
+		l = &chatLimiter{Limiter: rate.NewLimiter(rl.chatLimit, chatBurst)}
+		rl.chats[chatID] = l
+	}
+	l.lastUsed = now
+
+	return l.Limiter
+}
+
+// apiClient sends requests to the Bot API, respecting its rate limits and retrying the
+// requests that are rate limited or fail because of server errors or before being sent
+type apiClient struct {
+	baseURL *url.URL
+	http    *http.Client
+	limits  *RateLimits
+
+	// wait blocks for d or until ctx is done, it is only replaced in tests
+	wait func(ctx context.Context, d time.Duration) error
+}
+
+// newAPIClient returns an apiClient that respects limits, or limits of its own if nil
+func newAPIClient(baseURL *url.URL, hc *http.Client, limits *RateLimits) *apiClient {
+	if limits == nil {
+		limits = NewRateLimits()
+	}
+
+	return &apiClient{
+		baseURL: baseURL,
+		http:    hc,
+		limits:  limits,
+		wait:    wait,
+	}
+}
+
+// call sends a request to method for chatID and returns an *APIError if it fails
+func (ac *apiClient) call(ctx context.Context, chatID ChatID, method, contentType string, body []byte) error {
+	return ac.callResult(ctx, chatID, method, contentType, body, nil)
+}
+
+// callResult works like call, but also decodes the result of the request into result
+func (ac *apiClient) callResult(ctx context.Context, chatID ChatID, method, contentType string, body []byte, result interface{}) error {
+	return ac.callStream(ctx, chatID, method, contentType, func() (io.Reader, error) {
+		return bytes.NewReader(body), nil
+	}, result)
+}
+
+// callStream works like callResult, but reads the body of the request from the reader
+// returned by body, which is called again for every attempt so that it can be streamed
+func (ac *apiClient) callStream(ctx context.Context, chatID ChatID, method, contentType string, body func() (io.Reader, error), result interface{}) error {
+	u := methodURL(ac.baseURL, method)
+	delay := retryBaseDelay
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err := ac.limits.wait(ctx, chatID); err != nil {
+			return err
+		}
+
+		var r io.Reader
+		r, err = body()
+		if err != nil {
+			break
+		}
+
+		var retryAfter time.Duration
+		retryAfter, err = ac.send(ctx, u.String(), contentType, r, result)
+		if err == nil || retryAfter < 0 || attempt == maxAttempts {
+			break
+		}
+
+		if retryAfter == 0 {
+			retryAfter = delay
+			delay *= 2
+		}
+
+		// Do not wait in vain if ctx is done before the request can be retried
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < retryAfter {
+			break
+		}
+
+		if werr := ac.wait(ctx, retryAfter); werr != nil {
+			break
+		}
+	}
+
+	return err
+}
+
+// send sends a request once and decodes its result into result, if not nil. If it fails, it
+// also returns how long to wait before retrying it, 0 if the default backoff applies or a
+// negative duration if it should not be retried. Requests that fail after being written are
+// not retried, as the Bot API may have handled them even if their response was lost.
+func (ac *apiClient) send(ctx context.Context, u, contentType string, body io.Reader, result interface{}) (time.Duration, error) {
+	var written int32
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				atomic.StoreInt32(&written, 1)
+			}
+		},
+	}
+
+	resp, err := post(httptrace.WithClientTrace(ctx, trace), ac.http, u, contentType, body)
+	if err != nil {
+		if ctx.Err() != nil || atomic.LoadInt32(&written) == 1 {
+			return -1, err
+		}
+
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		if result == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			return 0, nil
+		}
+
+		// The request succeeded, so it must not be retried even if its result is unreadable
+		var ar apiResponse
+		if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
+			return -1, fmt.Errorf("unable to decode response: %w", err)
+		}
+		if err := json.Unmarshal(ar.Result, result); err != nil {
+			return -1, fmt.Errorf("unable to decode result: %w", err)
+		}
+
+		return 0, nil
+	}
+
+	apiErr := parseAPIError(resp)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return apiErr.RetryAfter, apiErr
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return 0, apiErr
+	default:
+		return -1, apiErr
+	}
+}
+
+// parseAPIError builds an *APIError from a failed response. Responses that do not carry a
+// Bot API error, like those of a proxy in between, are reported with their status code.
+func parseAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{Code: resp.StatusCode, Description: http.StatusText(resp.StatusCode)}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return apiErr
+	}
+
+	var ar apiResponse
+	if err := json.Unmarshal(data, &ar); err != nil || ar.OK {
+		return apiErr
+	}
+
+	if ar.ErrorCode != 0 {
+		apiErr.Code = ar.ErrorCode
+	}
+	if ar.Description != "" {
+		apiErr.Description = ar.Description
+	}
+	if ar.Parameters != nil {
+		apiErr.RetryAfter = time.Duration(ar.Parameters.RetryAfter) * time.Second
+	}
+
+	return apiErr
+}
+
+func wait(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
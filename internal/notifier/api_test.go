@@ -0,0 +1,235 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+// noWaits removes the limits and delays of ac, so that tests run fast, and returns the
+// delays it would have waited for
+func noWaits(ac *apiClient) *[]time.Duration {
+	waits := []time.Duration{}
+	ac.limits = &RateLimits{
+		global:    rate.NewLimiter(rate.Inf, 0),
+		chatLimit: rate.Inf,
+		chats:     map[ChatID]*chatLimiter{},
+	}
+	ac.wait = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+
+	return &waits
+}
+
+// scriptedServer replies to each request with the next status code and body of the script,
+// and with a 200 once the script is over
+func scriptedServer(codes []int, bodies []string) (*httptest.Server, *int) {
+	var mu sync.Mutex
+	calls := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		i := calls
+		calls++
+		if i >= len(codes) {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+			return
+		}
+
+		w.WriteHeader(codes[i])
+		_, _ = w.Write([]byte(bodies[i]))
+	}))
+
+	return svr, &calls
+}
+
+func newTestAPIClient(t *testing.T, svrURL string) (*apiClient, *[]time.Duration) {
+	u, err := url.Parse(svrURL)
+	require.NoError(t, err)
+
+	ac := newAPIClient(u, http.DefaultClient, nil)
+	return ac, noWaits(ac)
+}
+
+func TestCallHonoursRetryAfter(t *testing.T) {
+	svr, calls := scriptedServer(
+		[]int{http.StatusTooManyRequests},
+		[]string{`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 7","parameters":{"retry_after":7}}`},
+	)
+	defer svr.Close()
+
+	ac, waits := newTestAPIClient(t, svr.URL)
+
+	err := ac.call(context.Background(), 42, sendMessagePath, "text/plain", []byte{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, *calls)
+	assert.Equal(t, []time.Duration{7 * time.Second}, *waits)
+}
+
+func TestCallBacksOffOnServerErrors(t *testing.T) {
+	codes := []int{http.StatusBadGateway, http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusBadGateway}
+	svr, calls := scriptedServer(codes, []string{"bad gateway", `{"ok":false,"error_code":500,"description":"Internal Server Error"}`, "", ""})
+	defer svr.Close()
+
+	ac, waits := newTestAPIClient(t, svr.URL)
+
+	err := ac.call(context.Background(), 42, sendMessagePath, "text/plain", []byte{})
+
+	var apiErr *APIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusBadGateway, apiErr.Code)
+	assert.Equal(t, maxAttempts, *calls)
+	assert.Equal(t, []time.Duration{retryBaseDelay, 2 * retryBaseDelay, 4 * retryBaseDelay}, *waits)
+}
+
+func TestCallTypedErrors(t *testing.T) {
+	tests := []struct {
+		code     int
+		body     string
+		expected error
+	}{
+		{http.StatusForbidden, `{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`, ErrBotBlocked},
+		{http.StatusForbidden, `{"ok":false,"error_code":403,"description":"Forbidden: user is deactivated"}`, ErrUserDeactivated},
+		{http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`, ErrChatNotFound},
+	}
+
+	for _, tt := range tests {
+		svr, calls := scriptedServer([]int{tt.code}, []string{tt.body})
+
+		ac, waits := newTestAPIClient(t, svr.URL)
+		err := ac.call(context.Background(), 42, sendMessagePath, "text/plain", []byte{})
+
+		assert.ErrorIs(t, err, tt.expected)
+		assert.ErrorIs(t, err, ErrRecipientGone)
+		assert.Equal(t, 1, *calls, "Expected client errors not to be retried")
+		assert.Empty(t, *waits)
+
+		svr.Close()
+	}
+}
+
+func TestCallDoesNotWaitPastDeadline(t *testing.T) {
+	svr, calls := scriptedServer(
+		[]int{http.StatusTooManyRequests},
+		[]string{`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 60","parameters":{"retry_after":60}}`},
+	)
+	defer svr.Close()
+
+	ac, waits := newTestAPIClient(t, svr.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := ac.call(ctx, 42, sendMessagePath, "text/plain", []byte{})
+	assert.ErrorIs(t, err, ErrTooManyRequests)
+	assert.Equal(t, 1, *calls)
+	assert.Empty(t, *waits)
+}
+
+func TestCallDoesNotRetryLostResponses(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+
+		// The request is received, but the connection drops before the response is sent
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+	}))
+	defer svr.Close()
+
+	ac, waits := newTestAPIClient(t, svr.URL)
+
+	err := ac.call(context.Background(), 42, sendMessagePath, "text/plain", []byte{})
+	assert.Error(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, calls, "Expected requests that may have been handled not to be retried")
+	assert.Empty(t, *waits)
+}
+
+func TestCallRetriesUnsentRequests(t *testing.T) {
+	// Nothing listens at the address of a closed server, so requests cannot even be sent
+	svr := httptest.NewServer(http.NotFoundHandler())
+	svr.Close()
+
+	ac, waits := newTestAPIClient(t, svr.URL)
+
+	err := ac.call(context.Background(), 42, sendMessagePath, "text/plain", []byte{})
+	assert.Error(t, err)
+	assert.Len(t, *waits, maxAttempts-1)
+}
+
+func TestChatRateLimit(t *testing.T) {
+	svr, _ := scriptedServer(nil, nil)
+	defer svr.Close()
+
+	u, err := url.Parse(svr.URL)
+	require.NoError(t, err)
+	ac := newAPIClient(u, http.DefaultClient, nil)
+	ac.limits.chatLimit = rate.Every(50 * time.Millisecond)
+
+	start := time.Now()
+	for i := 0; i < chatBurst+2; i++ {
+		require.NoError(t, ac.call(context.Background(), 42, sendMessagePath, "text/plain", []byte{}))
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(90*time.Millisecond), "Expected requests beyond the burst to be delayed")
+
+	// Other chats have limits of their own
+	start = time.Now()
+	require.NoError(t, ac.call(context.Background(), 43, sendMessagePath, "text/plain", []byte{}))
+	assert.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+}
+
+func TestSharedRateLimits(t *testing.T) {
+	svr, _ := scriptedServer(nil, nil)
+	defer svr.Close()
+
+	u, err := url.Parse(svr.URL)
+	require.NoError(t, err)
+	limits := NewRateLimits()
+	limits.chatLimit = rate.Every(50 * time.Millisecond)
+	notifierClient := newAPIClient(u, http.DefaultClient, limits)
+	botClient := newAPIClient(u, http.DefaultClient, limits)
+
+	for i := 0; i < chatBurst; i++ {
+		require.NoError(t, notifierClient.call(context.Background(), 42, sendMessagePath, "text/plain", []byte{}))
+	}
+
+	// The burst of the chat is used up, no matter which client sent the requests
+	start := time.Now()
+	require.NoError(t, botClient.call(context.Background(), 42, sendMessagePath, "text/plain", []byte{}))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(40*time.Millisecond), "Expected requests of both clients to share limits")
+}
+
+func TestIdleChatLimitersAreDropped(t *testing.T) {
+	limits := NewRateLimits()
+	limits.chatLimiter(42)
+	limits.chatLimiter(43)
+
+	// Chat 42 has been idle for long, while chat 43 is still active
+	limits.chats[42].lastUsed = time.Now().Add(-idleLimiterAge)
+	limits.swept = time.Now().Add(-idleLimiterAge)
+	limits.chatLimiter(44)
+
+	assert.NotContains(t, limits.chats, ChatID(42))
+	assert.Contains(t, limits.chats, ChatID(43))
+	assert.Contains(t, limits.chats, ChatID(44))
+}
@@ -0,0 +1,419 @@
+package notifier
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/volmedo/almendruco.git/internal/raices"
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+const (
+	// sniffLength is the number of bytes needed to detect the content type of a file
+	sniffLength = 512
+
+	downloadFailedNote = "no se ha podido descargar de Raíces"
+	downloadRetryNote  = "no se ha podido descargar de Raíces, se volverá a intentar más tarde"
+)
+
+// fetchFunc opens the contents of an attachment, like raices.Attachment.Open does
+type fetchFunc func(ctx context.Context, a raices.Attachment) (io.ReadCloser, int64, error)
+
+// fetchFromRaices is the fetchFunc that downloads attachments from Raíces
+func fetchFromRaices(ctx context.Context, a raices.Attachment) (io.ReadCloser, int64, error) {
+	return a.Open(ctx)
+}
+
+// openAttachment is an attachment to send through Telegram. Its contents are streamed from
+// Raíces while it is uploaded, and only then is it open.
+type openAttachment struct {
+	raices.Attachment
+	fetch fetchFunc
+
+	// size is the size of the attachment in bytes, or -1 if it is not known
+	size        int64
+	contentType string
+
+	body io.ReadCloser
+}
+
+// check opens a with fetch to detect its content type from its first bytes and to find out
+// its size, and closes it right away. Attachments whose size is not known in advance are read
+// up to limit bytes to count it, and it stays unknown if they are bigger.
+func check(ctx context.Context, a raices.Attachment, fetch fetchFunc, limit int64) (*openAttachment, error) {
+	body, size, err := fetch(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	// Read errors are ignored here, they come up again when the contents are read
+	br := bufio.NewReaderSize(body, sniffLength)
+	head, _ := br.Peek(sniffLength)
+
+	oa := &openAttachment{
+		Attachment:  a,
+		fetch:       fetch,
+		size:        size,
+		contentType: http.DetectContentType(head),
+	}
+
+	if size < 0 {
+		n, err := io.Copy(io.Discard, io.LimitReader(br, limit+1))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read attachment %d: %w", a.ID, err)
+		}
+		if n <= limit {
+			oa.size = n
+		}
+	}
+
+	return oa, nil
+}
+
+// reader opens the attachment and returns its contents. Any contents handed out before are
+// closed, so that a failed upload can be retried.
+func (oa *openAttachment) reader(ctx context.Context) (io.Reader, error) {
+	_ = oa.Close()
+	body, _, err := oa.fetch(ctx, oa.Attachment)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open attachment %d: %w", oa.ID, err)
+	}
+	oa.body = body
+
+	return body, nil
+}
+
+func (oa *openAttachment) Close() error {
+	if oa.body == nil {
+		return nil
+	}
+
+	err := oa.body.Close()
+	oa.body = nil
+	return err
+}
+
+// isPhoto reports whether the attachment can be sent as a photo, judging by its contents
+func (oa *openAttachment) isPhoto() bool {
+	if oa.size < 0 || oa.size > maxPhotoSize {
+		return false
+	}
+
+	return oa.contentType == "image/jpeg" || oa.contentType == "image/png"
+}
+
+func closeAll(attachments []*openAttachment) {
+	for _, oa := range attachments {
+		_ = oa.Close()
+	}
+}
+
+// checkAttachments checks the attachments of m that have not been delivered yet, one at a
+// time, and returns those to send through Telegram, along with the notes to add to the rest
+// in the text of m, keyed by attachment ID. Those too big for Telegram are stored in the blob
+// store and their notes link to them. Attachments that cannot be downloaded are also
+// returned as failed if retry is true, otherwise they are given up on. If withNotes is false,
+// because the text has already been sent, nothing is stored.
+func (tn *telegramNotifier) checkAttachments(ctx context.Context, m raices.Message, ledger Ledger, withNotes, retry bool) ([]*openAttachment, map[uint64]bool, map[uint64]string, error) {
+	var pending []*openAttachment
+	failed := map[uint64]bool{}
+	notes := map[uint64]string{}
+	for _, a := range m.Attachments {
+		if ledger != nil && ledger.Delivered(repo.Delivery{MessageID: m.ID, AttachmentID: a.ID}) {
+			continue
+		}
+
+		oa, err := check(ctx, a, tn.fetch, int64(tn.maxUploadSize))
+		if err != nil {
+			if ctx.Err() != nil {
+				return pending, nil, nil, fmt.Errorf("unable to open attachment %d of message %d: %w", a.ID, m.ID, err)
+			}
+
+			log.Printf("unable to open attachment %d of message %d: %s", a.ID, m.ID, err)
+			if retry {
+				failed[a.ID] = true
+				notes[a.ID] = downloadRetryNote
+			} else {
+				notes[a.ID] = downloadFailedNote
+			}
+			continue
+		}
+
+		if oa.size >= 0 && oa.size <= int64(tn.maxUploadSize) {
+			pending = append(pending, oa)
+			continue
+		}
+
+		notes[a.ID] = undeliverableNote
+		if withNotes {
+			notes[a.ID] = tn.stash(ctx, m, oa)
+		}
+		_ = oa.Close()
+	}
+
+	return pending, failed, notes, nil
+}
+
+// stash stores oa in the blob store and returns the note to add to it in the text of m, which
+// links to the stored file or tells that it could not be delivered
+func (tn *telegramNotifier) stash(ctx context.Context, m raices.Message, oa *openAttachment) string {
+	if tn.blobs == nil {
+		return undeliverableNote
+	}
+
+	r, err := oa.reader(ctx)
+	if err != nil {
+		log.Printf("unable to store attachment %d of message %d: %s", oa.ID, m.ID, err)
+		return undeliverableNote
+	}
+
+	link, expires, err := tn.blobs.Put(ctx, oa.FileName, r)
+	if err != nil {
+		log.Printf("unable to store attachment %d of message %d: %s", oa.ID, m.ID, err)
+		return undeliverableNote
+	}
+
+	return fmt.Sprintf(linkNote, html.EscapeString(link), expires.Format(dateFormat))
+}
+
+// formatCaption returns the caption of the attachments of m, which tells what message they
+// belong to. Captions are sent as plain text, so nothing needs to be escaped.
+func formatCaption(m raices.Message, label string) string {
+	caption := fmt.Sprintf("Adjunto del mensaje «%s» del %s", m.Subject, m.SentDate.Format(dateFormat))
+	if label != "" {
+		caption = fmt.Sprintf("%s: %s", label, caption)
+	}
+
+	// Trim the caption to fit the limit, making room for the ellipsis
+	if textLength(caption) > maxCaptionLength {
+		runes := []rune(caption)
+		for textLength(string(runes)) > maxCaptionLength-1 {
+			runes = runes[:len(runes)-1]
+		}
+		caption = string(runes) + "…"
+	}
+
+	return caption
+}
+
+// sendAttachments sends the pending attachments of m as replies to the message replyTo, if
+// not 0. Photos are sent together in media groups, and anything else as documents. Each of
+// them is only open while it is being uploaded.
+func (tn *telegramNotifier) sendAttachments(ctx context.Context, chatID ChatID, m raices.Message, label string, replyTo int64, pending []*openAttachment, ledger Ledger) error {
+	caption := formatCaption(m, label)
+
+	var photos, documents []*openAttachment
+	for _, oa := range pending {
+		if oa.isPhoto() {
+			photos = append(photos, oa)
+		} else {
+			documents = append(documents, oa)
+		}
+	}
+
+	for len(photos) > 0 {
+		n := len(photos)
+		if n > maxMediaGroupSize {
+			n = maxMediaGroupSize
+		}
+		group := photos[:n]
+		photos = photos[n:]
+
+		err := tn.sendPhotos(ctx, chatID, group, caption, replyTo)
+		closeAll(group)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest && !errors.Is(err, ErrRecipientGone) {
+			// Photos with unusual dimensions are rejected, but they can still be sent as documents
+			documents = append(documents, group...)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, oa := range group {
+			if err := record(ctx, ledger, repo.Delivery{MessageID: m.ID, AttachmentID: oa.ID}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, oa := range documents {
+		oa := oa
+		err := deliver(ctx, ledger, repo.Delivery{MessageID: m.ID, AttachmentID: oa.ID}, func() error {
+			return tn.upload(ctx, chatID, sendDocumentPath, uploadFields(caption, replyTo), []uploadFile{{documentParam, oa}})
+		})
+		_ = oa.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inputMedia describes each of the photos in a media group
+type inputMedia struct {
+	Type    string `json:"type"`
+	Media   string `json:"media"`
+	Caption string `json:"caption,omitempty"`
+}
+
+// sendPhotos sends photos as a media group, or on its own if there is only one. The caption
+// is set on the first photo, which Telegram shows as the caption of the whole group.
+func (tn *telegramNotifier) sendPhotos(ctx context.Context, chatID ChatID, photos []*openAttachment, caption string, replyTo int64) error {
+	fields := uploadFields(caption, replyTo)
+	if len(photos) == 1 {
+		return tn.upload(ctx, chatID, sendPhotoPath, fields, []uploadFile{{photoParam, photos[0]}})
+	}
+
+	media := make([]inputMedia, 0, len(photos))
+	files := make([]uploadFile, 0, len(photos))
+	for i, p := range photos {
+		field := fmt.Sprintf("%s%d", photoParam, i)
+		media = append(media, inputMedia{Type: photoParam, Media: "attach://" + field})
+		files = append(files, uploadFile{field, p})
+	}
+	media[0].Caption = caption
+
+	data, err := json.Marshal(media)
+	if err != nil {
+		return err
+	}
+	fields.Del(captionParam)
+	fields.Set(mediaParam, string(data))
+
+	return tn.upload(ctx, chatID, sendMediaGroupPath, fields, files)
+}
+
+// uploadFile is an attachment sent in the given field of a multipart request
+type uploadFile struct {
+	field      string
+	attachment *openAttachment
+}
+
+// uploadFields returns the fields of an upload with the given caption, replying to the
+// message replyTo if not 0
+func uploadFields(caption string, replyTo int64) url.Values {
+	fields := url.Values{}
+	fields.Set(captionParam, caption)
+	if replyTo != 0 {
+		fields.Set(replyToParam, strconv.FormatInt(replyTo, 10))
+		fields.Set(allowWithoutReplyParam, "true")
+	}
+
+	return fields
+}
+
+// upload sends files to method in a multipart request along with fields. The request body is
+// written as it is sent, so the files are streamed and never held in memory.
+func (tn *telegramNotifier) upload(ctx context.Context, chatID ChatID, method string, fields url.Values, files []uploadFile) error {
+	// Every attempt writes a new body, all of them with the same boundary
+	mw := multipart.NewWriter(io.Discard)
+	boundary := mw.Boundary()
+
+	body := func() (io.Reader, error) {
+		readers := make([]io.Reader, len(files))
+		for i, f := range files {
+			r, err := f.attachment.reader(ctx)
+			if err != nil {
+				return nil, err
+			}
+			readers[i] = r
+		}
+
+		// The HTTP client closes the reader when done with the request, which stops the writer
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeMultipart(pw, boundary, chatID, fields, files, readers))
+		}()
+
+		return pr, nil
+	}
+
+	return tn.api.callStream(ctx, chatID, method, mw.FormDataContentType(), body, nil)
+}
+
+// writeMultipart writes to w a multipart body with chatID, fields and the contents of files,
+// read from readers
+func writeMultipart(w io.Writer, boundary string, chatID ChatID, fields url.Values, files []uploadFile, readers []io.Reader) error {
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	if err := addMultipartField(mw, chatIDParam, chatID); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := addMultipartField(mw, k, fields.Get(k)); err != nil {
+			return err
+		}
+	}
+
+	for i, f := range files {
+		if err := addMultipartFile(mw, f.field, f.attachment.FileName, f.attachment.contentType, readers[i]); err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+func addMultipartField(mw *multipart.Writer, name string, value interface{}) error {
+	fw, err := mw.CreateFormField(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprint(fw, value)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// addMultipartFile adds a file to mw like multipart.Writer.CreateFormFile does, but with the
+// given content type, so that Telegram can tell what kind of file it is
+func addMultipartFile(mw *multipart.Writer, fieldName, fileName, contentType string, r io.Reader) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		quoteEscaper.Replace(fieldName), quoteEscaper.Replace(fileName)))
+	h.Set("Content-Type", contentType)
+
+	fw, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fw, r)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
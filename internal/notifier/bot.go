@@ -0,0 +1,509 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/volmedo/almendruco.git/internal/raices"
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+const (
+	getUpdatesPath    = "getUpdates"
+	deleteMessagePath = "deleteMessage"
+
+	offsetParam         = "offset"
+	timeoutParam        = "timeout"
+	allowedUpdatesParam = "allowed_updates"
+	messageIDParam      = "message_id"
+
+	secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+	pollTimeout    = 30 * time.Second
+	pollRetryDelay = 5 * time.Second
+
+	chatTypePrivate = "private"
+
+	startCmd      = "/start"
+	registerCmd   = "/register"
+	unregisterCmd = "/unregister"
+	statusCmd     = "/status"
+	markReadCmd   = "/markread"
+	onlyUnreadCmd = "/onlyunread"
+)
+
+const (
+	helpText = "Hola! Te enviaré aquí los mensajes que recibas en Raíces.\n\n" +
+		"Estos son los comandos disponibles:\n" +
+		"/register &lt;usuario&gt; &lt;contraseña&gt; [nombre] - Empieza a recibir mensajes de una cuenta de Raíces. " +
+		"Si sigues varias cuentas, el nombre te ayudará a distinguir sus mensajes\n" +
+		"/unregister [usuario] - Deja de recibir mensajes de una cuenta, o de todas si no indicas ninguna\n" +
+		"/status - Muestra las cuentas que sigues\n" +
+		"/markread on|off - Marca como leídos en Raíces los mensajes que te envíe\n" +
+		"/onlyunread on|off - Envía sólo los mensajes que no hayas leído ya en Raíces"
+	registerUsageText         = "Uso: /register &lt;usuario&gt; &lt;contraseña&gt; [nombre]"
+	loginFailedText           = "No he podido iniciar sesión en Raíces con esas credenciales. Revisa el usuario y la contraseña e inténtalo de nuevo."
+	accountLockedText         = "Tu cuenta de Raíces está bloqueada. Desbloquéala desde la web de Raíces e inténtalo de nuevo."
+	raicesUnavailableText     = "No he podido conectar con Raíces, puede que esté en mantenimiento. Por favor, inténtalo de nuevo más tarde."
+	registeredText            = "Listo! A partir de ahora recibirás aquí los mensajes de Raíces del usuario <b>%s</b>."
+	unregisteredText          = "Hecho. Ya no recibirás más mensajes de Raíces en este chat."
+	accountRemovedText        = "Hecho. Ya no recibirás más mensajes de Raíces del usuario <b>%s</b>."
+	notRegisteredText         = "Este chat no está suscrito a ninguna cuenta de Raíces. Usa /register para suscribirte."
+	accountNotFoundText       = "Este chat no está suscrito a la cuenta de Raíces del usuario <b>%s</b>."
+	statusHeaderText          = "Este chat recibe los mensajes de Raíces de estas cuentas:"
+	statusAccountText         = "\n\n<b>%s</b>\nÚltimo mensaje notificado: %d"
+	statusLabelledAccountText = "\n\n<b>%s</b> (%s)\nÚltimo mensaje notificado: %d"
+	statusSuspendedText       = "\nNo se comprueban sus mensajes porque Raíces rechaza la contraseña. Vuelve a registrarla con /register."
+	statusMarkReadText        = "\n\nLos mensajes se marcan como leídos en Raíces al enviarlos."
+	statusOnlyUnreadText      = "\n\nSólo se envían los mensajes que no se han leído ya en Raíces."
+	markReadUsageText         = "Uso: /markread on|off"
+	markReadOnText            = "Hecho. Marcaré como leídos en Raíces los mensajes que te envíe."
+	markReadOffText           = "Hecho. Ya no marcaré como leídos en Raíces los mensajes que te envíe, podrás hacerlo con el botón de cada mensaje."
+	onlyUnreadUsageText       = "Uso: /onlyunread on|off"
+	onlyUnreadOnText          = "Hecho. Sólo te enviaré los mensajes que no hayas leído ya en Raíces."
+	onlyUnreadOffText         = "Hecho. Te enviaré todos los mensajes, aunque ya los hayas leído en Raíces."
+	reenabledText             = "Bienvenido de nuevo! Volverás a recibir aquí los mensajes de Raíces."
+	onlyPrivateChatsText      = "Lo siento, de momento sólo puedo enviar mensajes a chats privados."
+	internalErrorText         = "Algo ha ido mal. Por favor, inténtalo de nuevo más tarde."
+)
+
+// Bot handles the commands users send to the Telegram bot. Updates can be received either
+// through a webhook, by serving the bot as an http.Handler, or by long-polling the Bot API.
+type Bot interface {
+	http.Handler
+	Poll(ctx context.Context) error
+}
+
+type telegramBot struct {
+	baseURL     *url.URL
+	http        *http.Client
+	api         *apiClient
+	secretToken string
+	repo        repo.Repo
+	raices      raices.Client
+}
+
+type update struct {
+	ID            int64            `json:"update_id"`
+	Message       *incomingMessage `json:"message,omitempty"`
+	CallbackQuery *callbackQuery   `json:"callback_query,omitempty"`
+}
+
+type incomingMessage struct {
+	ID   int64        `json:"message_id"`
+	Chat incomingChat `json:"chat"`
+	Text string       `json:"text"`
+}
+
+// callbackQuery is sent when a button of a message sent by the bot is tapped
+type callbackQuery struct {
+	ID      string           `json:"id"`
+	Message *incomingMessage `json:"message,omitempty"`
+	Data    string           `json:"data"`
+}
+
+type incomingChat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+type updatesResponse struct {
+	OK          bool     `json:"ok"`
+	Description string   `json:"description,omitempty"`
+	Result      []update `json:"result"`
+}
+
+// NewTelegramBot returns a Bot that manages chat subscriptions in the given repo. Credentials
+// are validated with a login in Raíces before being stored. If secretToken is not empty, webhook
+// requests not carrying it in the corresponding header are rejected. Replies are sent within
+// limits, which should be shared with any Notifier of the same bot, or limits of its own if nil.
+func NewTelegramBot(baseURL, botToken, secretToken string, r repo.Repo, rc raices.Client, limits *RateLimits) (Bot, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/bot%s", baseURL, botToken))
+	if err != nil {
+		return &telegramBot{}, fmt.Errorf("bad baseURL and/or botToken: %s", err)
+	}
+
+	// The client timeout must leave room for the long-polling timeout
+	hc := &http.Client{Timeout: pollTimeout + 10*time.Second}
+
+	return &telegramBot{
+		baseURL:     u,
+		http:        hc,
+		api:         newAPIClient(u, hc, limits),
+		secretToken: secretToken,
+		repo:        r,
+		raices:      rc,
+	}, nil
+}
+
+// ServeHTTP handles updates delivered by Telegram to the webhook. Errors handling an update
+// are logged but never reported back to Telegram, otherwise it would keep delivering the
+// same update over and over again.
+func (tb *telegramBot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if tb.secretToken != "" && r.Header.Get(secretTokenHeader) != tb.secretToken {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var u update
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "bad update", http.StatusBadRequest)
+		return
+	}
+
+	if err := tb.handleUpdate(r.Context(), u); err != nil {
+		log.Printf("error handling update %d: %s", u.ID, err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Poll fetches updates from Telegram using long-polling and handles them until ctx is done
+func (tb *telegramBot) Poll(ctx context.Context) error {
+	var offset int64
+	for {
+		updates, err := tb.getUpdates(ctx, offset)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			log.Printf("error getting updates: %s", err)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(pollRetryDelay):
+				continue
+			}
+		}
+
+		for _, u := range updates {
+			if err := tb.handleUpdate(ctx, u); err != nil {
+				log.Printf("error handling update %d: %s", u.ID, err)
+			}
+
+			offset = u.ID + 1
+		}
+	}
+}
+
+func (tb *telegramBot) getUpdates(ctx context.Context, offset int64) ([]update, error) {
+	q := url.Values{}
+	q.Set(offsetParam, strconv.FormatInt(offset, 10))
+	q.Set(timeoutParam, strconv.Itoa(int(pollTimeout.Seconds())))
+	q.Set(allowedUpdatesParam, `["message","callback_query"]`)
+
+	u := methodURL(tb.baseURL, getUpdatesPath)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return []update{}, err
+	}
+
+	resp, err := tb.http.Do(req)
+	if err != nil {
+		return []update{}, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return []update{}, err
+	}
+
+	var updResp updatesResponse
+	if err := json.Unmarshal(data, &updResp); err != nil {
+		return []update{}, err
+	}
+
+	if !updResp.OK {
+		return []update{}, fmt.Errorf("received status code %d: %s", resp.StatusCode, updResp.Description)
+	}
+
+	return updResp.Result, nil
+}
+
+func (tb *telegramBot) handleUpdate(ctx context.Context, u update) error {
+	if u.CallbackQuery != nil {
+		return tb.markRead(ctx, u.CallbackQuery)
+	}
+
+	m := u.Message
+	if m == nil || !strings.HasPrefix(m.Text, "/") {
+		return nil
+	}
+
+	if m.Chat.Type != chatTypePrivate {
+		return tb.reply(ctx, m.Chat.ID, onlyPrivateChatsText)
+	}
+
+	cmd, args := parseCommand(m.Text)
+	switch cmd {
+	case startCmd:
+		return tb.start(ctx, m)
+	case registerCmd:
+		return tb.register(ctx, m, args)
+	case unregisterCmd:
+		return tb.unregister(ctx, m, args)
+	case statusCmd:
+		return tb.status(ctx, m)
+	case markReadCmd:
+		return tb.setOption(ctx, m, args, tb.repo.SetMarkRead, markReadUsageText, markReadOnText, markReadOffText)
+	case onlyUnreadCmd:
+		return tb.setOption(ctx, m, args, tb.repo.SetOnlyUnread, onlyUnreadUsageText, onlyUnreadOnText, onlyUnreadOffText)
+	default:
+		return tb.reply(ctx, m.Chat.ID, helpText)
+	}
+}
+
+// start greets the user and enables the chat again if it was disabled, which happens when
+// the user blocks the bot and they must have unblocked it to send the command
+func (tb *telegramBot) start(ctx context.Context, m *incomingMessage) error {
+	chatID := strconv.FormatInt(m.Chat.ID, 10)
+	chat, err := tb.repo.GetChat(ctx, chatID)
+	if errors.Is(err, repo.ErrChatNotFound) || (err == nil && !chat.Disabled()) {
+		return tb.reply(ctx, m.Chat.ID, helpText)
+	}
+	if err != nil {
+		_ = tb.reply(ctx, m.Chat.ID, internalErrorText)
+		return fmt.Errorf("unable to fetch chat from repo: %w", err)
+	}
+
+	if err := tb.repo.EnableChat(ctx, chatID); err != nil {
+		_ = tb.reply(ctx, m.Chat.ID, internalErrorText)
+		return fmt.Errorf("unable to enable chat: %w", err)
+	}
+
+	return tb.reply(ctx, m.Chat.ID, reenabledText+"\n\n"+helpText)
+}
+
+func (tb *telegramBot) register(ctx context.Context, m *incomingMessage, args []string) error {
+	// The message contains a password in clear text, so it's better not to leave it
+	// lying around in the chat history
+	if err := tb.deleteMessage(ctx, m.Chat.ID, m.ID); err != nil {
+		log.Printf("unable to delete register message in chat %d: %s", m.Chat.ID, err)
+	}
+
+	if len(args) < 2 {
+		return tb.reply(ctx, m.Chat.ID, registerUsageText)
+	}
+
+	creds := repo.Credentials{User: args[0], Pass: args[1]}
+	if err := tb.raices.CheckCredentials(ctx, creds); err != nil {
+		log.Printf("login failed for chat %d: %s", m.Chat.ID, err)
+		return tb.reply(ctx, m.Chat.ID, loginFailureText(err))
+	}
+
+	chatID := strconv.FormatInt(m.Chat.ID, 10)
+	chat, err := tb.repo.GetChat(ctx, chatID)
+	if err != nil && !errors.Is(err, repo.ErrChatNotFound) {
+		_ = tb.reply(ctx, m.Chat.ID, internalErrorText)
+		return fmt.Errorf("unable to fetch chat from repo: %w", err)
+	}
+
+	// Registering an account again keeps its last notified message, so that a password
+	// update does not result in old messages being notified again. New credentials lift
+	// the suspension of an account whose logins were failing.
+	account, _ := chat.Account(creds.User)
+	account.Credentials = creds
+	account.LoginFailures = 0
+	if len(args) > 2 {
+		account.Label = strings.Join(args[2:], " ")
+	}
+
+	if err := tb.repo.SaveAccount(ctx, chatID, account); err != nil {
+		_ = tb.reply(ctx, m.Chat.ID, internalErrorText)
+		return fmt.Errorf("unable to save account: %w", err)
+	}
+
+	// A user that blocked the bot has unblocked it to register
+	if chat.Disabled() {
+		if err := tb.repo.EnableChat(ctx, chatID); err != nil {
+			_ = tb.reply(ctx, m.Chat.ID, internalErrorText)
+			return fmt.Errorf("unable to enable chat: %w", err)
+		}
+	}
+
+	return tb.reply(ctx, m.Chat.ID, fmt.Sprintf(registeredText, html.EscapeString(creds.User)))
+}
+
+// loginFailureText returns the reply to a registration whose login failed with err. Errors
+// that Raíces does not report in its responses are not the fault of the credentials.
+func loginFailureText(err error) string {
+	var se *raices.StatusError
+	switch {
+	case errors.Is(err, raices.ErrAccountLocked):
+		return accountLockedText
+	case errors.Is(err, raices.ErrMaintenance), errors.Is(err, raices.ErrVersionRejected), !errors.As(err, &se):
+		return raicesUnavailableText
+	default:
+		return loginFailedText
+	}
+}
+
+func (tb *telegramBot) unregister(ctx context.Context, m *incomingMessage, args []string) error {
+	chatID := strconv.FormatInt(m.Chat.ID, 10)
+	if len(args) == 0 {
+		err := tb.repo.DeleteChat(ctx, chatID)
+		if errors.Is(err, repo.ErrChatNotFound) {
+			return tb.reply(ctx, m.Chat.ID, notRegisteredText)
+		}
+
+		if err != nil {
+			_ = tb.reply(ctx, m.Chat.ID, internalErrorText)
+			return fmt.Errorf("unable to delete chat: %w", err)
+		}
+
+		return tb.reply(ctx, m.Chat.ID, unregisteredText)
+	}
+
+	user := args[0]
+	chat, err := tb.repo.GetChat(ctx, chatID)
+	if errors.Is(err, repo.ErrChatNotFound) {
+		return tb.reply(ctx, m.Chat.ID, notRegisteredText)
+	}
+
+	if err != nil {
+		_ = tb.reply(ctx, m.Chat.ID, internalErrorText)
+		return fmt.Errorf("unable to fetch chat from repo: %w", err)
+	}
+
+	if !chat.RemoveAccount(user) {
+		return tb.reply(ctx, m.Chat.ID, fmt.Sprintf(accountNotFoundText, html.EscapeString(user)))
+	}
+
+	if len(chat.Accounts) == 0 {
+		err = tb.repo.DeleteChat(ctx, chatID)
+	} else {
+		err = tb.repo.DeleteAccount(ctx, chatID, user)
+	}
+
+	if errors.Is(err, repo.ErrChatNotFound) || errors.Is(err, repo.ErrAccountNotFound) {
+		return tb.reply(ctx, m.Chat.ID, fmt.Sprintf(accountNotFoundText, html.EscapeString(user)))
+	}
+
+	if err != nil {
+		_ = tb.reply(ctx, m.Chat.ID, internalErrorText)
+		return fmt.Errorf("unable to remove account from chat: %w", err)
+	}
+
+	return tb.reply(ctx, m.Chat.ID, fmt.Sprintf(accountRemovedText, html.EscapeString(user)))
+}
+
+func (tb *telegramBot) status(ctx context.Context, m *incomingMessage) error {
+	chat, err := tb.repo.GetChat(ctx, strconv.FormatInt(m.Chat.ID, 10))
+	if errors.Is(err, repo.ErrChatNotFound) || (err == nil && len(chat.Accounts) == 0) {
+		return tb.reply(ctx, m.Chat.ID, notRegisteredText)
+	}
+
+	if err != nil {
+		_ = tb.reply(ctx, m.Chat.ID, internalErrorText)
+		return fmt.Errorf("unable to fetch chat from repo: %w", err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(statusHeaderText)
+	for _, a := range chat.Accounts {
+		user := html.EscapeString(a.Credentials.User)
+		if a.Label != "" {
+			sb.WriteString(fmt.Sprintf(statusLabelledAccountText, user, html.EscapeString(a.Label), a.LastNotifiedMessage))
+		} else {
+			sb.WriteString(fmt.Sprintf(statusAccountText, user, a.LastNotifiedMessage))
+		}
+		if a.Suspended() {
+			sb.WriteString(statusSuspendedText)
+		}
+	}
+
+	if chat.MarkRead {
+		sb.WriteString(statusMarkReadText)
+	}
+	if chat.OnlyUnread {
+		sb.WriteString(statusOnlyUnreadText)
+	}
+
+	return tb.reply(ctx, m.Chat.ID, sb.String())
+}
+
+// setOption turns an option of the chat on or off with set, as told by the only argument of
+// the command
+func (tb *telegramBot) setOption(ctx context.Context, m *incomingMessage, args []string, set func(ctx context.Context, chatID string, on bool) error, usageText, onText, offText string) error {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return tb.reply(ctx, m.Chat.ID, usageText)
+	}
+	on := args[0] == "on"
+
+	err := set(ctx, strconv.FormatInt(m.Chat.ID, 10), on)
+	if errors.Is(err, repo.ErrChatNotFound) {
+		return tb.reply(ctx, m.Chat.ID, notRegisteredText)
+	}
+
+	if err != nil {
+		_ = tb.reply(ctx, m.Chat.ID, internalErrorText)
+		return fmt.Errorf("unable to set option of chat: %w", err)
+	}
+
+	if on {
+		return tb.reply(ctx, m.Chat.ID, onText)
+	}
+
+	return tb.reply(ctx, m.Chat.ID, offText)
+}
+
+func (tb *telegramBot) reply(ctx context.Context, chatID int64, text string) error {
+	params := url.Values{}
+	params.Set(chatIDParam, strconv.FormatInt(chatID, 10))
+	params.Set(parseModeParam, parseModeHTML)
+	params.Set(textParam, text)
+
+	return tb.api.call(ctx, ChatID(chatID), sendMessagePath, formContentType, []byte(params.Encode()))
+}
+
+func (tb *telegramBot) deleteMessage(ctx context.Context, chatID, messageID int64) error {
+	params := url.Values{}
+	params.Set(chatIDParam, strconv.FormatInt(chatID, 10))
+	params.Set(messageIDParam, strconv.FormatInt(messageID, 10))
+
+	return tb.api.call(ctx, ChatID(chatID), deleteMessagePath, formContentType, []byte(params.Encode()))
+}
+
+// parseCommand splits a message text into the command and its arguments. Commands sent
+// in groups may carry a bot username suffix ("/status@almendruco_bot") that is removed.
+func parseCommand(text string) (string, []string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return "", []string{}
+	}
+
+	cmd := fields[0]
+	if i := strings.Index(cmd, "@"); i != -1 {
+		cmd = cmd[:i]
+	}
+
+	return strings.ToLower(cmd), fields[1:]
+}
+
+func methodURL(baseURL *url.URL, method string) *url.URL {
+	u, _ := url.Parse(baseURL.String())
+	u.Path = path.Join(u.Path, method)
+
+	return u
+}
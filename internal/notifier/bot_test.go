@@ -0,0 +1,404 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/volmedo/almendruco.git/internal/raices"
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+// fakeRepo keeps chats in memory. It does not implement SaveChat, so that the bot is
+// caught rewriting whole chats, which would undo updates made meanwhile by a run.
+type fakeRepo struct {
+	repo.Repo
+	chats map[string]repo.Chat
+}
+
+func (fr *fakeRepo) GetChat(ctx context.Context, chatID string) (repo.Chat, error) {
+	c, ok := fr.chats[chatID]
+	if !ok {
+		return repo.Chat{}, repo.ErrChatNotFound
+	}
+
+	// Like real repos, return a copy that can be changed without changing the stored chat
+	c.Accounts = append([]repo.Account(nil), c.Accounts...)
+	return c, nil
+}
+
+func (fr *fakeRepo) SaveAccount(ctx context.Context, chatID string, a repo.Account) error {
+	c := fr.chats[chatID]
+	c.ID = chatID
+	if old, ok := c.Account(a.Credentials.User); ok {
+		a.LastNotifiedMessage = old.LastNotifiedMessage
+	}
+	c.SetAccount(a)
+	fr.chats[chatID] = c
+	return nil
+}
+
+func (fr *fakeRepo) DeleteAccount(ctx context.Context, chatID, user string) error {
+	c := fr.chats[chatID]
+	if !c.RemoveAccount(user) {
+		return repo.ErrAccountNotFound
+	}
+
+	fr.chats[chatID] = c
+	return nil
+}
+
+func (fr *fakeRepo) DeleteChat(ctx context.Context, chatID string) error {
+	if _, ok := fr.chats[chatID]; !ok {
+		return repo.ErrChatNotFound
+	}
+
+	delete(fr.chats, chatID)
+	return nil
+}
+
+func (fr *fakeRepo) EnableChat(ctx context.Context, chatID string) error {
+	return fr.updateChat(chatID, func(c *repo.Chat) {
+		c.DisabledAt = time.Time{}
+		c.DisabledReason = ""
+	})
+}
+
+func (fr *fakeRepo) SetMarkRead(ctx context.Context, chatID string, on bool) error {
+	return fr.updateChat(chatID, func(c *repo.Chat) { c.MarkRead = on })
+}
+
+func (fr *fakeRepo) SetOnlyUnread(ctx context.Context, chatID string, on bool) error {
+	return fr.updateChat(chatID, func(c *repo.Chat) { c.OnlyUnread = on })
+}
+
+func (fr *fakeRepo) updateChat(chatID string, update func(c *repo.Chat)) error {
+	c, ok := fr.chats[chatID]
+	if !ok {
+		return repo.ErrChatNotFound
+	}
+
+	update(&c)
+	fr.chats[chatID] = c
+	return nil
+}
+
+type fakeRaicesClient struct {
+	raices.Client
+	pass   string
+	err    error
+	marked []uint64
+}
+
+func (fc *fakeRaicesClient) MarkRead(ctx context.Context, creds repo.Credentials, messageID uint64) error {
+	if creds.Pass != fc.pass {
+		return &raices.StatusError{Code: "E", Description: "Usuario o clave incorrectos"}
+	}
+
+	fc.marked = append(fc.marked, messageID)
+	return nil
+}
+
+func (fc *fakeRaicesClient) CheckCredentials(ctx context.Context, creds repo.Credentials) error {
+	if fc.err != nil {
+		return fc.err
+	}
+
+	if creds.Pass != fc.pass {
+		return &raices.StatusError{Code: "E", Description: "Usuario o clave incorrectos"}
+	}
+
+	return nil
+}
+
+type telegramRecorder struct {
+	sync.Mutex
+	texts   []string
+	deleted []string
+	edited  []string
+	answers []string
+}
+
+func (tr *telegramRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	_ = r.ParseForm()
+	switch {
+	case strings.HasSuffix(r.URL.Path, sendMessagePath):
+		tr.texts = append(tr.texts, r.Form.Get(textParam))
+	case strings.HasSuffix(r.URL.Path, deleteMessagePath):
+		tr.deleted = append(tr.deleted, r.Form.Get(messageIDParam))
+	case strings.HasSuffix(r.URL.Path, editMessageReplyMarkupPath):
+		tr.edited = append(tr.edited, r.Form.Get(messageIDParam))
+	case strings.HasSuffix(r.URL.Path, answerCallbackQueryPath):
+		tr.answers = append(tr.answers, r.Form.Get(textParam))
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func newTestBot(t *testing.T, secretToken string) (Bot, *fakeRepo, *telegramRecorder, func()) {
+	rec := &telegramRecorder{}
+	svr := httptest.NewServer(rec)
+
+	fr := &fakeRepo{chats: map[string]repo.Chat{}}
+	b, err := NewTelegramBot(svr.URL, "test_token", secretToken, fr, &fakeRaicesClient{pass: "s3cr3t"}, nil)
+	require.NoError(t, err)
+
+	return b, fr, rec, svr.Close
+}
+
+func sendUpdate(b Bot, body string, secretToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if secretToken != "" {
+		req.Header.Set(secretTokenHeader, secretToken)
+	}
+
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestRegister(t *testing.T) {
+	b, fr, rec, done := newTestBot(t, "")
+	defer done()
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}, "text": "/register someuser s3cr3t"}}`
+	w := sendUpdate(b, upd, "")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"7"}, rec.deleted)
+	require.Len(t, rec.texts, 1)
+	assert.Contains(t, rec.texts[0], "someuser")
+
+	expected := repo.Chat{
+		ID: "42",
+		Accounts: []repo.Account{
+			{Credentials: repo.Credentials{User: "someuser", Pass: "s3cr3t"}},
+		},
+	}
+	assert.Equal(t, expected, fr.chats["42"])
+}
+
+func TestRegisterSecondAccount(t *testing.T) {
+	b, fr, _, done := newTestBot(t, "")
+	defer done()
+
+	first := repo.Account{Credentials: repo.Credentials{User: "someuser", Pass: "s3cr3t"}, LastNotifiedMessage: 1234}
+	fr.chats["42"] = repo.Chat{ID: "42", Accounts: []repo.Account{first}}
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}, "text": "/register otheruser s3cr3t María José"}}`
+	sendUpdate(b, upd, "")
+
+	expected := []repo.Account{
+		first,
+		{Label: "María José", Credentials: repo.Credentials{User: "otheruser", Pass: "s3cr3t"}},
+	}
+	assert.Equal(t, expected, fr.chats["42"].Accounts)
+}
+
+func TestRegisterKeepsLastNotifiedMessageForSameUser(t *testing.T) {
+	b, fr, _, done := newTestBot(t, "")
+	defer done()
+
+	fr.chats["42"] = repo.Chat{
+		ID: "42",
+		Accounts: []repo.Account{
+			{Label: "Lucía", Credentials: repo.Credentials{User: "someuser", Pass: "old"}, LastNotifiedMessage: 1234, LoginFailures: repo.MaxLoginFailures},
+		},
+	}
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}, "text": "/register someuser s3cr3t"}}`
+	sendUpdate(b, upd, "")
+
+	require.Len(t, fr.chats["42"].Accounts, 1)
+	account := fr.chats["42"].Accounts[0]
+	assert.Equal(t, "s3cr3t", account.Credentials.Pass)
+	assert.Equal(t, "Lucía", account.Label)
+	assert.Equal(t, uint64(1234), account.LastNotifiedMessage)
+	assert.Zero(t, account.LoginFailures, "Expected new credentials to lift the suspension")
+}
+
+func TestRegisterBadCredentials(t *testing.T) {
+	b, fr, rec, done := newTestBot(t, "")
+	defer done()
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}, "text": "/register someuser wrong"}}`
+	sendUpdate(b, upd, "")
+
+	assert.Empty(t, fr.chats)
+	require.Len(t, rec.texts, 1)
+	assert.Equal(t, loginFailedText, rec.texts[0])
+}
+
+func TestRegisterRaicesUnavailable(t *testing.T) {
+	b, fr, rec, done := newTestBot(t, "")
+	defer done()
+	b.(*telegramBot).raices = &fakeRaicesClient{err: fmt.Errorf("%w: received status code 503", raices.ErrMaintenance)}
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}, "text": "/register someuser s3cr3t"}}`
+	sendUpdate(b, upd, "")
+
+	assert.Empty(t, fr.chats)
+	require.Len(t, rec.texts, 1)
+	assert.Equal(t, raicesUnavailableText, rec.texts[0])
+}
+
+func TestUnregister(t *testing.T) {
+	b, fr, rec, done := newTestBot(t, "")
+	defer done()
+
+	fr.chats["42"] = repo.Chat{ID: "42"}
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}, "text": "/unregister"}}`
+	sendUpdate(b, upd, "")
+	sendUpdate(b, upd, "")
+
+	assert.Empty(t, fr.chats)
+	assert.Equal(t, []string{unregisteredText, notRegisteredText}, rec.texts)
+}
+
+func TestUnregisterAccount(t *testing.T) {
+	b, fr, _, done := newTestBot(t, "")
+	defer done()
+
+	fr.chats["42"] = repo.Chat{
+		ID: "42",
+		Accounts: []repo.Account{
+			{Credentials: repo.Credentials{User: "user1"}},
+			{Credentials: repo.Credentials{User: "user2"}},
+		},
+	}
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}, "text": "/unregister user1"}}`
+	sendUpdate(b, upd, "")
+
+	assert.Equal(t, []repo.Account{{Credentials: repo.Credentials{User: "user2"}}}, fr.chats["42"].Accounts)
+
+	upd = `{"update_id": 2, "message": {"message_id": 8, "chat": {"id": 42, "type": "private"}, "text": "/unregister user2"}}`
+	sendUpdate(b, upd, "")
+
+	assert.Empty(t, fr.chats)
+}
+
+func TestStartEnablesDisabledChat(t *testing.T) {
+	b, fr, rec, done := newTestBot(t, "")
+	defer done()
+
+	fr.chats["42"] = repo.Chat{ID: "42", DisabledAt: time.Now(), DisabledReason: "bot blocked by the user"}
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}, "text": "/start"}}`
+	sendUpdate(b, upd, "")
+	sendUpdate(b, upd, "")
+
+	assert.False(t, fr.chats["42"].Disabled())
+	assert.Equal(t, []string{reenabledText + "\n\n" + helpText, helpText}, rec.texts)
+}
+
+func TestRegisterEnablesDisabledChat(t *testing.T) {
+	b, fr, _, done := newTestBot(t, "")
+	defer done()
+
+	fr.chats["42"] = repo.Chat{ID: "42", DisabledAt: time.Now(), DisabledReason: "bot blocked by the user"}
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}, "text": "/register someuser s3cr3t"}}`
+	sendUpdate(b, upd, "")
+
+	assert.False(t, fr.chats["42"].Disabled())
+	assert.Empty(t, fr.chats["42"].DisabledReason)
+}
+
+func TestChatOptions(t *testing.T) {
+	b, fr, rec, done := newTestBot(t, "")
+	defer done()
+	noWaits(b.(*telegramBot).api)
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}, "text": "%s"}}`
+	sendUpdate(b, fmt.Sprintf(upd, "/markread on"), "")
+	assert.Equal(t, []string{notRegisteredText}, rec.texts)
+
+	fr.chats["42"] = repo.Chat{ID: "42", Accounts: []repo.Account{{Credentials: repo.Credentials{User: "someuser", Pass: "s3cr3t"}}}}
+	sendUpdate(b, fmt.Sprintf(upd, "/markread on"), "")
+	sendUpdate(b, fmt.Sprintf(upd, "/onlyunread on"), "")
+	sendUpdate(b, fmt.Sprintf(upd, "/onlyunread off"), "")
+	sendUpdate(b, fmt.Sprintf(upd, "/markread yes"), "")
+
+	assert.True(t, fr.chats["42"].MarkRead)
+	assert.False(t, fr.chats["42"].OnlyUnread)
+	assert.Equal(t, []string{notRegisteredText, markReadOnText, onlyUnreadOnText, onlyUnreadOffText, markReadUsageText}, rec.texts)
+}
+
+func TestMarkReadButton(t *testing.T) {
+	b, fr, rec, done := newTestBot(t, "")
+	defer done()
+	noWaits(b.(*telegramBot).api)
+
+	fr.chats["42"] = repo.Chat{ID: "42", Accounts: []repo.Account{
+		{Credentials: repo.Credentials{User: "someuser", Pass: "s3cr3t"}},
+		{Credentials: repo.Credentials{User: "suspended", Pass: "old"}, LoginFailures: repo.MaxLoginFailures},
+	}}
+
+	upd := `{"update_id": 1, "callback_query": {"id": "q1", "data": "%s", "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}}}}`
+	sendUpdate(b, fmt.Sprintf(upd, "read:1234:someuser"), "")
+	sendUpdate(b, fmt.Sprintf(upd, "read:1235:otheruser"), "")
+	sendUpdate(b, fmt.Sprintf(upd, "read:1236:suspended"), "")
+
+	assert.Equal(t, []uint64{1234}, b.(*telegramBot).raices.(*fakeRaicesClient).marked)
+	assert.Equal(t, []string{"7"}, rec.edited, "Expected the button to be removed")
+	assert.Equal(t, []string{markedReadText, readAccountNotFoundText, readAccountSuspendedText}, rec.answers)
+}
+
+func TestParseReadCallback(t *testing.T) {
+	user, id, ok := parseReadCallback("read:1234:some:user")
+	assert.True(t, ok)
+	assert.Equal(t, "some:user", user)
+	assert.Equal(t, uint64(1234), id)
+
+	for _, data := range []string{"", "read", "read:1234", "read:1234:", "read:abc:user", "other:1234:user"} {
+		_, _, ok := parseReadCallback(data)
+		assert.False(t, ok, "Expected %q not to be parsed", data)
+	}
+}
+
+func TestOnlyPrivateChats(t *testing.T) {
+	b, fr, rec, done := newTestBot(t, "")
+	defer done()
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": -42, "type": "group"}, "text": "/register someuser s3cr3t"}}`
+	sendUpdate(b, upd, "")
+
+	assert.Empty(t, fr.chats)
+	assert.Equal(t, []string{onlyPrivateChatsText}, rec.texts)
+}
+
+func TestWebhookSecretToken(t *testing.T) {
+	b, _, rec, done := newTestBot(t, "webhook_secret")
+	defer done()
+
+	upd := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42, "type": "private"}, "text": "/start"}}`
+
+	w := sendUpdate(b, upd, "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, rec.texts)
+
+	w = sendUpdate(b, upd, "webhook_secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{helpText}, rec.texts)
+}
+
+func TestParseCommand(t *testing.T) {
+	cmd, args := parseCommand("/Register@almendruco_bot  user   pass ")
+
+	assert.Equal(t, registerCmd, cmd)
+	assert.Equal(t, []string{"user", "pass"}, args)
+}
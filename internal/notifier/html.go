@@ -0,0 +1,432 @@
+package notifier
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// formatBody converts the HTML body of a message from Raíces to the subset of HTML supported
+// by the Bot API. Formatting and links are kept, block elements become line breaks, lists are
+// rendered as bullets and tables as aligned text. Anything else is reduced to its text.
+func formatBody(body string) string {
+	parent := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(body), parent)
+	if err != nil {
+		// Parsing only fails if the input cannot be read, which cannot happen with a string
+		return html.EscapeString(body)
+	}
+
+	r := &bodyRenderer{}
+	for _, n := range nodes {
+		r.render(n)
+	}
+
+	return strings.TrimSpace(r.sb.String())
+}
+
+// plainText returns the text of Telegram HTML without its markup
+func plainText(s string) string {
+	var sb strings.Builder
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return sb.String()
+		case html.TextToken:
+			sb.Write(z.Text())
+		}
+	}
+}
+
+// bodyRenderer renders parsed HTML as Telegram HTML, collapsing whitespace like a browser would
+type bodyRenderer struct {
+	sb strings.Builder
+
+	// hasText is true once some text has been written
+	hasText bool
+	// newlines is the number of line breaks at the end of the output
+	newlines int
+	// space is true if a space must be written before the next text
+	space bool
+	// marker is true right after writing the marker of a list item
+	marker bool
+	// pre is true while rendering preformatted text, which cannot contain other entities
+	pre bool
+	// code is true while rendering inline code, which cannot contain other entities either
+	code bool
+	// quote is true while rendering a quote, as Telegram does not allow nesting them
+	quote bool
+
+	lists []*list
+}
+
+type list struct {
+	ordered bool
+	next    int
+}
+
+func (r *bodyRenderer) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.ElementNode:
+	case html.DocumentNode:
+		r.children(n)
+		return
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title, atom.Img:
+	case atom.Br:
+		r.lineBreak()
+	case atom.B, atom.Strong:
+		r.inline(n, "b")
+	case atom.I, atom.Em, atom.Cite:
+		r.inline(n, "i")
+	case atom.U, atom.Ins:
+		r.inline(n, "u")
+	case atom.S, atom.Strike, atom.Del:
+		r.inline(n, "s")
+	case atom.Code, atom.Tt, atom.Kbd, atom.Samp:
+		r.inlineCode(n)
+	case atom.A:
+		r.link(n)
+	case atom.Pre:
+		r.preformatted(n)
+	case atom.Blockquote:
+		r.blockquote(n)
+	case atom.P, atom.Hr:
+		r.block(2)
+		r.children(n)
+		r.block(2)
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		r.block(2)
+		r.inline(n, "b")
+		r.block(2)
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Center,
+		atom.Address, atom.Dl, atom.Dt, atom.Dd:
+		r.block(1)
+		r.children(n)
+		r.block(1)
+	case atom.Ul, atom.Ol:
+		r.list(n)
+	case atom.Li:
+		r.item(n)
+	case atom.Table:
+		r.table(n)
+	default:
+		r.children(n)
+	}
+}
+
+func (r *bodyRenderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
+
+// text writes s collapsing its whitespace, or as is in preformatted text
+func (r *bodyRenderer) text(s string) {
+	if r.pre {
+		r.write(html.EscapeString(s))
+		if s != "" {
+			r.hasText = true
+			r.newlines = len(s) - len(strings.TrimRight(s, "\n"))
+		}
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		r.space = r.space || s != ""
+		return
+	}
+
+	r.space = r.space || startsWithSpace(s)
+	r.flushSpace()
+	r.write(html.EscapeString(strings.Join(words, " ")))
+	r.hasText, r.newlines, r.marker = true, 0, false
+	r.space = endsWithSpace(s)
+}
+
+// plain reports whether entities cannot be written, because the output is inside preformatted
+// text or inline code
+func (r *bodyRenderer) plain() bool {
+	return r.pre || r.code
+}
+
+// inline writes the children of n enclosed in tag, unless entities cannot be written
+func (r *bodyRenderer) inline(n *html.Node, tag string) {
+	if r.plain() {
+		r.children(n)
+		return
+	}
+
+	r.flushSpace()
+	r.write("<" + tag + ">")
+	r.children(n)
+	r.write("</" + tag + ">")
+}
+
+// inlineCode writes n as inline code, with the text of its children only
+func (r *bodyRenderer) inlineCode(n *html.Node) {
+	if r.plain() {
+		r.children(n)
+		return
+	}
+
+	r.flushSpace()
+	r.write("<code>")
+	r.code = true
+	r.children(n)
+	r.code = false
+	r.write("</code>")
+}
+
+// blockquote writes n as a quote, or only its children if it is nested in another one
+func (r *bodyRenderer) blockquote(n *html.Node) {
+	r.block(1)
+	if r.quote || r.plain() {
+		r.children(n)
+	} else {
+		r.quote = true
+		r.inline(n, "blockquote")
+		r.quote = false
+	}
+	r.block(1)
+}
+
+// link writes n as a link if it points somewhere Telegram can open, or else just its text
+func (r *bodyRenderer) link(n *html.Node) {
+	href := attr(n, "href")
+	if r.plain() || !safeLink(href) {
+		r.children(n)
+		return
+	}
+
+	r.flushSpace()
+	r.write(fmt.Sprintf(`<a href="%s">`, html.EscapeString(href)))
+	r.children(n)
+	r.write("</a>")
+}
+
+func (r *bodyRenderer) preformatted(n *html.Node) {
+	if r.plain() {
+		r.children(n)
+		return
+	}
+
+	r.block(1)
+	r.write("<pre>")
+	r.pre = true
+	r.children(n)
+	r.pre = false
+	r.write("</pre>")
+	r.block(1)
+}
+
+func (r *bodyRenderer) list(n *html.Node) {
+	l := &list{ordered: n.DataAtom == atom.Ol, next: 1}
+	if start := attr(n, "start"); start != "" {
+		fmt.Sscan(start, &l.next)
+	}
+
+	r.block(1)
+	r.lists = append(r.lists, l)
+	r.children(n)
+	r.lists = r.lists[:len(r.lists)-1]
+	r.block(1)
+}
+
+// item writes a list item preceded by a bullet or its number, indented by the nesting level
+func (r *bodyRenderer) item(n *html.Node) {
+	marker, depth := "•", 0
+	if len(r.lists) > 0 {
+		l := r.lists[len(r.lists)-1]
+		if l.ordered {
+			marker = fmt.Sprintf("%d.", l.next)
+			l.next++
+		}
+		depth = len(r.lists) - 1
+	}
+
+	r.block(1)
+	r.write(strings.Repeat("    ", depth) + marker + " ")
+	r.hasText, r.newlines, r.space, r.marker = true, 0, false, true
+	r.children(n)
+	r.block(1)
+}
+
+// table writes the rows of a table as preformatted text, with its columns aligned
+func (r *bodyRenderer) table(n *html.Node) {
+	var rows [][]string
+	header := false
+	walkRows(n, func(tr *html.Node) {
+		var cells []string
+		allHeaders := true
+		for c := tr.FirstChild; c != nil; c = c.NextSibling {
+			if c.DataAtom != atom.Td && c.DataAtom != atom.Th {
+				continue
+			}
+			allHeaders = allHeaders && c.DataAtom == atom.Th
+			cells = append(cells, strings.Join(strings.Fields(textContent(c)), " "))
+		}
+
+		if len(cells) > 0 {
+			header = header || (len(rows) == 0 && allHeaders)
+			rows = append(rows, cells)
+		}
+	})
+	if len(rows) == 0 {
+		return
+	}
+
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := utf8.RuneCountInString(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+
+	lines := make([]string, 0, len(rows)+1)
+	for i, row := range rows {
+		cells := make([]string, len(row))
+		for j, cell := range row {
+			cells[j] = cell + strings.Repeat(" ", widths[j]-utf8.RuneCountInString(cell))
+		}
+		lines = append(lines, strings.TrimRightFunc(strings.Join(cells, " | "), unicode.IsSpace))
+
+		if i == 0 && header {
+			rules := make([]string, len(widths))
+			for j, w := range widths {
+				rules[j] = strings.Repeat("-", w)
+			}
+			lines = append(lines, strings.Join(rules, "-+-"))
+		}
+	}
+
+	text := html.EscapeString(strings.Join(lines, "\n"))
+	if r.plain() {
+		r.write(text)
+		return
+	}
+
+	r.block(1)
+	r.write("<pre>" + text + "</pre>")
+	r.hasText, r.newlines, r.space, r.marker = true, 0, false, false
+	r.block(1)
+}
+
+// block makes sure the output ends with at least n line breaks, to separate blocks
+func (r *bodyRenderer) block(n int) {
+	if !r.hasText || r.marker {
+		return
+	}
+
+	for ; r.newlines < n; r.newlines++ {
+		r.write("\n")
+	}
+	r.space = false
+}
+
+func (r *bodyRenderer) lineBreak() {
+	if !r.hasText {
+		return
+	}
+
+	r.write("\n")
+	r.newlines++
+	r.space, r.marker = false, false
+}
+
+// flushSpace writes a pending space, unless at the beginning of a line
+func (r *bodyRenderer) flushSpace() {
+	if r.space && r.hasText && r.newlines == 0 && !r.marker {
+		r.write(" ")
+	}
+	r.space = false
+}
+
+func (r *bodyRenderer) write(s string) {
+	r.sb.WriteString(s)
+}
+
+// walkRows calls f for every row of table, skipping those of nested tables
+func walkRows(table *html.Node, f func(tr *html.Node)) {
+	for c := table.FirstChild; c != nil; c = c.NextSibling {
+		switch c.DataAtom {
+		case atom.Tr:
+			f(c)
+		case atom.Thead, atom.Tbody, atom.Tfoot:
+			walkRows(c, f)
+		}
+	}
+}
+
+// textContent returns the text of n and its descendants, with line breaks as spaces
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	if n.DataAtom == atom.Br {
+		return " "
+	}
+
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textContent(c))
+	}
+
+	return sb.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+
+	return ""
+}
+
+// safeLink reports whether href is an absolute link that can be opened from Telegram
+func safeLink(href string) bool {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto", "tel":
+		return u.Opaque != ""
+	default:
+		return false
+	}
+}
+
+func startsWithSpace(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsSpace(r)
+}
+
+func endsWithSpace(s string) bool {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return unicode.IsSpace(r)
+}
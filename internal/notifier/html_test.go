@@ -0,0 +1,77 @@
+package notifier
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatBody(t *testing.T) {
+	tests := map[string]struct {
+		body     string
+		expected string
+	}{
+		"plain text": {
+			body:     "Hi you, this is a test message",
+			expected: "Hi you, this is a test message",
+		},
+		"divs and line breaks": {
+			body:     "Hola<div>línea</div><div><br></div><div>más</div>",
+			expected: "Hola\nlínea\n\nmás",
+		},
+		"paragraphs": {
+			body:     "<p>  Uno\n  dos </p><p>tres</p>",
+			expected: "Uno dos\n\ntres",
+		},
+		"formatting": {
+			body:     "Hay <strong>reunión</strong> el <em>lunes</em>, <u>no</u> <del>el martes</del>. Usar <code>x</code>",
+			expected: "Hay <b>reunión</b> el <i>lunes</i>, <u>no</u> <s>el martes</s>. Usar <code>x</code>",
+		},
+		"spaces around tags": {
+			body:     "<b>Nota: </b>mañana",
+			expected: "<b>Nota:</b> mañana",
+		},
+		"entities": {
+			body:     "Padres &amp; madres&nbsp;&lt;3 &aacute; &#8364;",
+			expected: "Padres &amp; madres &lt;3 á €",
+		},
+		"links": {
+			body:     `Ver <a href="https://example.com/a?b=1&amp;c=2">circular</a> o <a href="javascript:alert(1)">esto</a>`,
+			expected: `Ver <a href="https://example.com/a?b=1&amp;c=2">circular</a> o esto`,
+		},
+		"headings and quotes": {
+			body:     "<h2>Excursión</h2><blockquote>Traed agua</blockquote>Gracias",
+			expected: "<b>Excursión</b>\n\n<blockquote>Traed agua</blockquote>\nGracias",
+		},
+		"lists": {
+			body:     "Material:<ul><li>Lápiz</li><li><p>Goma</p><ol start=\"3\"><li>Blanca</li><li>Azul</li></ol></li></ul>Fin",
+			expected: "Material:\n• Lápiz\n• Goma\n\n    3. Blanca\n    4. Azul\nFin",
+		},
+		"tables": {
+			body:     "<table><thead><tr><th>Día</th><th>Hora</th></tr></thead><tbody><tr><td>Lunes</td><td>9:00</td></tr><tr><td>Miércoles &amp; jueves</td></tr></tbody></table>",
+			expected: "<pre>Día                | Hora\n-------------------+-----\nLunes              | 9:00\nMiércoles &amp; jueves</pre>",
+		},
+		"preformatted": {
+			body:     "<pre>  a <b>b</b>\n  c</pre>",
+			expected: "<pre>  a b\n  c</pre>",
+		},
+		"entities in code": {
+			body:     `<code>a <b>b</b> <a href="http://x.y">l</a> &lt;c&gt;</code>`,
+			expected: "<code>a b l &lt;c&gt;</code>",
+		},
+		"nested quotes": {
+			body:     "<blockquote>Dijo:<blockquote>Traed <i>agua</i></blockquote></blockquote>",
+			expected: "<blockquote>Dijo:\nTraed <i>agua</i>\n</blockquote>",
+		},
+		"unsupported elements": {
+			body:     "<style>p {}</style><span style=\"color: red\">Rojo</span><img src=\"x.png\"><script>alert(1)</script>",
+			expected: "Rojo",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, formatBody(tc.body))
+		})
+	}
+}
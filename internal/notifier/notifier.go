@@ -1,9 +1,38 @@
 package notifier
 
-import "github.com/volmedo/almendruco.git/internal/raices"
+import (
+	"context"
+	"errors"
+
+	"github.com/volmedo/almendruco.git/internal/raices"
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
 
 type ChatID uint64
 
+// Notifier sends Raíces messages and warnings to chats. If a chat cannot be reached anymore,
+// e.g. because the user blocked the bot, the error returned matches ErrRecipientGone.
 type Notifier interface {
-	Notify(chatID ChatID, msgs []raices.Message) (uint64, error)
+	// Notify sends msgs to a chat and returns the ID of the last message notified, also when
+	// it stops halfway because of an error or because ctx is done. If label is not empty,
+	// messages are tagged with it to tell apart the accounts the chat is subscribed to. If
+	// readUser is not empty, unread messages come with a button to mark them as read in that
+	// Raíces account, which is handled by the Bot. If ledger is not nil, what it reports as
+	// delivered is skipped and every new delivery is recorded in it. If some attachments
+	// cannot be downloaded, the rest of the messages are still notified, but the ID returned
+	// is that of the last message before them and the error matches ErrDownloadFailed, so
+	// that they are retried in the next run; attachments of old messages are given up on.
+	Notify(ctx context.Context, chatID ChatID, label, readUser string, msgs []raices.Message, ledger Ledger) (uint64, error)
+	// NotifyLoginSuspended warns a chat that the messages of the Raíces account of user are not
+	// being checked anymore because its credentials were rejected, and tells how to update them
+	NotifyLoginSuspended(ctx context.Context, chatID ChatID, user, label string) error
+}
+
+// ErrDownloadFailed is returned when some attachments could not be downloaded from Raíces
+var ErrDownloadFailed = errors.New("attachment download failed")
+
+// Ledger keeps track of what has already been delivered to a chat
+type Ledger interface {
+	Delivered(d repo.Delivery) bool
+	Record(ctx context.Context, d repo.Delivery) error
 }
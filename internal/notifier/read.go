@@ -0,0 +1,141 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/volmedo/almendruco.git/internal/raices"
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+const (
+	answerCallbackQueryPath    = "answerCallbackQuery"
+	editMessageReplyMarkupPath = "editMessageReplyMarkup"
+
+	callbackQueryIDParam = "callback_query_id"
+	replyMarkupParam     = "reply_markup"
+
+	// readCallbackPrefix starts the data of the buttons to mark messages as read, which is
+	// followed by the ID of the message and the user of its account, separated by colons
+	readCallbackPrefix = "read"
+	// maxCallbackDataLength is the limit of the Bot API for the data of buttons, in bytes
+	maxCallbackDataLength = 64
+
+	readButtonText = "Marcar como leído"
+
+	// Answers to callback queries are shown as plain text
+	markedReadText           = "Mensaje marcado como leído en Raíces"
+	markReadFailedText       = "No he podido marcar el mensaje como leído en Raíces. Inténtalo de nuevo más tarde."
+	readAccountNotFoundText  = "Este chat ya no está suscrito a esa cuenta de Raíces."
+	readAccountSuspendedText = "Raíces rechaza la contraseña de esta cuenta. Vuelve a registrarla con /register para poder marcar mensajes como leídos."
+)
+
+type inlineKeyboardMarkup struct {
+	InlineKeyboard [][]inlineKeyboardButton `json:"inline_keyboard"`
+}
+
+type inlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+// readMarkup returns the markup of the button to mark m as read in the Raíces account of
+// readUser, or an empty string if m needs no button
+func readMarkup(m raices.Message, readUser string) string {
+	if readUser == "" || !m.ReadDate.IsZero() {
+		return ""
+	}
+
+	data := fmt.Sprintf("%s:%d:%s", readCallbackPrefix, m.ID, readUser)
+	if len(data) > maxCallbackDataLength {
+		return ""
+	}
+
+	markup, err := json.Marshal(inlineKeyboardMarkup{
+		InlineKeyboard: [][]inlineKeyboardButton{{{Text: readButtonText, CallbackData: data}}},
+	})
+	if err != nil {
+		return ""
+	}
+
+	return string(markup)
+}
+
+// parseReadCallback returns the user and the message ID in the data of a button to mark a
+// message as read
+func parseReadCallback(data string) (string, uint64, bool) {
+	parts := strings.SplitN(data, ":", 3)
+	if len(parts) != 3 || parts[0] != readCallbackPrefix || parts[2] == "" {
+		return "", 0, false
+	}
+
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return parts[2], id, true
+}
+
+// markRead marks as read in Raíces the message whose button was tapped, and removes the
+// button once it is done
+func (tb *telegramBot) markRead(ctx context.Context, q *callbackQuery) error {
+	user, messageID, ok := parseReadCallback(q.Data)
+	if !ok || q.Message == nil {
+		return tb.answerCallback(ctx, 0, q.ID, "")
+	}
+
+	chatID := q.Message.Chat.ID
+	chat, err := tb.repo.GetChat(ctx, strconv.FormatInt(chatID, 10))
+	if err != nil && !errors.Is(err, repo.ErrChatNotFound) {
+		_ = tb.answerCallback(ctx, chatID, q.ID, internalErrorText)
+		return fmt.Errorf("unable to fetch chat from repo: %w", err)
+	}
+
+	account, ok := chat.Account(user)
+	if !ok {
+		return tb.answerCallback(ctx, chatID, q.ID, readAccountNotFoundText)
+	}
+
+	// Logging in with credentials known to be rejected could get the account locked
+	if account.Suspended() {
+		return tb.answerCallback(ctx, chatID, q.ID, readAccountSuspendedText)
+	}
+
+	if err := tb.raices.MarkRead(ctx, account.Credentials, messageID); err != nil {
+		_ = tb.answerCallback(ctx, chatID, q.ID, markReadFailedText)
+		return fmt.Errorf("unable to mark message %d of user %s as read: %w", messageID, user, err)
+	}
+
+	if err := tb.removeMarkup(ctx, chatID, q.Message.ID); err != nil {
+		log.Printf("unable to remove read button from message %d in chat %d: %s", q.Message.ID, chatID, err)
+	}
+
+	return tb.answerCallback(ctx, chatID, q.ID, markedReadText)
+}
+
+// answerCallback stops the progress indicator of the button of a callback query, showing
+// text to the user if it is not empty
+func (tb *telegramBot) answerCallback(ctx context.Context, chatID int64, queryID, text string) error {
+	params := url.Values{}
+	params.Set(callbackQueryIDParam, queryID)
+	if text != "" {
+		params.Set(textParam, text)
+	}
+
+	return tb.api.call(ctx, ChatID(chatID), answerCallbackQueryPath, formContentType, []byte(params.Encode()))
+}
+
+func (tb *telegramBot) removeMarkup(ctx context.Context, chatID, messageID int64) error {
+	params := url.Values{}
+	params.Set(chatIDParam, strconv.FormatInt(chatID, 10))
+	params.Set(messageIDParam, strconv.FormatInt(messageID, 10))
+
+	return tb.api.call(ctx, ChatID(chatID), editMessageReplyMarkupPath, formContentType, []byte(params.Encode()))
+}
@@ -0,0 +1,214 @@
+package notifier
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxMessageLength is the maximum length of the text of a message allowed by the Bot API
+	maxMessageLength = 4096
+
+	// partReserve is the room left in every part of a split message for its number and for
+	// closing and reopening the HTML tags that are open where the message is split
+	partReserve = 256
+)
+
+// Break points where a message can be split, from worst to best
+const (
+	noBreak = iota
+	wordBreak
+	lineBreak
+	paragraphBreak
+)
+
+// splitMessage returns the text of a message made of header and content, split in parts
+// that fit in a Telegram message if needed. Only the first part carries the header, and
+// parts are numbered at the end.
+func splitMessage(header, content string) []string {
+	text := header + "\n\n" + content
+	if textLength(text) <= maxMessageLength {
+		return []string{text}
+	}
+
+	firstLimit := maxMessageLength - partReserve - textLength(header+"\n\n")
+	chunks := splitHTML(content, firstLimit, maxMessageLength-partReserve)
+
+	parts := make([]string, 0, len(chunks))
+	for i, c := range chunks {
+		if i == 0 {
+			c = header + "\n\n" + c
+		}
+
+		parts = append(parts, fmt.Sprintf("%s\n\n<i>(%d/%d)</i>", c, i+1, len(chunks)))
+	}
+
+	return parts
+}
+
+// splitHTML splits s in chunks no longer than firstLimit, for the first one, and limit, for
+// the rest. Chunks are split at paragraph boundaries if possible, or else at line or word
+// boundaries. Tags open at the end of a chunk are closed there and reopened in the next one,
+// so that every chunk is valid HTML on its own.
+func splitHTML(s string, firstLimit, limit int) []string {
+	pieces := htmlPieces(s)
+
+	chunks := []string{}
+	open := []string{}
+	max := firstLimit
+	for start := 0; start < len(pieces); {
+		reopen := strings.Join(open, "")
+		length := textLength(reopen)
+
+		end, cut, cutKind := start, -1, noBreak
+		for ; end < len(pieces); end++ {
+			// Closing tags are not counted, they are covered by partReserve like those
+			// added to close the chunk, so that they stay with the text they enclose
+			if !strings.HasPrefix(pieces[end], "</") {
+				length += textLength(pieces[end])
+			}
+			if length > max {
+				break
+			}
+
+			if kind := breakAfter(pieces, end); kind != noBreak && kind >= cutKind {
+				cut, cutKind = end+1, kind
+			}
+		}
+
+		switch {
+		case end == len(pieces):
+			cut = len(pieces)
+		case cut == -1:
+			cut = end
+		}
+
+		// Always make progress, even if a single piece does not fit
+		if cut <= start {
+			cut = start + 1
+		}
+
+		body := strings.TrimSpace(strings.Join(pieces[start:cut], ""))
+		open = openTags(open, pieces[start:cut])
+		if hasText(pieces[start:cut]) {
+			chunks = append(chunks, reopen+body+closeTags(open))
+		}
+
+		start = cut
+		max = limit
+	}
+
+	return chunks
+}
+
+// htmlPieces splits s into the pieces a message can be split between: tags, character
+// entities and single characters
+func htmlPieces(s string) []string {
+	pieces := []string{}
+	for len(s) > 0 {
+		n := 0
+		switch s[0] {
+		case '<':
+			n = strings.IndexByte(s, '>') + 1
+		case '&':
+			if i := strings.IndexByte(s, ';'); i != -1 && i <= 10 {
+				n = i + 1
+			}
+		}
+
+		if n <= 0 {
+			_, n = utf8.DecodeRuneInString(s)
+		}
+
+		pieces = append(pieces, s[:n])
+		s = s[n:]
+	}
+
+	return pieces
+}
+
+// hasText reports whether pieces contain any visible text besides tags and whitespace
+func hasText(pieces []string) bool {
+	for _, p := range pieces {
+		if !strings.HasPrefix(p, "<") && strings.TrimSpace(p) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// breakAfter returns the kind of break point found right after pieces[i]
+func breakAfter(pieces []string, i int) int {
+	switch pieces[i] {
+	case "\n":
+		if i > 0 && pieces[i-1] == "\n" {
+			return paragraphBreak
+		}
+		return lineBreak
+	case " ", "\t":
+		return wordBreak
+	default:
+		return noBreak
+	}
+}
+
+// openTags returns the tags that remain open after pieces, given those open before them
+func openTags(open []string, pieces []string) []string {
+	stack := append([]string{}, open...)
+	for _, p := range pieces {
+		if !strings.HasPrefix(p, "<") {
+			continue
+		}
+
+		if strings.HasPrefix(p, "</") {
+			name := tagName(p)
+			for i := len(stack) - 1; i >= 0; i-- {
+				if tagName(stack[i]) == name {
+					stack = stack[:i]
+					break
+				}
+			}
+			continue
+		}
+
+		stack = append(stack, p)
+	}
+
+	return stack
+}
+
+func closeTags(open []string) string {
+	var sb strings.Builder
+	for i := len(open) - 1; i >= 0; i-- {
+		sb.WriteString("</" + tagName(open[i]) + ">")
+	}
+
+	return sb.String()
+}
+
+// tagName returns the name of the tag in an opening or closing tag
+func tagName(tag string) string {
+	name := strings.TrimLeft(tag, "</")
+	if i := strings.IndexAny(name, " \t\n>"); i != -1 {
+		name = name[:i]
+	}
+
+	return strings.ToLower(name)
+}
+
+// textLength returns the length of s as measured by the Bot API, in UTF-16 code units.
+// Tags and entities are counted in full, which overestimates the length of the text.
+func textLength(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,104 @@
+package notifier
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/volmedo/almendruco.git/internal/raices"
+)
+
+func TestFormatTextSplitsLongMessages(t *testing.T) {
+	paragraphs := make([]string, 30)
+	for i := range paragraphs {
+		paragraphs[i] = fmt.Sprintf("<p>Párrafo %d. %s</p>", i, strings.Repeat("Lorem ipsum dolor sit amet. ", 10))
+	}
+
+	msg := raices.Message{
+		ID:                  123456,
+		SentDate:            time.Date(2021, time.Month(11), 11, 0, 0, 0, 0, time.UTC),
+		Sender:              "Test Sender",
+		Subject:             "Test Subject",
+		Body:                strings.Join(paragraphs, ""),
+		ContainsAttachments: true,
+		Attachments:         []raices.Attachment{{ID: 98765, FileName: "attachment.file"}},
+	}
+
+	parts := formatText(msg, "", nil)
+	require.Greater(t, len(parts), 1)
+
+	for i, p := range parts {
+		assert.LessOrEqual(t, textLength(p), maxMessageLength)
+		assert.True(t, strings.HasSuffix(p, fmt.Sprintf("\n\n<i>(%d/%d)</i>", i+1, len(parts))), p)
+		assert.Equal(t, i == 0, strings.Contains(p, "<b>Asunto:</b> Test Subject"), p)
+		assert.Equal(t, i == len(parts)-1, strings.Contains(p, "attachment.file"), p)
+	}
+
+	// Parts are split between paragraphs and nothing but whitespace is lost
+	var sb strings.Builder
+	for i, p := range parts {
+		p = strings.TrimSuffix(p, fmt.Sprintf("\n\n<i>(%d/%d)</i>", i+1, len(parts)))
+		if i == 0 {
+			p = strings.TrimPrefix(p, formatHeader(msg, "")+"\n\n")
+		} else {
+			sb.WriteString("\n\n")
+		}
+		assert.True(t, strings.HasPrefix(p, "Párrafo "), p)
+		sb.WriteString(p)
+	}
+	assert.Equal(t, strings.Fields(formatContent(msg, nil)), strings.Fields(sb.String()))
+}
+
+func TestSplitHTML(t *testing.T) {
+	tests := map[string]struct {
+		s      string
+		limit  int
+		chunks []string
+	}{
+		"fits": {
+			s:      "uno dos",
+			limit:  10,
+			chunks: []string{"uno dos"},
+		},
+		"prefers paragraphs over lines and words": {
+			s:      "uno dos\n\ntres\ncuatro cinco",
+			limit:  20,
+			chunks: []string{"uno dos", "tres\ncuatro cinco"},
+		},
+		"splits words": {
+			s:      "uno dos tres",
+			limit:  8,
+			chunks: []string{"uno dos", "tres"},
+		},
+		"splits long words": {
+			s:      "abcdefghij",
+			limit:  4,
+			chunks: []string{"abcd", "efgh", "ij"},
+		},
+		"keeps entities whole": {
+			s:      "ab&amp;cd",
+			limit:  4,
+			chunks: []string{"ab", "&amp;", "cd"},
+		},
+		"keeps tags balanced": {
+			s:      `<b>uno <a href="x">dos tres</a></b> cuatro`,
+			limit:  20,
+			chunks: []string{"<b>uno</b>", `<b><a href="x">dos</a></b>`, `<b><a href="x">tres</a></b>`, "cuatro"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.chunks, splitHTML(tc.s, tc.limit, tc.limit))
+		})
+	}
+}
+
+func TestTextLength(t *testing.T) {
+	assert.Equal(t, 5, textLength("Lucía"))
+	assert.Equal(t, 3, textLength("a😀"))
+}
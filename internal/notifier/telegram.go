@@ -1,18 +1,21 @@
 package notifier
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"mime/multipart"
+	"html"
+	"io"
+	"log"
 	"net/http"
 	"net/url"
-	"path"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/microcosm-cc/bluemonday"
-
+	"github.com/volmedo/almendruco.git/internal/blobstore"
 	"github.com/volmedo/almendruco.git/internal/raices"
+	"github.com/volmedo/almendruco.git/internal/repo"
 )
 
 const (
@@ -21,162 +24,312 @@ const (
 	parseModeParam = "parse_mode"
 	parseModeHTML  = "HTML"
 	documentParam  = "document"
+	photoParam     = "photo"
+	mediaParam     = "media"
+	captionParam   = "caption"
+	replyToParam   = "reply_to_message_id"
+	// allowWithoutReplyParam lets messages be sent even if the one they reply to was deleted
+	allowWithoutReplyParam = "allow_sending_without_reply"
+
+	sendMessagePath    = "sendMessage"
+	sendDocumentPath   = "sendDocument"
+	sendPhotoPath      = "sendPhoto"
+	sendMediaGroupPath = "sendMediaGroup"
+
+	formContentType = "application/x-www-form-urlencoded"
 
-	sendMessagePath  = "sendMessage"
-	sendDocumentPath = "sendDocument"
+	// Limits of the Bot API for uploads, photos, media groups and captions
+	maxUploadSize     = 50 << 20
+	maxPhotoSize      = 10 << 20
+	maxMediaGroupSize = 10
+	maxCaptionLength  = 1024
+
+	linkNote          = `<a href="%s">descargar</a> (es demasiado grande para Telegram, el enlace caduca el %s)`
+	undeliverableNote = "no se ha podido enviar, es demasiado grande para Telegram"
 
 	dateFormat = "02/01/2006 15:04"
+
+	loginSuspendedText = "No he podido iniciar sesión en Raíces con la cuenta del usuario %s porque el usuario o la contraseña no son correctos. " +
+		"He dejado de comprobar sus mensajes para evitar que Raíces bloquee la cuenta.\n\n" +
+		"Si has cambiado la contraseña, vuelve a registrarla con /register &lt;usuario&gt; &lt;contraseña&gt; [nombre]."
+
+	// maxRetryAge is how long after a message was sent its attachments are still retried if
+	// they cannot be downloaded
+	maxRetryAge = 7 * 24 * time.Hour
+
+	// requestTimeout bounds every request to the Bot API. It is generous because
+	// it also covers uploading attachments.
+	requestTimeout = 60 * time.Second
 )
 
 type telegramNotifier struct {
-	baseURL *url.URL
-	http    *http.Client
+	api   *apiClient
+	blobs blobstore.Store
+
+	// maxUploadSize is the size of the largest attachment sent through Telegram, it is only
+	// replaced in tests
+	maxUploadSize int
+	// fetch opens the contents of attachments, it is only replaced in tests
+	fetch fetchFunc
 }
 
-func NewTelegramNotifier(baseURL, botToken string) (Notifier, error) {
+// NewTelegramNotifier returns a Notifier that sends messages through the Telegram bot with
+// the given token. Attachments too big for Telegram are stored in blobs, if not nil, and a
+// link to download them is added to the text of their message instead. Messages are sent
+// within limits, which should be shared with any Bot of the same bot, or limits of its own if nil.
+func NewTelegramNotifier(baseURL, botToken string, blobs blobstore.Store, limits *RateLimits) (Notifier, error) {
 	u, err := url.Parse(fmt.Sprintf("%s/bot%s", baseURL, botToken))
 	if err != nil {
 		return &telegramNotifier{}, fmt.Errorf("bad baseURL and/or botToken: %s", err)
 	}
 
 	return &telegramNotifier{
-		baseURL: u,
-		http:    &http.Client{},
+		api:           newAPIClient(u, &http.Client{Timeout: requestTimeout}, limits),
+		blobs:         blobs,
+		maxUploadSize: maxUploadSize,
+		fetch:         fetchFromRaices,
 	}, nil
 }
 
-func (tn *telegramNotifier) Notify(chatID ChatID, msgs []raices.Message) (uint64, error) {
-	u, _ := url.Parse(tn.baseURL.String())
-	u.Path = path.Join(u.Path, sendMessagePath)
-
+func (tn *telegramNotifier) Notify(ctx context.Context, chatID ChatID, label, readUser string, msgs []raices.Message, ledger Ledger) (uint64, error) {
 	params := url.Values{}
 	params.Set(chatIDParam, strconv.FormatUint(uint64(chatID), 10))
 	params.Set(parseModeParam, parseModeHTML)
 
 	var lastNotifiedMessage uint64
+	var incomplete []string
 	for _, m := range msgs {
-		// Send message text
-		if err := tn.sendMessage(m, u, params); err != nil {
+		if err := ctx.Err(); err != nil {
 			return lastNotifiedMessage, err
 		}
 
-		// Upload attachments (if any)
-		for _, a := range m.Attachments {
-			if err := tn.uploadAttachment(chatID, a.FileName, a.Contents); err != nil {
-				return lastNotifiedMessage, err
-			}
+		complete, err := tn.notifyMessage(ctx, chatID, m, label, readUser, params, ledger)
+		if err != nil {
+			return lastNotifiedMessage, err
+		}
+
+		// Messages with attachments left to retry hold the cursor back, while the ledger keeps
+		// the next ones from being sent again when they are retried
+		if !complete {
+			incomplete = append(incomplete, strconv.FormatUint(m.ID, 10))
+		}
+		if len(incomplete) == 0 {
+			lastNotifiedMessage = m.ID
 		}
+	}
 
-		lastNotifiedMessage = m.ID
+	if len(incomplete) > 0 {
+		return lastNotifiedMessage, fmt.Errorf("%w in messages %s", ErrDownloadFailed, strings.Join(incomplete, ", "))
 	}
 
 	return lastNotifiedMessage, nil
 }
 
-func (tn *telegramNotifier) sendMessage(m raices.Message, u *url.URL, params url.Values) error {
-	text := formatText(m)
+func (tn *telegramNotifier) NotifyLoginSuspended(ctx context.Context, chatID ChatID, user, label string) error {
+	account := fmt.Sprintf("<b>%s</b>", html.EscapeString(user))
+	if label != "" && label != user {
+		account = fmt.Sprintf("%s (%s)", account, html.EscapeString(label))
+	}
+	text := fmt.Sprintf(loginSuspendedText, account)
 
+	params := url.Values{}
+	params.Set(chatIDParam, strconv.FormatUint(uint64(chatID), 10))
+	params.Set(parseModeParam, parseModeHTML)
 	params.Set(textParam, text)
 
-	resp, err := tn.http.Post(u.String(), "application/x-www-form-urlencoded", strings.NewReader(params.Encode()))
+	return tn.api.call(ctx, chatID, sendMessagePath, formContentType, []byte(params.Encode()))
+}
+
+// notifyMessage sends the text of m and then its attachments as replies to it. Attachments
+// are checked before sending the text, so that it can tell about those that cannot be sent
+// through Telegram, and opened again as they are uploaded. It reports whether m is complete, i.e. whether no attachments are left
+// to retry.
+func (tn *telegramNotifier) notifyMessage(ctx context.Context, chatID ChatID, m raices.Message, label, readUser string, params url.Values, ledger Ledger) (bool, error) {
+	textDelivery := repo.Delivery{MessageID: m.ID}
+	textPending := ledger == nil || !ledger.Delivered(textDelivery)
+
+	retry := time.Since(m.SentDate) <= maxRetryAge
+	pending, failed, notes, err := tn.checkAttachments(ctx, m, ledger, textPending, retry)
+	defer closeAll(pending)
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("received status code %d", resp.StatusCode)
+	// Send message text, keeping its ID to send the attachments as replies to it
+	var replyTo int64
+	err = deliver(ctx, ledger, textDelivery, func() error {
+		var err error
+		replyTo, err = tn.sendMessage(ctx, chatID, m, label, readMarkup(m, readUser), notes, params, ledger)
+		return err
+	})
+	if err != nil {
+		return false, err
 	}
 
-	return nil
-}
-
-func formatText(m raices.Message) string {
-	var sb strings.Builder
-	sb.WriteString("Nuevo mensaje en Raíces!")
-	sb.WriteString(fmt.Sprintf("\n\n<b>Fecha:</b> %s", m.SentDate.Format(dateFormat)))
-	sb.WriteString(fmt.Sprintf("\n<b>De:</b> %s", m.Sender))
-	sb.WriteString(fmt.Sprintf("\n<b>Asunto:</b> %s", m.Subject))
-	sb.WriteString(fmt.Sprintf("\n\n%s", formatBody(m.Body)))
+	// Attachments with a note are accounted for in the text of the message, unless they
+	// are to be retried
+	for id := range notes {
+		if failed[id] {
+			continue
+		}
+		if err := record(ctx, ledger, repo.Delivery{MessageID: m.ID, AttachmentID: id}); err != nil {
+			return false, err
+		}
+	}
 
-	if m.ContainsAttachments {
-		sb.WriteString(fmt.Sprintf("\n\n<b>Adjuntos:</b>\n%s", formatAttachments(m.Attachments)))
+	if err := tn.sendAttachments(ctx, chatID, m, label, replyTo, pending, ledger); err != nil {
+		return false, err
 	}
 
-	return sb.String()
+	return len(failed) == 0, nil
 }
 
-func formatBody(body string) string {
-	processed := strings.Replace(body, "<div>", "\n", -1)
+// deliver calls send unless ledger reports d as delivered, and records d in ledger afterwards
+func deliver(ctx context.Context, ledger Ledger, d repo.Delivery, send func() error) error {
+	if ledger == nil {
+		return send()
+	}
 
-	p := bluemonday.StrictPolicy()
-	return p.Sanitize(processed)
-}
+	if ledger.Delivered(d) {
+		return nil
+	}
 
-func formatAttachments(attachments []raices.Attachment) string {
-	var sb strings.Builder
-	for _, a := range attachments {
-		sb.WriteString(fmt.Sprintf("\t\t\t%s\n", a.FileName))
+	if err := send(); err != nil {
+		return err
 	}
 
-	return sb.String()
+	return record(ctx, ledger, d)
 }
 
-func (tn *telegramNotifier) uploadAttachment(chatID ChatID, fileName string, contents []byte) error {
-	body := &bytes.Buffer{}
-	mw := multipart.NewWriter(body)
-	if err := addMultipartField(mw, chatIDParam, chatID); err != nil {
-		return err
+func record(ctx context.Context, ledger Ledger, d repo.Delivery) error {
+	if ledger == nil {
+		return nil
 	}
 
-	if err := addMultipartFile(mw, documentParam, fileName, contents); err != nil {
-		return err
+	if err := ledger.Record(ctx, d); err != nil {
+		return fmt.Errorf("unable to record delivery: %w", err)
 	}
 
-	if err := mw.Close(); err != nil {
-		return err
+	return nil
+}
+
+// sentMessage is the part of a message sent by the bot that is needed to reply to it
+type sentMessage struct {
+	ID int64 `json:"message_id"`
+}
+
+// sendMessage sends the text of m, split in as many messages as needed to fit Telegram's
+// limits, and returns the ID of the first one, which carries markup if it is not empty.
+// The parts of a split text are recorded in ledger one by one, so that only those left are
+// sent if it is retried. The ID returned is 0 if the first part was sent in a previous try.
+func (tn *telegramNotifier) sendMessage(ctx context.Context, chatID ChatID, m raices.Message, label, markup string, notes map[uint64]string, params url.Values, ledger Ledger) (int64, error) {
+	defer params.Del(replyMarkupParam)
+
+	parts := formatText(m, label, notes)
+	partLedger := ledger
+	if len(parts) == 1 {
+		// The delivery of the whole text is enough
+		partLedger = nil
 	}
 
-	u, _ := url.Parse(tn.baseURL.String())
-	u.Path = path.Join(u.Path, sendDocumentPath)
+	var first int64
+	for i, text := range parts {
+		params.Set(textParam, text)
+		if i == 0 && markup != "" {
+			params.Set(replyMarkupParam, markup)
+		} else {
+			params.Del(replyMarkupParam)
+		}
 
-	resp, err := tn.http.Post(u.String(), mw.FormDataContentType(), bytes.NewReader(body.Bytes()))
-	if err != nil {
-		return err
+		part := repo.Delivery{MessageID: m.ID, Part: uint64(i + 1)}
+		err := deliver(ctx, partLedger, part, func() error {
+			var sent sentMessage
+			err := tn.api.callResult(ctx, chatID, sendMessagePath, formContentType, []byte(params.Encode()), &sent)
+			if errors.Is(err, ErrBadMarkup) {
+				// Sending the text without its formatting beats getting stuck on it forever
+				log.Printf("markup of message %d rejected, sending it as plain text: %s", m.ID, err)
+				err = tn.api.callResult(ctx, chatID, sendMessagePath, formContentType, []byte(plainParams(params).Encode()), &sent)
+			}
+			if err != nil {
+				return err
+			}
+
+			if i == 0 {
+				first = sent.ID
+			}
+
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("received status code %d", resp.StatusCode)
+	return first, nil
+}
+
+// plainParams returns a copy of the params of a message that sends its text as plain text
+func plainParams(params url.Values) url.Values {
+	plain := url.Values{}
+	for k, v := range params {
+		plain[k] = v
 	}
+	plain.Del(parseModeParam)
+	plain.Set(textParam, plainText(params.Get(textParam)))
 
-	return nil
+	return plain
 }
 
-func addMultipartField(mw *multipart.Writer, name string, value interface{}) error {
-	fw, err := mw.CreateFormField(name)
-	if err != nil {
-		return err
+// formatText returns the text of m, split in parts that fit in a Telegram message. Notes are
+// added next to the names of the attachments they are keyed by.
+func formatText(m raices.Message, label string, notes map[uint64]string) []string {
+	return splitMessage(formatHeader(m, label), formatContent(m, notes))
+}
+
+func formatHeader(m raices.Message, label string) string {
+	var sb strings.Builder
+	if label != "" {
+		sb.WriteString(fmt.Sprintf("Nuevo mensaje en Raíces para <b>%s</b>!", html.EscapeString(label)))
+	} else {
+		sb.WriteString("Nuevo mensaje en Raíces!")
 	}
+	sb.WriteString(fmt.Sprintf("\n\n<b>Fecha:</b> %s", m.SentDate.Format(dateFormat)))
+	sb.WriteString(fmt.Sprintf("\n<b>De:</b> %s", html.EscapeString(m.Sender)))
+	sb.WriteString(fmt.Sprintf("\n<b>Asunto:</b> %s", html.EscapeString(m.Subject)))
 
-	_, err = fmt.Fprint(fw, value)
-	if err != nil {
-		return err
+	return sb.String()
+}
+
+func formatContent(m raices.Message, notes map[uint64]string) string {
+	var sb strings.Builder
+	sb.WriteString(formatBody(m.Body))
+
+	if m.ContainsAttachments {
+		sb.WriteString(fmt.Sprintf("\n\n<b>Adjuntos:</b>\n%s", formatAttachments(m.Attachments, notes)))
 	}
 
-	return nil
+	return sb.String()
 }
 
-func addMultipartFile(mw *multipart.Writer, fieldName string, fileName string, contents []byte) error {
-	fw, err := mw.CreateFormFile(fieldName, fileName)
-	if err != nil {
-		return err
+func formatAttachments(attachments []raices.Attachment, notes map[uint64]string) string {
+	var sb strings.Builder
+	for _, a := range attachments {
+		if note, ok := notes[a.ID]; ok {
+			sb.WriteString(fmt.Sprintf("\t\t\t%s - %s\n", html.EscapeString(a.FileName), note))
+		} else {
+			sb.WriteString(fmt.Sprintf("\t\t\t%s\n", html.EscapeString(a.FileName)))
+		}
 	}
 
-	_, err = fw.Write(contents)
+	return sb.String()
+}
+
+func post(ctx context.Context, hc *http.Client, u, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	req.Header.Set("Content-Type", contentType)
 
-	return nil
+	return hc.Do(req)
 }
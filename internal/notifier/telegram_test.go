@@ -1,19 +1,49 @@
 package notifier
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/volmedo/almendruco.git/internal/blobstore"
 	"github.com/volmedo/almendruco.git/internal/raices"
+	"github.com/volmedo/almendruco.git/internal/repo"
 )
 
+type memLedger map[repo.Delivery]bool
+
+func (ml memLedger) Delivered(d repo.Delivery) bool {
+	return ml[d]
+}
+
+func (ml memLedger) Record(ctx context.Context, d repo.Delivery) error {
+	ml[d] = true
+	return nil
+}
+
+// fetchFrom makes tn fetch the contents of attachments from files, keyed by attachment ID
+func fetchFrom(tn Notifier, files map[uint64][]byte) {
+	tn.(*telegramNotifier).fetch = func(ctx context.Context, a raices.Attachment) (io.ReadCloser, int64, error) {
+		data, ok := files[a.ID]
+		if !ok {
+			return nil, 0, fmt.Errorf("attachment %d not found", a.ID)
+		}
+		return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}
+}
+
 func TestNotify(t *testing.T) {
 	chatID := ChatID(123456789)
 
@@ -28,7 +58,6 @@ func TestNotify(t *testing.T) {
 			{
 				ID:       98765,
 				FileName: "attachment.file",
-				Contents: []byte{1, 2, 3, 4, 5, 6},
 			},
 		},
 		ReadDate: time.Now(),
@@ -47,12 +76,15 @@ func TestNotify(t *testing.T) {
 			assert.Equal(t, expectedText, reqText)
 
 			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":77}}`))
 		} else if strings.HasSuffix(r.URL.String(), sendDocumentPath) {
 			err := r.ParseMultipartForm(10)
 			require.NoError(t, err)
 
 			reqChatID := r.MultipartForm.Value["chat_id"][0]
 			assert.Equal(t, "123456789", reqChatID)
+			assert.Equal(t, "77", r.MultipartForm.Value[replyToParam][0])
+			assert.Equal(t, "Adjunto del mensaje «Test Subject» del 11/11/2021 00:00", r.MultipartForm.Value[captionParam][0])
 
 			reqDocument := r.MultipartForm.File["document"][0]
 			assert.Equal(t, "attachment.file", reqDocument.Filename)
@@ -71,10 +103,631 @@ func TestNotify(t *testing.T) {
 	}))
 	defer svr.Close()
 
-	tn, err := NewTelegramNotifier(svr.URL, "test_token")
+	tn, err := NewTelegramNotifier(svr.URL, "test_token", nil, nil)
 	require.NoError(t, err)
+	fetchFrom(tn, map[uint64][]byte{98765: {1, 2, 3, 4, 5, 6}})
 
-	lastNotifiedMessage, err := tn.Notify(chatID, []raices.Message{msg})
+	lastNotifiedMessage, err := tn.Notify(context.Background(), chatID, "", "", []raices.Message{msg}, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, uint64(123456), lastNotifiedMessage)
 }
+
+func TestFormatTextWithLabel(t *testing.T) {
+	msg := raices.Message{
+		ID:       123456,
+		SentDate: time.Date(2021, time.Month(11), 11, 0, 0, 0, 0, time.UTC),
+		Sender:   "Test Sender",
+		Subject:  "Test Subject",
+		Body:     "Hi you, this is a test message",
+	}
+
+	text := formatText(msg, "Lucía & Co", nil)
+
+	expectedText := "Nuevo mensaje en Raíces para <b>Lucía &amp; Co</b>!\n\n<b>Fecha:</b> 11/11/2021 00:00\n<b>De:</b> Test Sender\n<b>Asunto:</b> Test Subject\n\nHi you, this is a test message"
+	assert.Equal(t, []string{expectedText}, text)
+}
+
+func TestNotifyLoginSuspended(t *testing.T) {
+	var text string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.True(t, strings.HasSuffix(r.URL.Path, sendMessagePath))
+		assert.Equal(t, "42", r.Form.Get(chatIDParam))
+		text = r.Form.Get(textParam)
+
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":77}}`))
+	}))
+	defer svr.Close()
+
+	tn, err := NewTelegramNotifier(svr.URL, "test_token", nil, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, tn.NotifyLoginSuspended(context.Background(), 42, "someuser", "Lucía & Co"))
+	assert.Contains(t, text, "<b>someuser</b> (Lucía &amp; Co)")
+	assert.Contains(t, text, "/register")
+}
+
+func TestNotifyAddsReadButton(t *testing.T) {
+	var mu sync.Mutex
+	markups := []string{}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+
+		mu.Lock()
+		markups = append(markups, r.Form.Get(replyMarkupParam))
+		mu.Unlock()
+
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":77}}`))
+	}))
+	defer svr.Close()
+
+	tn, err := NewTelegramNotifier(svr.URL, "test_token", nil, nil)
+	require.NoError(t, err)
+
+	msgs := []raices.Message{
+		{ID: 1, Subject: "Unread"},
+		{ID: 2, Subject: "Read", ReadDate: time.Date(2021, time.November, 11, 10, 30, 0, 0, time.UTC)},
+	}
+	_, err = tn.Notify(context.Background(), 42, "", "someuser", msgs, nil)
+	require.NoError(t, err)
+
+	require.Len(t, markups, 2)
+	assert.JSONEq(t, `{"inline_keyboard":[[{"text":"Marcar como leído","callback_data":"read:1:someuser"}]]}`, markups[0])
+	assert.Empty(t, markups[1], "Expected no button for messages already read")
+}
+
+func TestNotifySendsRejectedMarkupAsPlainText(t *testing.T) {
+	var mu sync.Mutex
+	var sent []url.Values
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		require.NoError(t, r.ParseForm())
+		sent = append(sent, r.Form)
+		if r.Form.Get(parseModeParam) != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: can't parse entities: unsupported start tag"}`))
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+	}))
+	defer svr.Close()
+
+	tn, err := NewTelegramNotifier(svr.URL, "test_token", nil, nil)
+	require.NoError(t, err)
+
+	msg := raices.Message{ID: 1, Subject: "Excursión", Body: "Traed <b>agua</b> &amp; gorra"}
+	last, err := tn.Notify(context.Background(), 42, "", "", []raices.Message{msg}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), last)
+
+	require.Len(t, sent, 2)
+	assert.Contains(t, sent[1].Get(textParam), "Asunto: Excursión")
+	assert.Contains(t, sent[1].Get(textParam), "Traed agua & gorra")
+}
+
+func TestNotifyResumesFromLedger(t *testing.T) {
+	msgs := []raices.Message{
+		{ID: 1, Attachments: []raices.Attachment{{ID: 10, FileName: "a"}, {ID: 11, FileName: "b"}}},
+		{ID: 2},
+	}
+
+	var mu sync.Mutex
+	sent := []string{}
+	failing := "b"
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if strings.HasSuffix(r.URL.Path, sendDocumentPath) {
+			require.NoError(t, r.ParseMultipartForm(1024))
+			name := r.MultipartForm.File[documentParam][0].Filename
+			if name == failing {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: file is too big"}`))
+				return
+			}
+			sent = append(sent, name)
+		} else {
+			sent = append(sent, "text")
+		}
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+	}))
+	defer svr.Close()
+
+	tn, err := NewTelegramNotifier(svr.URL, "test_token", nil, nil)
+	require.NoError(t, err)
+	noWaits(tn.(*telegramNotifier).api)
+	fetchFrom(tn, map[uint64][]byte{10: {}, 11: {}})
+
+	ledger := memLedger{}
+	last, err := tn.Notify(context.Background(), 42, "", "", msgs, ledger)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(0), last)
+	assert.Equal(t, []string{"text", "a"}, sent)
+
+	// The retry only sends what was not delivered in the first attempt
+	mu.Lock()
+	sent = []string{}
+	failing = ""
+	mu.Unlock()
+
+	last, err = tn.Notify(context.Background(), 42, "", "", msgs, ledger)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), last)
+	assert.Equal(t, []string{"b", "text"}, sent)
+}
+
+func TestNotifyResumesSplitText(t *testing.T) {
+	msg := raices.Message{ID: 1, Subject: "Menú", Body: strings.Repeat("macarrones ", 1000)}
+	parts := formatText(msg, "", nil)
+	require.Greater(t, len(parts), 2)
+
+	var mu sync.Mutex
+	sent := []string{}
+	failing := parts[1]
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		require.NoError(t, r.ParseForm())
+		text := r.Form.Get(textParam)
+		if text == failing {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: something went wrong"}`))
+			return
+		}
+		sent = append(sent, text)
+
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+	}))
+	defer svr.Close()
+
+	tn, err := NewTelegramNotifier(svr.URL, "test_token", nil, nil)
+	require.NoError(t, err)
+	noWaits(tn.(*telegramNotifier).api)
+
+	ledger := memLedger{}
+	_, err = tn.Notify(context.Background(), 42, "", "", []raices.Message{msg}, ledger)
+	assert.Error(t, err)
+	assert.Equal(t, parts[:1], sent)
+
+	// The retry only sends the parts that were not delivered in the first attempt
+	mu.Lock()
+	sent = []string{}
+	failing = ""
+	mu.Unlock()
+
+	last, err := tn.Notify(context.Background(), 42, "", "", []raices.Message{msg}, ledger)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), last)
+	assert.Equal(t, parts[1:], sent)
+	assert.True(t, ledger.Delivered(repo.Delivery{MessageID: 1}))
+}
+
+var (
+	pngContents = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	pdfContents = []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3")
+)
+
+// upload is a request received by uploadServer, only the text is kept for sendMessage
+type upload struct {
+	method string
+	fields map[string]string
+	files  map[string]string
+	types  map[string]string
+}
+
+// uploadServer records the uploads it receives, failing with a bad request those sent to the
+// methods in failing
+func uploadServer(t *testing.T, failing ...string) (*httptest.Server, func() []upload) {
+	var mu sync.Mutex
+	uploads := []upload{}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		if method == sendMessagePath {
+			require.NoError(t, r.ParseForm())
+			uploads = append(uploads, upload{method: method, fields: map[string]string{textParam: r.Form.Get(textParam)}})
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":77}}`))
+			return
+		}
+
+		for _, f := range failing {
+			if f == method {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: PHOTO_INVALID_DIMENSIONS"}`))
+				return
+			}
+		}
+
+		require.NoError(t, r.ParseMultipartForm(1024))
+		u := upload{method: method, fields: map[string]string{}, files: map[string]string{}, types: map[string]string{}}
+		for k, v := range r.MultipartForm.Value {
+			u.fields[k] = v[0]
+		}
+		for k, v := range r.MultipartForm.File {
+			u.files[k] = v[0].Filename
+			u.types[k] = v[0].Header.Get("Content-Type")
+		}
+		uploads = append(uploads, u)
+
+		_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+	}))
+
+	return svr, func() []upload {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploads
+	}
+}
+
+func TestNotifySendsPhotosAsMediaGroup(t *testing.T) {
+	msg := raices.Message{
+		ID:       1,
+		SentDate: time.Date(2021, time.Month(11), 11, 0, 0, 0, 0, time.UTC),
+		Subject:  "Fotos",
+		Attachments: []raices.Attachment{
+			{ID: 10, FileName: "a.png"},
+			{ID: 11, FileName: "circular.pdf"},
+			{ID: 12, FileName: "b.png"},
+		},
+	}
+
+	svr, uploads := uploadServer(t)
+	defer svr.Close()
+
+	tn, err := NewTelegramNotifier(svr.URL, "test_token", nil, nil)
+	require.NoError(t, err)
+	fetchFrom(tn, map[uint64][]byte{10: pngContents, 11: pdfContents, 12: pngContents})
+
+	ledger := memLedger{}
+	_, err = tn.Notify(context.Background(), 42, "Lucía", "", []raices.Message{msg}, ledger)
+	require.NoError(t, err)
+
+	got := uploads()
+	require.Len(t, got, 3)
+
+	group := got[1]
+	assert.Equal(t, sendMediaGroupPath, group.method)
+	assert.Equal(t, "77", group.fields[replyToParam])
+	assert.Equal(t, map[string]string{"photo0": "a.png", "photo1": "b.png"}, group.files)
+	assert.Equal(t, "image/png", group.types["photo0"])
+	assert.JSONEq(t, `[
+		{"type":"photo","media":"attach://photo0","caption":"Lucía: Adjunto del mensaje «Fotos» del 11/11/2021 00:00"},
+		{"type":"photo","media":"attach://photo1"}
+	]`, group.fields[mediaParam])
+
+	doc := got[2]
+	assert.Equal(t, sendDocumentPath, doc.method)
+	assert.Equal(t, "77", doc.fields[replyToParam])
+	assert.Equal(t, map[string]string{documentParam: "circular.pdf"}, doc.files)
+	assert.Equal(t, "application/pdf", doc.types[documentParam])
+
+	assert.Len(t, ledger, 4)
+}
+
+func TestNotifySendsRejectedPhotosAsDocuments(t *testing.T) {
+	msg := raices.Message{
+		ID:          1,
+		Attachments: []raices.Attachment{{ID: 10, FileName: "a.png"}},
+	}
+
+	svr, uploads := uploadServer(t, sendPhotoPath)
+	defer svr.Close()
+
+	tn, err := NewTelegramNotifier(svr.URL, "test_token", nil, nil)
+	require.NoError(t, err)
+	fetchFrom(tn, map[uint64][]byte{10: pngContents})
+
+	_, err = tn.Notify(context.Background(), 42, "", "", []raices.Message{msg}, nil)
+	require.NoError(t, err)
+
+	got := uploads()
+	require.Len(t, got, 2)
+	assert.Equal(t, sendDocumentPath, got[1].method)
+	assert.Equal(t, map[string]string{documentParam: "a.png"}, got[1].files)
+}
+
+func TestFormatCaption(t *testing.T) {
+	msg := raices.Message{
+		SentDate: time.Date(2021, time.Month(11), 11, 0, 0, 0, 0, time.UTC),
+		Subject:  strings.Repeat("a", 2000),
+	}
+
+	caption := formatCaption(msg, "")
+	assert.Equal(t, maxCaptionLength, textLength(caption))
+	assert.True(t, strings.HasSuffix(caption, "a…"))
+}
+
+// memStore is a blobstore.Store that keeps files in memory
+type memStore map[string][]byte
+
+func (ms memStore) Put(ctx context.Context, name string, r io.Reader) (string, time.Time, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	ms[name] = data
+
+	return "https://example.com/files/" + name + "?a=1&b=2", time.Date(2021, time.Month(11), 18, 0, 0, 0, 0, time.UTC), nil
+}
+
+func TestNotifyStoresOversizedAttachments(t *testing.T) {
+	msg := raices.Message{
+		ID:                  1,
+		ContainsAttachments: true,
+		Attachments: []raices.Attachment{
+			{ID: 10, FileName: "big.pdf"},
+			{ID: 11, FileName: "small.txt"},
+		},
+	}
+
+	tests := map[string]struct {
+		store memStore
+		note  string
+	}{
+		"with store": {
+			store: memStore{},
+			note:  `big.pdf - <a href="https://example.com/files/big.pdf?a=1&amp;b=2">descargar</a> (es demasiado grande para Telegram, el enlace caduca el 18/11/2021 00:00)`,
+		},
+		"without store": {
+			note: "big.pdf - no se ha podido enviar, es demasiado grande para Telegram",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			svr, uploads := uploadServer(t)
+			defer svr.Close()
+
+			var store blobstore.Store
+			if tc.store != nil {
+				store = tc.store
+			}
+			tn, err := NewTelegramNotifier(svr.URL, "test_token", store, nil)
+			require.NoError(t, err)
+			tn.(*telegramNotifier).maxUploadSize = 4
+			fetchFrom(tn, map[uint64][]byte{10: pdfContents, 11: []byte("ok")})
+
+			ledger := memLedger{}
+			_, err = tn.Notify(context.Background(), 42, "", "", []raices.Message{msg}, ledger)
+			require.NoError(t, err)
+
+			got := uploads()
+			require.Len(t, got, 2)
+			assert.Contains(t, got[0].fields[textParam], "\t\t\t"+tc.note+"\n")
+			assert.Contains(t, got[0].fields[textParam], "\t\t\tsmall.txt\n")
+			assert.Equal(t, map[string]string{documentParam: "small.txt"}, got[1].files)
+			assert.True(t, ledger[repo.Delivery{MessageID: 1, AttachmentID: 10}])
+
+			if tc.store != nil {
+				assert.Equal(t, pdfContents, tc.store["big.pdf"])
+			}
+		})
+	}
+}
+
+func TestNotifyCountsAttachmentsOfUnknownSize(t *testing.T) {
+	files := map[string][]byte{"big.pdf": pdfContents, "small.txt": []byte("ok")}
+	raicesSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before writing the contents makes the response chunked
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(files[strings.TrimPrefix(r.URL.Path, "/")])
+	}))
+	defer raicesSvr.Close()
+
+	msg := raices.Message{
+		ID:                  1,
+		ContainsAttachments: true,
+		Attachments:         []raices.Attachment{{ID: 10, FileName: "big.pdf"}, {ID: 11, FileName: "small.txt"}},
+	}
+
+	svr, uploads := uploadServer(t)
+	defer svr.Close()
+
+	store := memStore{}
+	tn, err := NewTelegramNotifier(svr.URL, "test_token", store, nil)
+	require.NoError(t, err)
+	tn.(*telegramNotifier).maxUploadSize = 4
+	tn.(*telegramNotifier).fetch = func(ctx context.Context, a raices.Attachment) (io.ReadCloser, int64, error) {
+		resp, err := http.Get(raicesSvr.URL + "/" + a.FileName)
+		if err != nil {
+			return nil, 0, err
+		}
+		require.Equal(t, int64(-1), resp.ContentLength)
+		return resp.Body, resp.ContentLength, nil
+	}
+
+	_, err = tn.Notify(context.Background(), 42, "", "", []raices.Message{msg}, nil)
+	require.NoError(t, err)
+
+	got := uploads()
+	require.Len(t, got, 2)
+	assert.Contains(t, got[0].fields[textParam], "\t\t\tbig.pdf - <a href=")
+	assert.Contains(t, got[0].fields[textParam], "\t\t\tsmall.txt\n")
+	assert.Equal(t, map[string]string{documentParam: "small.txt"}, got[1].files)
+	assert.Equal(t, pdfContents, store["big.pdf"])
+}
+
+func TestNotifyOpensAttachmentsOneAtATime(t *testing.T) {
+	msg := raices.Message{
+		ID: 1,
+		Attachments: []raices.Attachment{
+			{ID: 10, FileName: "a.pdf"},
+			{ID: 11, FileName: "b.pdf"},
+			{ID: 12, FileName: "c.pdf"},
+		},
+	}
+
+	svr, uploads := uploadServer(t)
+	defer svr.Close()
+
+	tn, err := NewTelegramNotifier(svr.URL, "test_token", nil, nil)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	open, maxOpen := 0, 0
+	tn.(*telegramNotifier).fetch = func(ctx context.Context, a raices.Attachment) (io.ReadCloser, int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		open++
+		if open > maxOpen {
+			maxOpen = open
+		}
+		return &closeFunc{Reader: bytes.NewReader(pdfContents), close: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			open--
+		}}, int64(len(pdfContents)), nil
+	}
+
+	_, err = tn.Notify(context.Background(), 42, "", "", []raices.Message{msg}, nil)
+	require.NoError(t, err)
+
+	assert.Len(t, uploads(), 4)
+	assert.Equal(t, 1, maxOpen, "Expected attachments to be opened one at a time")
+	assert.Equal(t, 0, open, "Expected every attachment to be closed")
+}
+
+// closeFunc is a reader that calls close when it is closed
+type closeFunc struct {
+	io.Reader
+	close func()
+}
+
+func (cf *closeFunc) Close() error {
+	cf.close()
+	return nil
+}
+
+func TestNotifyReopensAttachmentsOnRetry(t *testing.T) {
+	msg := raices.Message{
+		ID:          1,
+		Attachments: []raices.Attachment{{ID: 10, FileName: "circular.pdf"}},
+	}
+
+	var mu sync.Mutex
+	attempts := 0
+	received := [][]byte{}
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if strings.HasSuffix(r.URL.Path, sendDocumentPath) {
+			attempts++
+			if attempts == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			f, _, err := r.FormFile(documentParam)
+			require.NoError(t, err)
+			data, err := io.ReadAll(f)
+			require.NoError(t, err)
+			received = append(received, data)
+		}
+
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+	}))
+	defer svr.Close()
+
+	tn, err := NewTelegramNotifier(svr.URL, "test_token", nil, nil)
+	require.NoError(t, err)
+	noWaits(tn.(*telegramNotifier).api)
+	fetchFrom(tn, map[uint64][]byte{10: pdfContents})
+
+	_, err = tn.Notify(context.Background(), 42, "", "", []raices.Message{msg}, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, [][]byte{pdfContents}, received)
+}
+
+func TestNotifyRetriesFailedDownloads(t *testing.T) {
+	downloadFails := true
+	fetch := func(ctx context.Context, a raices.Attachment) (io.ReadCloser, int64, error) {
+		contents := []byte("ok")
+		if a.ID == 11 {
+			if downloadFails {
+				return nil, 0, errors.New("received status code 500")
+			}
+			contents = pdfContents
+		}
+		return io.NopCloser(bytes.NewReader(contents)), int64(len(contents)), nil
+	}
+
+	tests := map[string]struct {
+		sentDate time.Time
+		note     string
+		last     uint64
+		retried  bool
+	}{
+		"recent message": {
+			sentDate: time.Now().Add(-time.Hour),
+			note:     "lazy.pdf - no se ha podido descargar de Raíces, se volverá a intentar más tarde",
+			last:     0,
+			retried:  true,
+		},
+		"old message": {
+			sentDate: time.Now().Add(-maxRetryAge - time.Hour),
+			note:     "lazy.pdf - no se ha podido descargar de Raíces",
+			last:     2,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			msgs := []raices.Message{
+				{
+					ID:                  1,
+					SentDate:            tc.sentDate,
+					ContainsAttachments: true,
+					Attachments:         []raices.Attachment{{ID: 10, FileName: "ok.txt"}, {ID: 11, FileName: "lazy.pdf"}},
+				},
+				{ID: 2, SentDate: tc.sentDate},
+			}
+
+			svr, uploads := uploadServer(t)
+			defer svr.Close()
+
+			tn, err := NewTelegramNotifier(svr.URL, "test_token", nil, nil)
+			require.NoError(t, err)
+			noWaits(tn.(*telegramNotifier).api)
+			tn.(*telegramNotifier).fetch = fetch
+
+			downloadFails = true
+			ledger := memLedger{}
+			last, err := tn.Notify(context.Background(), 42, "", "", msgs, ledger)
+			assert.Equal(t, tc.last, last)
+			assert.Equal(t, tc.retried, errors.Is(err, ErrDownloadFailed))
+
+			got := uploads()
+			require.Len(t, got, 3)
+			assert.Contains(t, got[0].fields[textParam], "\t\t\t"+tc.note+"\n")
+			assert.Equal(t, map[string]string{documentParam: "ok.txt"}, got[1].files)
+			assert.Equal(t, sendMessagePath, got[2].method)
+
+			// Only the failed attachment is sent in the next run, if it is retried at all
+			downloadFails = false
+			last, err = tn.Notify(context.Background(), 42, "", "", msgs, ledger)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(2), last)
+
+			got = uploads()[3:]
+			if tc.retried {
+				require.Len(t, got, 1)
+				assert.Equal(t, map[string]string{documentParam: "lazy.pdf"}, got[0].files)
+			} else {
+				assert.Empty(t, got)
+			}
+		})
+	}
+}
@@ -2,14 +2,22 @@ package raices
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"mime"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/publicsuffix"
 	"golang.org/x/text/encoding/charmap"
@@ -23,70 +31,321 @@ const (
 	userParam       = "USUARIO"
 	passParam       = "CLAVE"
 	verParam        = "p"
-	verString       = `{"version":"1.0.23"}`
 	loginCookieName = "JSESSIONID"
 
+	// DefaultAppVersion is the version of the pasendroid app the client identifies itself as
+	// unless told otherwise
+	DefaultAppVersion = "1.0.23"
+
+	// probeUser is the user the app version is probed with, which must not exist in Raíces
+	probeUser = "almendruco-version-probe"
+
 	msgPath     = "/raiz_app/jsp/pasendroid/mensajeria"
 	pageParam   = "PAGINA"
 	msgsPerPage = 10
 
 	attachmentPath     = "/raiz_app/jsp/pasendroid/descargaAdjMen"
 	attachmentNumParam = "X_ADJMENSAL"
+
+	readPath        = "/raiz_app/jsp/pasendroid/marcarLeido"
+	messageNumParam = "X_NOTMENSAL"
+
+	// requestTimeout bounds every request to Raíces, so that a hung server cannot
+	// block a caller that did not set a deadline of its own
+	requestTimeout = 30 * time.Second
+
+	// downloadAttempts is the number of times the download of an attachment is tried before
+	// giving up on it when it fails because of server or network errors
+	downloadAttempts = 3
+	// downloadRetryDelay is the delay before the first retry of a failed download, it doubles
+	// with every retry
+	downloadRetryDelay = time.Second
 )
 
+// Client fetches messages from Raíces. MarkRead marks a message as read, like opening it in
+// the app does. ProbeVersion checks whether Raíces still accepts the app version the client
+// identifies itself as, returning an error that matches ErrVersionRejected if it does not.
 type Client interface {
-	FetchMessages(creds repo.Credentials, lastNotifiedMessage uint64) ([]Message, error)
+	FetchMessages(ctx context.Context, creds repo.Credentials, lastNotifiedMessage uint64) ([]Message, error)
+	MarkRead(ctx context.Context, creds repo.Credentials, messageID uint64) error
+	CheckCredentials(ctx context.Context, creds repo.Credentials) error
+	ProbeVersion(ctx context.Context) error
 }
 
 type client struct {
-	http    *http.Client
 	baseURL *url.URL
+	store   repo.SessionStore
+	// verString is the app version sent along with the credentials in every login
+	verString string
+
+	// sessions holds the sessions of the accounts that have already logged in, keyed by user.
+	// Each session is only reused with the password it was logged in with.
+	mu       sync.Mutex
+	sessions map[string]*session
+
+	// retryDelay is the delay before the first retry of a failed download, it is only
+	// replaced in tests
+	retryDelay time.Duration
 }
 
-func NewClient(baseURL string) (Client, error) {
+// session holds the cookies of a logged in account. Every account gets its own session, so
+// that accounts never share cookies, not even when they are used concurrently.
+//
+// Attachments are downloaded with their own client, which shares the cookies but not the
+// timeout, as reading a big attachment may take longer. Downloads are only bounded by the
+// context of the caller.
+type session struct {
+	// passHash is the hash of the password the session was logged in with
+	passHash   string
+	jar        http.CookieJar
+	http       *http.Client
+	download   *http.Client
+	baseURL    *url.URL
+	verString  string
+	retryDelay time.Duration
+}
+
+// NewClient returns a Client for the Raíces instance at baseURL, which identifies itself as
+// the given version of the pasendroid app, or DefaultAppVersion if it is empty. The session
+// of each account is reused across calls and only renewed when it expires. If store is not
+// nil, sessions are also kept there, so that they can be reused after a restart.
+func NewClient(baseURL, appVersion string, store repo.SessionStore) (Client, error) {
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return &client{}, err
 	}
 
-	j, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if appVersion == "" {
+		appVersion = DefaultAppVersion
+	}
+	ver, err := json.Marshal(struct {
+		Version string `json:"version"`
+	}{appVersion})
 	if err != nil {
 		return &client{}, err
 	}
 
-	hc := &http.Client{Jar: j}
-
 	return &client{
-		http:    hc,
-		baseURL: u,
+		baseURL:    u,
+		store:      store,
+		verString:  string(ver),
+		sessions:   map[string]*session{},
+		retryDelay: downloadRetryDelay,
+	}, nil
+}
+
+func (c *client) newSession() (*session, error) {
+	j, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return &session{}, err
+	}
+
+	return &session{
+		jar:        j,
+		http:       &http.Client{Jar: j, Timeout: requestTimeout},
+		download:   &http.Client{Jar: j},
+		baseURL:    c.baseURL,
+		verString:  c.verString,
+		retryDelay: c.retryDelay,
 	}, nil
 }
 
-func (c *client) FetchMessages(creds repo.Credentials, lastNotifiedMessage uint64) ([]Message, error) {
-	// Login if needed
-	if err := c.login(creds); err != nil {
+func (c *client) FetchMessages(ctx context.Context, creds repo.Credentials, lastNotifiedMessage uint64) ([]Message, error) {
+	var msgs []Message
+	err := c.withSession(ctx, creds, func(s *session) error {
+		var err error
+		msgs, err = s.fetchMessages(ctx, lastNotifiedMessage)
+		return err
+	})
+	if err != nil {
 		return []Message{}, err
 	}
 
-	u, _ := url.Parse(c.baseURL.String())
-	u.Path = path.Join(u.Path, msgPath)
+	return msgs, nil
+}
+
+func (c *client) MarkRead(ctx context.Context, creds repo.Credentials, messageID uint64) error {
+	return c.withSession(ctx, creds, func(s *session) error {
+		return s.markRead(ctx, messageID)
+	})
+}
+
+// withSession calls f with the session of the account of creds. If f fails because a reused
+// session has expired, it logs in again and calls f once more.
+func (c *client) withSession(ctx context.Context, creds repo.Credentials, f func(s *session) error) error {
+	s, fresh, err := c.session(ctx, creds)
+	if err != nil {
+		return err
+	}
+
+	err = f(s)
+	if renewable(err) && !fresh {
+		// Log in again only when a reused session turns out to have expired
+		c.forget(ctx, creds.User)
+
+		s, err = c.login(ctx, creds)
+		if err != nil {
+			return err
+		}
+
+		err = f(s)
+	}
+
+	return err
+}
+
+// session returns the session of the account of creds, which is the one of a previous call
+// or the one kept in the store, if any was logged in with the same password. Otherwise, it
+// logs in. It also reports whether the session is a new one.
+func (c *client) session(ctx context.Context, creds repo.Credentials) (*session, bool, error) {
+	hash := passHash(creds)
+
+	c.mu.Lock()
+	s, ok := c.sessions[creds.User]
+	c.mu.Unlock()
+	if ok && s.passHash == hash {
+		return s, false, nil
+	}
+
+	if c.store != nil {
+		stored, err := c.store.GetSession(ctx, creds.User)
+		if err == nil && stored.PassHash != hash {
+			err = repo.ErrSessionNotFound
+		}
+		if err == nil {
+			s, err = c.restoreSession(stored)
+		}
+
+		if err == nil {
+			c.remember(creds.User, s)
+			return s, false, nil
+		}
+
+		if !errors.Is(err, repo.ErrSessionNotFound) {
+			log.Printf("unable to restore session of user %s: %s", creds.User, err)
+		}
+	}
+
+	s, err := c.login(ctx, creds)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return s, true, nil
+}
+
+// login logs in with creds and keeps the new session for the next calls
+func (c *client) login(ctx context.Context, creds repo.Credentials) (*session, error) {
+	s, err := c.newSession()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.login(ctx, creds); err != nil {
+		return nil, err
+	}
+	s.passHash = passHash(creds)
+
+	c.remember(creds.User, s)
+
+	if c.store != nil {
+		if err := c.store.SaveSession(ctx, repo.Session{User: creds.User, PassHash: s.passHash, Cookies: s.cookies()}); err != nil {
+			log.Printf("unable to save session of user %s: %s", creds.User, err)
+		}
+	}
+
+	return s, nil
+}
+
+func (c *client) remember(user string, s *session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sessions[user] = s
+}
+
+// forget discards the session of user, which has expired
+func (c *client) forget(ctx context.Context, user string) {
+	c.mu.Lock()
+	delete(c.sessions, user)
+	c.mu.Unlock()
+
+	if c.store != nil {
+		if err := c.store.DeleteSession(ctx, user); err != nil {
+			log.Printf("unable to delete session of user %s: %s", user, err)
+		}
+	}
+}
+
+// restoreSession builds a session with the cookies of a stored one
+func (c *client) restoreSession(stored repo.Session) (*session, error) {
+	if len(stored.Cookies) == 0 {
+		return nil, repo.ErrSessionNotFound
+	}
+
+	s, err := c.newSession()
+	if err != nil {
+		return nil, err
+	}
+	s.passHash = stored.PassHash
+
+	cookies := make([]*http.Cookie, 0, len(stored.Cookies))
+	for name, value := range stored.Cookies {
+		cookies = append(cookies, &http.Cookie{Name: name, Value: value, Path: "/"})
+	}
+	s.jar.SetCookies(s.baseURL, cookies)
+
+	return s, nil
+}
+
+// passHash returns the hash of the password of creds that sessions are matched against, which
+// is salted with the user so that it differs across accounts sharing a password
+func passHash(creds repo.Credentials) string {
+	sum := sha256.Sum256([]byte(creds.User + "\x00" + creds.Pass))
+	return hex.EncodeToString(sum[:])
+}
+
+// cookies returns the cookies that Raíces set in the session
+func (s *session) cookies() map[string]string {
+	cookies := map[string]string{}
+	for _, ck := range s.jar.Cookies(s.url(msgPath)) {
+		cookies[ck.Name] = ck.Value
+	}
+
+	return cookies
+}
+
+func (s *session) url(p string) *url.URL {
+	u, _ := url.Parse(s.baseURL.String())
+	u.Path = path.Join(u.Path, p)
+
+	return u
+}
+
+func (s *session) fetchMessages(ctx context.Context, lastNotifiedMessage uint64) ([]Message, error) {
+	u := s.url(msgPath)
 
 	msgs := []Message{}
 	numMsgs := msgsPerPage
 	for i := 1; numMsgs == msgsPerPage; i++ {
-		rawMsgs, err := c.fetchPage(u, i)
+		rawMsgs, err := s.fetchPage(ctx, u, i)
 		if err != nil {
 			return []Message{}, err
 		}
 
 		rawMsgs = filterNotified(rawMsgs, lastNotifiedMessage)
-		rawMsgs = c.downloadAttachments(rawMsgs)
-
 		parsed, err := parse(rawMsgs)
 		if err != nil {
 			return []Message{}, err
 		}
 
+		// Attachments are downloaded later, when they are opened, with this same session
+		for _, m := range parsed {
+			for j := range m.Attachments {
+				m.Attachments[j].open = s.attachmentOpener(m.Attachments[j])
+			}
+		}
+
 		numMsgs = len(parsed)
 
 		msgs = append(msgs, parsed...)
@@ -95,22 +354,56 @@ func (c *client) FetchMessages(creds repo.Credentials, lastNotifiedMessage uint6
 	return reverse(msgs), nil
 }
 
-func (c *client) login(creds repo.Credentials) error {
+// CheckCredentials performs a login in Raíces with the given credentials and returns
+// an error if it does not succeed
+func (c *client) CheckCredentials(ctx context.Context, creds repo.Credentials) error {
+	s, err := c.newSession()
+	if err != nil {
+		return err
+	}
+
+	return s.login(ctx, creds)
+}
+
+// ProbeVersion logs in as a user that does not exist. Raíces is expected to reject the login
+// because of the credentials, so that any other error in the status block is only returned
+// if it tells about the version.
+func (c *client) ProbeVersion(ctx context.Context) error {
+	s, err := c.newSession()
+	if err != nil {
+		return err
+	}
+
+	err = s.login(ctx, repo.Credentials{User: probeUser, Pass: probeUser})
+	var se *StatusError
+	if err == nil || (errors.As(err, &se) && !errors.Is(err, ErrVersionRejected)) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *session) login(ctx context.Context, creds repo.Credentials) error {
 	params := url.Values{}
 	params.Set(userParam, creds.User)
 	params.Set(passParam, creds.Pass)
-	params.Set(verParam, verString)
+	params.Set(verParam, s.verString)
 
-	u, _ := url.Parse(c.baseURL.String())
-	u.Path = path.Join(u.Path, loginPath)
-	resp, err := c.http.Post(u.String(), "application/x-www-form-urlencoded", strings.NewReader(params.Encode()))
+	u := s.url(loginPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.http.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("received status code %d", resp.StatusCode)
+	if err := checkStatusCode(resp); err != nil {
+		return err
 	}
 
 	data, err := io.ReadAll(resp.Body)
@@ -118,45 +411,112 @@ func (c *client) login(creds repo.Credentials) error {
 		return err
 	}
 
-	var loginResp loginResponse
+	var loginResp statusResponse
 	if err := json.Unmarshal(data, &loginResp); err != nil {
-		return err
+		return fmt.Errorf("%w: unable to decode login response: %s", ErrUnexpectedResponse, err)
 	}
 
-	if loginResp.Status.Code != statusCodeOK {
-		return fmt.Errorf("code %s in login response: %s", loginResp.Status.Code, loginResp.Status.Description)
-	}
-
-	return nil
+	return checkStatus(loginResp.Status)
 }
 
-func (c *client) fetchPage(u *url.URL, pageNum int) ([]rawMessage, error) {
+func (s *session) fetchPage(ctx context.Context, u *url.URL, pageNum int) ([]rawMessage, error) {
 	q := url.Values{}
 	q.Set(pageParam, fmt.Sprint(pageNum))
 	u.RawQuery = q.Encode()
-	resp, err := c.http.Get(u.String())
+	resp, err := s.get(ctx, u.String())
 	if err != nil {
 		return []rawMessage{}, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return []rawMessage{}, fmt.Errorf("%w: received status code %d", errSessionExpired, resp.StatusCode)
+	}
+	if err := checkStatusCode(resp); err != nil {
+		return []rawMessage{}, err
+	}
+
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return []rawMessage{}, err
 	}
 
+	// Expired sessions are sent to the login page
+	if isHTML(resp.Header.Get("Content-Type")) {
+		return []rawMessage{}, fmt.Errorf("%w: received an HTML page instead of the messages", errSessionExpired)
+	}
+
 	// For some reason, the server is using ISO 8859-1 to encode its responses instead of UTF-8
 	utf8Reader := transform.NewReader(bytes.NewReader(data), charmap.ISO8859_1.NewDecoder())
 	utf8Data, _ := io.ReadAll(utf8Reader)
 
 	var msgResp messagesResponse
 	if err := json.Unmarshal(utf8Data, &msgResp); err != nil {
+		return []rawMessage{}, fmt.Errorf("%w: unable to decode messages response: %s", ErrUnexpectedResponse, err)
+	}
+
+	if err := checkStatus(msgResp.Status); err != nil {
 		return []rawMessage{}, err
 	}
 
 	return msgResp.Messages, nil
 }
 
+func (s *session) markRead(ctx context.Context, messageID uint64) error {
+	u := s.url(readPath)
+	q := url.Values{}
+	q.Set(messageNumParam, fmt.Sprint(messageID))
+	u.RawQuery = q.Encode()
+
+	resp, err := s.get(ctx, u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: received status code %d", errSessionExpired, resp.StatusCode)
+	}
+	if err := checkStatusCode(resp); err != nil {
+		return err
+	}
+
+	if isHTML(resp.Header.Get("Content-Type")) {
+		return fmt.Errorf("%w: received an HTML page instead of the status", errSessionExpired)
+	}
+
+	var readResp statusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&readResp); err != nil {
+		return fmt.Errorf("%w: unable to decode read response: %s", ErrUnexpectedResponse, err)
+	}
+
+	return checkStatus(readResp.Status)
+}
+
+// checkStatusCode returns an error if resp does not have a 200 status code
+func checkStatusCode(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusServiceUnavailable:
+		return fmt.Errorf("%w: received status code %d", ErrMaintenance, resp.StatusCode)
+	default:
+		return fmt.Errorf("received status code %d", resp.StatusCode)
+	}
+}
+
+// checkStatus returns a *StatusError if the status block of a response reports an error
+func checkStatus(st status) error {
+	switch st.Code {
+	case statusCodeOK:
+		return nil
+	case "":
+		return fmt.Errorf("%w: missing status", ErrUnexpectedResponse)
+	default:
+		return &StatusError{Code: st.Code, Description: st.Description}
+	}
+}
+
 func filterNotified(rawMsgs []rawMessage, lastNotifiedMessage uint64) []rawMessage {
 	lastMessageToNotify := len(rawMsgs)
 	for j, r := range rawMsgs {
@@ -169,42 +529,88 @@ func filterNotified(rawMsgs []rawMessage, lastNotifiedMessage uint64) []rawMessa
 	return rawMsgs[:lastMessageToNotify]
 }
 
-func (c *client) downloadAttachments(rawMsgs []rawMessage) []rawMessage {
-	u, _ := url.Parse(c.baseURL.String())
-	u.Path = path.Join(u.Path, attachmentPath)
+// attachmentOpener returns a function that starts the download of a, retrying it if it fails
+// because of server or network errors
+func (s *session) attachmentOpener(a Attachment) func(ctx context.Context) (io.ReadCloser, int64, error) {
+	return func(ctx context.Context) (io.ReadCloser, int64, error) {
+		delay := s.retryDelay
+		for attempt := 1; ; attempt++ {
+			body, size, retry, err := s.downloadAttachment(ctx, a)
+			if err == nil {
+				return body, size, nil
+			}
+
+			if !retry || attempt == downloadAttempts || wait(ctx, delay) != nil {
+				return nil, 0, fmt.Errorf("unable to download attachment %d: %w", a.ID, err)
+			}
+			delay *= 2
+		}
+	}
+}
+
+// downloadAttachment starts the download of a once. If it fails, it also reports whether it is worth
+// retrying it.
+func (s *session) downloadAttachment(ctx context.Context, a Attachment) (io.ReadCloser, int64, bool, error) {
+	u := s.url(attachmentPath)
+	q := url.Values{}
+	q.Set(attachmentNumParam, fmt.Sprint(a.ID))
+	u.RawQuery = q.Encode()
 
-	// for each message...
-	downloaded := make([]rawMessage, 0, len(rawMsgs))
-	for _, m := range rawMsgs {
-		msgWithAttachments := m
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, false, err
+	}
 
-		// ...download each attachment
-		attachments := make([]rawAttachment, 0, len(m.Attachments))
-		for _, a := range m.Attachments {
-			q := url.Values{}
-			q.Set(attachmentNumParam, fmt.Sprint(a.ID))
-			u.RawQuery = q.Encode()
+	resp, err := s.download.Do(req)
+	if err != nil {
+		return nil, 0, ctx.Err() == nil, err
+	}
 
-			resp, err := c.http.Get(u.String())
-			if err != nil {
-				continue
-			}
-			defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		retry := resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+		return nil, 0, retry, fmt.Errorf("received status code %d", resp.StatusCode)
+	}
 
-			data, err := io.ReadAll(resp.Body)
-			if err != nil {
-				continue
-			}
+	// Raíces answers with an error page instead of the file when something goes wrong, e.g.
+	// if the session has expired
+	if isHTML(resp.Header.Get("Content-Type")) && !isHTMLFile(a.FileName) {
+		resp.Body.Close()
+		return nil, 0, false, fmt.Errorf("received an HTML page instead of the file")
+	}
 
-			attachments = append(attachments, rawAttachment{ID: a.ID, FileName: a.FileName, Contents: data})
-		}
+	return resp.Body, resp.ContentLength, false, nil
+}
 
-		msgWithAttachments.Attachments = attachments
+func wait(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
 
-		downloaded = append(downloaded, msgWithAttachments)
+func isHTML(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mt == "text/html"
+}
+
+func isHTMLFile(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".html" || ext == ".htm"
+}
+
+func (s *session) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return downloaded
+	return s.http.Do(req)
 }
 
 func parse(raw []rawMessage) ([]Message, error) {
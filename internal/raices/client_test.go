@@ -1,8 +1,10 @@
 package raices
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"net/http/httptest"
@@ -11,6 +13,7 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -28,7 +31,7 @@ func TestFetchMessages(t *testing.T) {
 	svr := httptest.NewServer(mux)
 	defer svr.Close()
 
-	c, err := NewClient(svr.URL)
+	c, err := NewClient(svr.URL, "", nil)
 	require.NoError(t, err, "Unable to create client")
 
 	testCreds := repo.Credentials{
@@ -36,7 +39,7 @@ func TestFetchMessages(t *testing.T) {
 		Pass: "s0m3p4ss",
 	}
 
-	msgs, err := c.FetchMessages(testCreds, 0)
+	msgs, err := c.FetchMessages(context.Background(), testCreds, 0)
 
 	require.NoError(t, err, "Unexpected error fetching messages")
 	require.Equal(t, 1, len(msgs), "Expected 1 message")
@@ -56,15 +59,258 @@ func TestFetchMessages(t *testing.T) {
 			{
 				ID:       123456,
 				FileName: "Some File.ext",
-				Contents: []byte{1, 2, 3, 4, 5, 6},
 			},
 		},
 		ReadDate: time.Date(2021, time.October, 2, 19, 3, 00, 00, cet),
 	}
 
-	if diff := cmp.Diff(expected, msgs[0]); diff != "" {
+	if diff := cmp.Diff(expected, msgs[0], cmpopts.IgnoreUnexported(Attachment{})); diff != "" {
 		t.Fatalf("Message not equal to expected:\n%s", diff)
 	}
+
+	// Attachments are downloaded when they are opened
+	rc, size, err := msgs[0].Attachments[0].Open(context.Background())
+	require.NoError(t, err)
+	defer rc.Close()
+
+	contents, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6}, contents)
+	assert.Equal(t, int64(6), size)
+}
+
+func TestOpenAttachmentFailure(t *testing.T) {
+	tests := map[string]struct {
+		handler  http.HandlerFunc
+		attempts int
+	}{
+		"server error": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			},
+			attempts: downloadAttempts,
+		},
+		"not found": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+			},
+			attempts: 1,
+		},
+		"error page": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+				_, _ = w.Write([]byte("<html><body>Sesión caducada</body></html>"))
+			},
+			attempts: 1,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			attempts := 0
+			mux := http.NewServeMux()
+			mux.Handle(loginPath, http.HandlerFunc(happyLoginHandler))
+			mux.Handle(msgPath, http.HandlerFunc(happyMessagesHandler))
+			mux.Handle(attachmentPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				tc.handler(w, r)
+			}))
+
+			svr := httptest.NewServer(mux)
+			defer svr.Close()
+
+			c, err := NewClient(svr.URL, "", nil)
+			require.NoError(t, err, "Unable to create client")
+			c.(*client).retryDelay = 0
+
+			msgs, err := c.FetchMessages(context.Background(), repo.Credentials{User: "Some User", Pass: "s0m3p4ss"}, 0)
+			require.NoError(t, err)
+			require.Len(t, msgs, 1)
+
+			_, _, err = msgs[0].Attachments[0].Open(context.Background())
+			assert.Error(t, err)
+			assert.Equal(t, tc.attempts, attempts)
+		})
+	}
+}
+
+func TestOpenAttachmentRetries(t *testing.T) {
+	attempts := 0
+	mux := http.NewServeMux()
+	mux.Handle(loginPath, http.HandlerFunc(happyLoginHandler))
+	mux.Handle(msgPath, http.HandlerFunc(happyMessagesHandler))
+	mux.Handle(attachmentPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		happyAttachmentHandler(w, r)
+	}))
+
+	svr := httptest.NewServer(mux)
+	defer svr.Close()
+
+	c, err := NewClient(svr.URL, "", nil)
+	require.NoError(t, err, "Unable to create client")
+	c.(*client).retryDelay = 0
+
+	msgs, err := c.FetchMessages(context.Background(), repo.Credentials{User: "Some User", Pass: "s0m3p4ss"}, 0)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	rc, _, err := msgs[0].Attachments[0].Open(context.Background())
+	require.NoError(t, err)
+	defer rc.Close()
+
+	contents, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6}, contents)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestOpenUnfetchedAttachment(t *testing.T) {
+	a := Attachment{ID: 1, FileName: "a.txt"}
+
+	_, _, err := a.Open(context.Background())
+	assert.Error(t, err)
+}
+
+func TestCheckCredentials(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle(loginPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue(passParam) != "s0m3p4ss" {
+			fmt.Fprint(w, `{"ESTADO": {"CODIGO": "E", "DESCRIPCION": "Usuario o clave incorrectos"}}`)
+			return
+		}
+
+		happyLoginHandler(w, r)
+	}))
+
+	svr := httptest.NewServer(mux)
+	defer svr.Close()
+
+	c, err := NewClient(svr.URL, "", nil)
+	require.NoError(t, err, "Unable to create client")
+
+	err = c.CheckCredentials(context.Background(), repo.Credentials{User: "Some User", Pass: "s0m3p4ss"})
+	assert.NoError(t, err)
+
+	err = c.CheckCredentials(context.Background(), repo.Credentials{User: "Some User", Pass: "wrong"})
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestLoginErrors(t *testing.T) {
+	tests := map[string]struct {
+		handler  http.HandlerFunc
+		expected error
+	}{
+		"maintenance": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "en mantenimiento", http.StatusServiceUnavailable)
+			},
+			expected: ErrMaintenance,
+		},
+		"not json": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "<html></html>")
+			},
+			expected: ErrUnexpectedResponse,
+		},
+		"missing status": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"RESULTADO": []}`)
+			},
+			expected: ErrUnexpectedResponse,
+		},
+		"version rejected": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"ESTADO": {"CODIGO": "E", "DESCRIPCION": "Versión no soportada, actualice la aplicación"}}`)
+			},
+			expected: ErrVersionRejected,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.Handle(loginPath, tc.handler)
+
+			svr := httptest.NewServer(mux)
+			defer svr.Close()
+
+			c, err := NewClient(svr.URL, "", nil)
+			require.NoError(t, err)
+
+			err = c.CheckCredentials(context.Background(), repo.Credentials{User: "Some User", Pass: "s0m3p4ss"})
+			assert.ErrorIs(t, err, tc.expected)
+		})
+	}
+}
+
+func TestProbeVersion(t *testing.T) {
+	tests := map[string]struct {
+		version     string
+		description string
+		expected    error
+	}{
+		"accepted":         {"1.0.30", "Usuario o clave incorrectos", nil},
+		"rejected":         {"1.0.23", "Versión no soportada, actualice la aplicación", ErrVersionRejected},
+		"other status":     {"1.0.30", "Error inesperado", nil},
+		"default accepted": {"", "Usuario o clave incorrectos", nil},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.Handle(loginPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.NoError(t, r.ParseForm())
+				assert.Equal(t, probeUser, r.Form.Get(userParam))
+
+				version := tc.version
+				if version == "" {
+					version = DefaultAppVersion
+				}
+				assert.JSONEq(t, fmt.Sprintf(`{"version":%q}`, version), r.Form.Get(verParam))
+
+				fmt.Fprintf(w, `{"ESTADO": {"CODIGO": "E", "DESCRIPCION": %q}}`, tc.description)
+			}))
+
+			svr := httptest.NewServer(mux)
+			defer svr.Close()
+
+			c, err := NewClient(svr.URL, tc.version, nil)
+			require.NoError(t, err)
+
+			err = c.ProbeVersion(context.Background())
+			if tc.expected == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestFetchMessagesHonoursContext(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle(loginPath, http.HandlerFunc(happyLoginHandler))
+	mux.Handle(msgPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+
+	svr := httptest.NewServer(mux)
+	defer svr.Close()
+
+	c, err := NewClient(svr.URL, "", nil)
+	require.NoError(t, err, "Unable to create client")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = c.FetchMessages(ctx, repo.Credentials{User: "Some User", Pass: "s0m3p4ss"}, 0)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
 }
 
 func happyLoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -129,7 +375,7 @@ func TestMultiPageMessages(t *testing.T) {
 	svr := httptest.NewServer(mux)
 	defer svr.Close()
 
-	c, err := NewClient(svr.URL)
+	c, err := NewClient(svr.URL, "", nil)
 	require.NoError(t, err, "Unable to create client")
 
 	testCreds := repo.Credentials{
@@ -137,7 +383,7 @@ func TestMultiPageMessages(t *testing.T) {
 		Pass: "s0m3p4ss",
 	}
 
-	msgs, err := c.FetchMessages(testCreds, 0)
+	msgs, err := c.FetchMessages(context.Background(), testCreds, 0)
 
 	assert.NoError(t, err, "Unexpected error fetching messages")
 	assert.Equal(t, 15, len(msgs), "Expected 15 messages")
@@ -151,7 +397,7 @@ func TestOnlyReturnsNonNotifiedMsgs(t *testing.T) {
 	svr := httptest.NewServer(mux)
 	defer svr.Close()
 
-	c, err := NewClient(svr.URL)
+	c, err := NewClient(svr.URL, "", nil)
 	require.NoError(t, err, "Unable to create client")
 
 	testCreds := repo.Credentials{
@@ -159,7 +405,7 @@ func TestOnlyReturnsNonNotifiedMsgs(t *testing.T) {
 		Pass: "s0m3p4ss",
 	}
 
-	msgs, err := c.FetchMessages(testCreds, 4)
+	msgs, err := c.FetchMessages(context.Background(), testCreds, 4)
 
 	assert.NoError(t, err, "Unexpected error fetching messages")
 	assert.Equal(t, 11, len(msgs), "Expected 11 messages")
@@ -211,3 +457,158 @@ func multiPageHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(messagesResp)
 }
+
+// memSessionStore is a repo.SessionStore that keeps sessions in memory
+type memSessionStore map[string]repo.Session
+
+func (ms memSessionStore) GetSession(ctx context.Context, user string) (repo.Session, error) {
+	s, ok := ms[user]
+	if !ok {
+		return repo.Session{}, repo.ErrSessionNotFound
+	}
+
+	return s, nil
+}
+
+func (ms memSessionStore) SaveSession(ctx context.Context, s repo.Session) error {
+	ms[s.User] = s
+	return nil
+}
+
+func (ms memSessionStore) DeleteSession(ctx context.Context, user string) error {
+	delete(ms, user)
+	return nil
+}
+
+// sessionServer accepts only the session of the last successful login, and expired sessions
+// get the error Raíces sends for them. Logins with the password "wrong" are rejected.
+func sessionServer(t *testing.T) (*httptest.Server, *int) {
+	logins := 0
+	mux := http.NewServeMux()
+	mux.Handle(loginPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue(passParam) == "wrong" {
+			fmt.Fprint(w, `{"ESTADO": {"CODIGO": "E", "DESCRIPCION": "Usuario o clave incorrectos"}}`)
+			return
+		}
+
+		logins++
+		http.SetCookie(w, &http.Cookie{Name: loginCookieName, Value: fmt.Sprintf("session%d", logins), Path: "/"})
+		fmt.Fprint(w, `{"ESTADO": {"CODIGO": "C"}}`)
+	}))
+	mux.Handle(msgPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ck, err := r.Cookie(loginCookieName)
+		if err != nil || ck.Value != fmt.Sprintf("session%d", logins) {
+			fmt.Fprint(w, `{"ESTADO": {"CODIGO": "E", "DESCRIPCION": "Sesión caducada"}}`)
+			return
+		}
+
+		happyMessagesHandler(w, r)
+	}))
+	mux.Handle(readPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ck, err := r.Cookie(loginCookieName)
+		if err != nil || ck.Value != fmt.Sprintf("session%d", logins) {
+			fmt.Fprint(w, `{"ESTADO": {"CODIGO": "E", "DESCRIPCION": "Sesión caducada"}}`)
+			return
+		}
+
+		if r.URL.Query().Get(messageNumParam) != "12345678" {
+			fmt.Fprint(w, `{"ESTADO": {"CODIGO": "E", "DESCRIPCION": "Mensaje no encontrado"}}`)
+			return
+		}
+
+		fmt.Fprint(w, `{"ESTADO": {"CODIGO": "C"}}`)
+	}))
+
+	svr := httptest.NewServer(mux)
+	t.Cleanup(svr.Close)
+
+	return svr, &logins
+}
+
+func TestFetchMessagesReusesSession(t *testing.T) {
+	svr, logins := sessionServer(t)
+
+	store := memSessionStore{}
+	c, err := NewClient(svr.URL, "", store)
+	require.NoError(t, err)
+
+	creds := repo.Credentials{User: "Some User", Pass: "s0m3p4ss"}
+	for i := 0; i < 2; i++ {
+		msgs, err := c.FetchMessages(context.Background(), creds, 0)
+		require.NoError(t, err)
+		assert.Len(t, msgs, 1)
+	}
+
+	assert.Equal(t, 1, *logins)
+	assert.Equal(t, map[string]string{loginCookieName: "session1"}, store["Some User"].Cookies)
+
+	// Another client, e.g. after a restart, reuses the stored session
+	c, err = NewClient(svr.URL, "", store)
+	require.NoError(t, err)
+
+	_, err = c.FetchMessages(context.Background(), creds, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, *logins)
+}
+
+func TestFetchMessagesRenewsExpiredSession(t *testing.T) {
+	svr, logins := sessionServer(t)
+
+	creds := repo.Credentials{User: "Some User", Pass: "s0m3p4ss"}
+	store := memSessionStore{"Some User": {User: "Some User", PassHash: passHash(creds), Cookies: map[string]string{loginCookieName: "expired"}}}
+	c, err := NewClient(svr.URL, "", store)
+	require.NoError(t, err)
+
+	msgs, err := c.FetchMessages(context.Background(), creds, 0)
+	require.NoError(t, err)
+	assert.Len(t, msgs, 1)
+
+	assert.Equal(t, 1, *logins)
+	assert.Equal(t, map[string]string{loginCookieName: "session1"}, store["Some User"].Cookies)
+}
+
+func TestFetchMessagesOnlyReusesSessionWithSamePassword(t *testing.T) {
+	svr, logins := sessionServer(t)
+
+	store := memSessionStore{}
+	c, err := NewClient(svr.URL, "", store)
+	require.NoError(t, err)
+
+	valid := repo.Credentials{User: "Some User", Pass: "s0m3p4ss"}
+	_, err = c.FetchMessages(context.Background(), valid, 0)
+	require.NoError(t, err)
+
+	// The session of the valid password is not reused with a stale one, which has to log in,
+	// neither from memory nor from the store, e.g. after a restart
+	restarted, err := NewClient(svr.URL, "", store)
+	require.NoError(t, err)
+
+	stale := repo.Credentials{User: "Some User", Pass: "wrong"}
+	for _, client := range []Client{c, restarted} {
+		_, err = client.FetchMessages(context.Background(), stale, 0)
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+	}
+	assert.Equal(t, 1, *logins)
+
+	// The session of the valid password is kept, and still reused with it
+	assert.Equal(t, passHash(valid), store["Some User"].PassHash)
+	_, err = c.FetchMessages(context.Background(), valid, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, *logins)
+}
+
+func TestMarkRead(t *testing.T) {
+	svr, logins := sessionServer(t)
+
+	creds := repo.Credentials{User: "Some User", Pass: "s0m3p4ss"}
+	store := memSessionStore{"Some User": {User: "Some User", PassHash: passHash(creds), Cookies: map[string]string{loginCookieName: "expired"}}}
+	c, err := NewClient(svr.URL, "", store)
+	require.NoError(t, err)
+
+	require.NoError(t, c.MarkRead(context.Background(), creds, 12345678))
+	assert.Equal(t, 1, *logins, "Expected the expired session to be renewed")
+
+	err = c.MarkRead(context.Background(), creds, 1)
+	var se *StatusError
+	assert.ErrorAs(t, err, &se)
+}
@@ -0,0 +1,93 @@
+package raices
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidCredentials is returned when Raíces rejects the user or the password of an account
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// ErrAccountLocked is returned when the account is locked, e.g. after too many failed logins
+	ErrAccountLocked = errors.New("account locked")
+
+	// ErrMaintenance is returned when Raíces is not available because of maintenance
+	ErrMaintenance = errors.New("server under maintenance")
+
+	// ErrVersionRejected is returned when Raíces does not accept the version of the app the
+	// client identifies itself as anymore
+	ErrVersionRejected = errors.New("app version rejected")
+
+	// ErrUnexpectedResponse is returned when a response does not have the expected format
+	ErrUnexpectedResponse = errors.New("unexpected response")
+
+	// errSessionExpired is returned when Raíces does not accept the session of a request
+	errSessionExpired = errors.New("session expired")
+)
+
+// StatusError is an error reported by Raíces in the status block of a response. It can be
+// compared with errors.Is to the errors above to find out its cause, which can only be told
+// from its description.
+type StatusError struct {
+	Code        string
+	Description string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Raíces error %s: %s", e.Code, e.Description)
+}
+
+// accentRemover leaves descriptions in plain ASCII, as Raíces is not consistent with accents
+var accentRemover = strings.NewReplacer("á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u", "ü", "u")
+
+// versionRejections are the wordings Raíces rejects the app version with. They are matched
+// as a whole, as a description that merely mentions a version stops every account.
+var versionRejections = []string{
+	"version no soportada",
+	"version de la aplicacion no valida",
+	"actualice la aplicacion",
+	"actualizar la aplicacion",
+}
+
+func (e *StatusError) Is(target error) bool {
+	desc := accentRemover.Replace(strings.ToLower(e.Description))
+	switch target {
+	case ErrInvalidCredentials:
+		// Rejected versions may be reported as not valid too, they are not the user's fault
+		return containsAny(desc, "incorrect", "no valid", "erroneo", "no existe") && !e.Is(ErrVersionRejected)
+	case ErrAccountLocked:
+		return containsAny(desc, "bloquead")
+	case ErrMaintenance:
+		return containsAny(desc, "mantenimiento", "no disponible")
+	case ErrVersionRejected:
+		return containsAny(desc, versionRejections...)
+	case errSessionExpired:
+		return containsAny(desc, "sesion")
+	}
+
+	return false
+}
+
+func containsAny(s string, substrs ...string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// renewable reports whether err may be caused by an expired session, so that logging in
+// again could fix it. Raíces does not always tell why it rejects a request, so any error
+// in the status block is taken as such, except those that another login cannot fix.
+func renewable(err error) bool {
+	var se *StatusError
+	if !errors.Is(err, errSessionExpired) && !errors.As(err, &se) {
+		return false
+	}
+
+	return !errors.Is(err, ErrMaintenance) && !errors.Is(err, ErrVersionRejected) && !errors.Is(err, ErrAccountLocked)
+}
@@ -0,0 +1,49 @@
+package raices
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusErrorIs(t *testing.T) {
+	targets := []error{ErrInvalidCredentials, ErrAccountLocked, ErrMaintenance, ErrVersionRejected, errSessionExpired}
+
+	tests := map[string]struct {
+		description string
+		expected    error
+	}{
+		"invalid credentials": {"Usuario o clave incorrectos", ErrInvalidCredentials},
+		"unknown user":        {"El usuario no existe", ErrInvalidCredentials},
+		"account locked":      {"Usuario BLOQUEADO por exceso de intentos", ErrAccountLocked},
+		"maintenance":         {"Sistema en mantenimiento. Inténtelo más tarde", ErrMaintenance},
+		"version rejected":    {"Debe actualizar la aplicación a la última versión", ErrVersionRejected},
+		"version not valid":   {"Versión de la aplicación no válida", ErrVersionRejected},
+		"session expired":     {"Sesión caducada", errSessionExpired},
+		"unknown":             {"Error inesperado", nil},
+		// Other mentions of a version are neither version rejections nor hide the actual cause
+		"credentials with version": {"Usuario o clave incorrectos (versión 2 del servicio)", ErrInvalidCredentials},
+		"other update":             {"Debe actualizar sus datos de contacto", nil},
+		"other version":            {"Error en la versión del mensaje", nil},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := fmt.Errorf("login failed: %w", &StatusError{Code: "E", Description: tc.description})
+			for _, target := range targets {
+				assert.Equal(t, target == tc.expected, errors.Is(err, target), "errors.Is(%q, %q)", tc.description, target)
+			}
+		})
+	}
+}
+
+func TestRenewable(t *testing.T) {
+	assert.True(t, renewable(fmt.Errorf("%w: received status code 401", errSessionExpired)))
+	assert.True(t, renewable(&StatusError{Code: "E", Description: "Error inesperado"}))
+	assert.False(t, renewable(&StatusError{Code: "E", Description: "Sistema en mantenimiento"}))
+	assert.False(t, renewable(&StatusError{Code: "E", Description: "Usuario bloqueado"}))
+	assert.False(t, renewable(fmt.Errorf("%w: missing status", ErrUnexpectedResponse)))
+	assert.False(t, renewable(nil))
+}
@@ -1,8 +1,15 @@
 package raices
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
 
-type loginResponse struct {
+// statusResponse is a response that only carries a status block, like those of logins and
+// of marking messages as read
+type statusResponse struct {
 	Status status `json:"ESTADO"`
 }
 
@@ -32,7 +39,6 @@ type rawMessage struct {
 type rawAttachment struct {
 	ID       uint64 `json:"X_ADJMENSAL"`
 	FileName string `json:"T_NOMFIC"`
-	Contents []byte
 }
 
 type Message struct {
@@ -49,7 +55,20 @@ type Message struct {
 type Attachment struct {
 	ID       uint64
 	FileName string
-	Contents []byte
+
+	open func(ctx context.Context) (io.ReadCloser, int64, error)
+}
+
+// Open returns the contents of the attachment along with their size in bytes, or -1 if it
+// is not known in advance. The contents of attachments fetched from Raíces are downloaded as
+// they are read, so that they never need to be held in memory as a whole. The reader must
+// be closed. Only attachments fetched from Raíces can be opened.
+func (a Attachment) Open(ctx context.Context) (io.ReadCloser, int64, error) {
+	if a.open == nil {
+		return nil, 0, fmt.Errorf("attachment %d was not fetched from Raíces", a.ID)
+	}
+
+	return a.open(ctx)
 }
 
 const dateFormat = "02/01/2006 15:04"
@@ -79,12 +98,9 @@ func parseMessage(rm rawMessage) (Message, error) {
 
 	attachments := make([]Attachment, len(rm.Attachments))
 	for i, ra := range rm.Attachments {
-		contents := make([]byte, len(ra.Contents))
-		copy(contents, ra.Contents)
 		attachments[i] = Attachment{
 			ID:       ra.ID,
 			FileName: ra.FileName,
-			Contents: contents,
 		}
 	}
 
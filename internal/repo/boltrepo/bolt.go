@@ -0,0 +1,629 @@
+// Package boltrepo implements repo.Repo on top of an embedded bbolt database, so that
+// almendruco can run without any external service.
+package boltrepo
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+// openTimeout bounds the wait for the file lock, which bbolt holds for as long as the
+// database is open. Only one process can have the database open at any given time.
+const openTimeout = 5 * time.Second
+
+var (
+	metaBucket       = []byte("meta")
+	chatsBucket      = []byte("chats")
+	deliveriesBucket = []byte("deliveries")
+	sessionsBucket   = []byte("sessions")
+
+	schemaVersionKey = []byte("schemaVersion")
+)
+
+// migration upgrades the database schema by one version
+type migration func(tx *bolt.Tx) error
+
+// migrations holds every schema migration in the order they must be applied. The schema
+// version of a database is the number of migrations already applied to it, so migrations
+// must only ever be appended to this list.
+var migrations = []migration{
+	// 1: chats are stored as JSON documents keyed by chat ID
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(chatsBucket)
+		return err
+	},
+	// 2: the delivery ledger is stored with a key per delivery, see deliveryKey
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(deliveriesBucket)
+		return err
+	},
+	// 3: Raíces sessions are stored as JSON documents keyed by user
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	},
+	// 4: delivery keys end with the part of the text too, 0 for the deliveries stored before
+	func(tx *bolt.Tx) error {
+		b := tx.Bucket(deliveriesBucket)
+
+		keys := [][]byte{}
+		if err := b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			if err := b.Put(append(k, make([]byte, 8)...), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
+
+type boltRepo struct {
+	db *bolt.DB
+}
+
+// chatRecord mirrors the layout of the chats stored in the chats bucket
+type chatRecord struct {
+	ID       string          `json:"id"`
+	Accounts []accountRecord `json:"accounts"`
+
+	MarkRead   bool `json:"markRead,omitempty"`
+	OnlyUnread bool `json:"onlyUnread,omitempty"`
+
+	DisabledAt     *time.Time `json:"disabledAt,omitempty"`
+	DisabledReason string     `json:"disabledReason,omitempty"`
+}
+
+type accountRecord struct {
+	Label               string            `json:"label,omitempty"`
+	Credentials         credentialsRecord `json:"credentials"`
+	LastNotifiedMessage uint64            `json:"lastNotifiedMessage"`
+	LoginFailures       int               `json:"loginFailures,omitempty"`
+}
+
+type credentialsRecord struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+// sessionRecord mirrors the layout of the sessions stored in the sessions bucket
+type sessionRecord struct {
+	User     string            `json:"user"`
+	PassHash string            `json:"passHash,omitempty"`
+	Cookies  map[string]string `json:"cookies"`
+}
+
+// NewRepo opens the database at path, creating it if it does not exist, and migrates it
+// to the latest schema version. The returned repository implements io.Closer.
+func NewRepo(path string) (repo.Repo, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return &boltRepo{}, fmt.Errorf("unable to open database %s: %w", path, err)
+	}
+
+	if err := db.Update(migrate); err != nil {
+		db.Close()
+		return &boltRepo{}, fmt.Errorf("database migration failed: %w", err)
+	}
+
+	return &boltRepo{db: db}, nil
+}
+
+// migrate applies the migrations that have not been applied yet
+func migrate(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+
+	version := uint64(0)
+	if v := meta.Get(schemaVersionKey); v != nil {
+		version = binary.BigEndian.Uint64(v)
+	}
+
+	if version > uint64(len(migrations)) {
+		return fmt.Errorf("schema version %d is newer than the latest known version %d", version, len(migrations))
+	}
+
+	for ; version < uint64(len(migrations)); version++ {
+		if err := migrations[version](tx); err != nil {
+			return fmt.Errorf("migration to version %d failed: %w", version+1, err)
+		}
+	}
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, version)
+
+	return meta.Put(schemaVersionKey, v)
+}
+
+func (br *boltRepo) Close() error {
+	return br.db.Close()
+}
+
+func (br *boltRepo) GetChats(ctx context.Context) ([]repo.Chat, error) {
+	chats := []repo.Chat{}
+	err := br.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(chatsBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			cr := chatRecord{}
+			if err := json.Unmarshal(v, &cr); err != nil {
+				return fmt.Errorf("failed to unmarshal record: %w", err)
+			}
+
+			chats = append(chats, cr.toChat())
+
+			return nil
+		})
+	})
+	if err != nil {
+		return []repo.Chat{}, fmt.Errorf("unable to fetch chats from DB: %w", err)
+	}
+
+	return chats, nil
+}
+
+func (br *boltRepo) GetChat(ctx context.Context, chatID string) (repo.Chat, error) {
+	var chat repo.Chat
+	err := br.db.View(func(tx *bolt.Tx) error {
+		cr, err := getChat(tx, chatID)
+		if err != nil {
+			return err
+		}
+
+		chat = cr.toChat()
+
+		return nil
+	})
+	if err != nil {
+		return repo.Chat{}, err
+	}
+
+	return chat, nil
+}
+
+func (br *boltRepo) SaveChat(ctx context.Context, chat repo.Chat) error {
+	err := br.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteDeliveries(tx, chatPrefix(chat.ID), func(repo.Delivery) bool { return true }); err != nil {
+			return err
+		}
+
+		return putChat(tx, fromChat(chat))
+	})
+	if err != nil {
+		return fmt.Errorf("save chat failed: %w", err)
+	}
+
+	return nil
+}
+
+func (br *boltRepo) DeleteChat(ctx context.Context, chatID string) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(chatsBucket)
+		if b.Get([]byte(chatID)) == nil {
+			return repo.ErrChatNotFound
+		}
+
+		if err := b.Delete([]byte(chatID)); err != nil {
+			return err
+		}
+
+		return deleteDeliveries(tx, chatPrefix(chatID), func(repo.Delivery) bool { return true })
+	})
+}
+
+// SaveAccount keeps the cursor of an existing account, the deliveries are not touched as
+// they are stored apart from the chat
+func (br *boltRepo) SaveAccount(ctx context.Context, chatID string, a repo.Account) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		cr, err := getChat(tx, chatID)
+		if err == repo.ErrChatNotFound {
+			cr = chatRecord{ID: chatID}
+		} else if err != nil {
+			return err
+		}
+
+		ar := fromAccount(a)
+		for i := range cr.Accounts {
+			if cr.Accounts[i].Credentials.User == a.Credentials.User {
+				ar.LastNotifiedMessage = cr.Accounts[i].LastNotifiedMessage
+				cr.Accounts[i] = ar
+				return putChat(tx, cr)
+			}
+		}
+
+		cr.Accounts = append(cr.Accounts, ar)
+		return putChat(tx, cr)
+	})
+}
+
+func (br *boltRepo) DeleteAccount(ctx context.Context, chatID, user string) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		cr, err := getChat(tx, chatID)
+		if err == repo.ErrChatNotFound {
+			return repo.ErrAccountNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		for i := range cr.Accounts {
+			if cr.Accounts[i].Credentials.User == user {
+				cr.Accounts = append(cr.Accounts[:i], cr.Accounts[i+1:]...)
+				if err := putChat(tx, cr); err != nil {
+					return err
+				}
+
+				return deleteDeliveries(tx, accountPrefix(chatID, user), func(repo.Delivery) bool { return true })
+			}
+		}
+
+		return repo.ErrAccountNotFound
+	})
+}
+
+func (br *boltRepo) UpdateLastNotifiedMessage(ctx context.Context, chatID, user string, lastNotifiedMessage uint64) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		cr, err := getChat(tx, chatID)
+		if err == repo.ErrChatNotFound {
+			return repo.ErrAccountNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		for i := range cr.Accounts {
+			if cr.Accounts[i].Credentials.User == user {
+				if cr.Accounts[i].LastNotifiedMessage >= lastNotifiedMessage {
+					return nil
+				}
+
+				cr.Accounts[i].LastNotifiedMessage = lastNotifiedMessage
+				return putChat(tx, cr)
+			}
+		}
+
+		return repo.ErrAccountNotFound
+	})
+}
+
+func (br *boltRepo) SetLastNotifiedMessage(ctx context.Context, chatID, user string, lastNotifiedMessage uint64) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		cr, err := getChat(tx, chatID)
+		if err == repo.ErrChatNotFound {
+			return repo.ErrAccountNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		for i := range cr.Accounts {
+			if cr.Accounts[i].Credentials.User == user {
+				cr.Accounts[i].LastNotifiedMessage = lastNotifiedMessage
+				return putChat(tx, cr)
+			}
+		}
+
+		return repo.ErrAccountNotFound
+	})
+}
+
+func (br *boltRepo) UpdateLoginFailures(ctx context.Context, chatID, user string, failures int) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		cr, err := getChat(tx, chatID)
+		if err == repo.ErrChatNotFound {
+			return repo.ErrAccountNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		for i := range cr.Accounts {
+			if cr.Accounts[i].Credentials.User == user {
+				cr.Accounts[i].LoginFailures = failures
+				return putChat(tx, cr)
+			}
+		}
+
+		return repo.ErrAccountNotFound
+	})
+}
+
+func (br *boltRepo) DisableChat(ctx context.Context, chatID, reason string, at time.Time) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		cr, err := getChat(tx, chatID)
+		if err != nil {
+			return err
+		}
+
+		at = at.UTC()
+		cr.DisabledAt = &at
+		cr.DisabledReason = reason
+
+		return putChat(tx, cr)
+	})
+}
+
+func (br *boltRepo) EnableChat(ctx context.Context, chatID string) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		cr, err := getChat(tx, chatID)
+		if err != nil {
+			return err
+		}
+
+		cr.DisabledAt = nil
+		cr.DisabledReason = ""
+
+		return putChat(tx, cr)
+	})
+}
+
+func (br *boltRepo) SetMarkRead(ctx context.Context, chatID string, on bool) error {
+	return br.updateChat(chatID, func(cr *chatRecord) { cr.MarkRead = on })
+}
+
+func (br *boltRepo) SetOnlyUnread(ctx context.Context, chatID string, on bool) error {
+	return br.updateChat(chatID, func(cr *chatRecord) { cr.OnlyUnread = on })
+}
+
+// updateChat applies update to the record of a chat
+func (br *boltRepo) updateChat(chatID string, update func(cr *chatRecord)) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		cr, err := getChat(tx, chatID)
+		if err != nil {
+			return err
+		}
+
+		update(&cr)
+
+		return putChat(tx, cr)
+	})
+}
+
+func (br *boltRepo) GetDeliveries(ctx context.Context, chatID, user string) ([]repo.Delivery, error) {
+	deliveries := []repo.Delivery{}
+	err := br.db.View(func(tx *bolt.Tx) error {
+		if err := checkAccount(tx, chatID, user); err != nil {
+			return err
+		}
+
+		prefix := accountPrefix(chatID, user)
+		c := tx.Bucket(deliveriesBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			deliveries = append(deliveries, parseDeliveryKey(k))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []repo.Delivery{}, err
+	}
+
+	return deliveries, nil
+}
+
+func (br *boltRepo) RecordDelivery(ctx context.Context, chatID, user string, d repo.Delivery) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		if err := checkAccount(tx, chatID, user); err != nil {
+			return err
+		}
+
+		return tx.Bucket(deliveriesBucket).Put(deliveryKey(chatID, user, d), []byte{})
+	})
+}
+
+func (br *boltRepo) PruneDeliveries(ctx context.Context, chatID, user string, upTo uint64) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		if err := checkAccount(tx, chatID, user); err != nil {
+			return err
+		}
+
+		return deleteDeliveries(tx, accountPrefix(chatID, user), func(d repo.Delivery) bool {
+			return d.MessageID <= upTo
+		})
+	})
+}
+
+func (br *boltRepo) GetSession(ctx context.Context, user string) (repo.Session, error) {
+	sr := sessionRecord{}
+	err := br.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(sessionsBucket).Get([]byte(user))
+		if v == nil {
+			return repo.ErrSessionNotFound
+		}
+
+		if err := json.Unmarshal(v, &sr); err != nil {
+			return fmt.Errorf("failed to unmarshal record: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return repo.Session{}, err
+	}
+
+	return repo.Session{User: sr.User, PassHash: sr.PassHash, Cookies: sr.Cookies}, nil
+}
+
+func (br *boltRepo) SaveSession(ctx context.Context, s repo.Session) error {
+	v, err := json.Marshal(sessionRecord{User: s.User, PassHash: s.PassHash, Cookies: s.Cookies})
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	return br.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(s.User), v)
+	})
+}
+
+func (br *boltRepo) DeleteSession(ctx context.Context, user string) error {
+	return br.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(user))
+	})
+}
+
+// checkAccount returns repo.ErrAccountNotFound if the chat is not subscribed to the account of user
+func checkAccount(tx *bolt.Tx, chatID, user string) error {
+	cr, err := getChat(tx, chatID)
+	if err == repo.ErrChatNotFound {
+		return repo.ErrAccountNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, a := range cr.Accounts {
+		if a.Credentials.User == user {
+			return nil
+		}
+	}
+
+	return repo.ErrAccountNotFound
+}
+
+// deleteDeliveries deletes the deliveries with the given key prefix for which del returns true
+func deleteDeliveries(tx *bolt.Tx, prefix []byte, del func(repo.Delivery) bool) error {
+	b := tx.Bucket(deliveriesBucket)
+
+	// Keys are collected first, as the bucket cannot be modified while iterating over it
+	keys := [][]byte{}
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if del(parseDeliveryKey(k)) {
+			keys = append(keys, append([]byte{}, k...))
+		}
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliveryKey builds the key of a delivery, which is made of the chat ID and the user,
+// both followed by a zero byte, and the message and attachment IDs and the part in big
+// endian, so that the deliveries of a chat and of an account can be iterated with a prefix
+func deliveryKey(chatID, user string, d repo.Delivery) []byte {
+	k := accountPrefix(chatID, user)
+	k = append(k, make([]byte, 24)...)
+	binary.BigEndian.PutUint64(k[len(k)-24:], d.MessageID)
+	binary.BigEndian.PutUint64(k[len(k)-16:], d.AttachmentID)
+	binary.BigEndian.PutUint64(k[len(k)-8:], d.Part)
+
+	return k
+}
+
+func parseDeliveryKey(k []byte) repo.Delivery {
+	return repo.Delivery{
+		MessageID:    binary.BigEndian.Uint64(k[len(k)-24:]),
+		AttachmentID: binary.BigEndian.Uint64(k[len(k)-16:]),
+		Part:         binary.BigEndian.Uint64(k[len(k)-8:]),
+	}
+}
+
+func chatPrefix(chatID string) []byte {
+	return append([]byte(chatID), 0)
+}
+
+func accountPrefix(chatID, user string) []byte {
+	return append(append(chatPrefix(chatID), user...), 0)
+}
+
+func getChat(tx *bolt.Tx, chatID string) (chatRecord, error) {
+	v := tx.Bucket(chatsBucket).Get([]byte(chatID))
+	if v == nil {
+		return chatRecord{}, repo.ErrChatNotFound
+	}
+
+	cr := chatRecord{}
+	if err := json.Unmarshal(v, &cr); err != nil {
+		return chatRecord{}, fmt.Errorf("failed to unmarshal record: %w", err)
+	}
+
+	return cr, nil
+}
+
+func putChat(tx *bolt.Tx, cr chatRecord) error {
+	v, err := json.Marshal(cr)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	return tx.Bucket(chatsBucket).Put([]byte(cr.ID), v)
+}
+
+func fromChat(chat repo.Chat) chatRecord {
+	cr := chatRecord{
+		ID:             chat.ID,
+		Accounts:       make([]accountRecord, 0, len(chat.Accounts)),
+		MarkRead:       chat.MarkRead,
+		OnlyUnread:     chat.OnlyUnread,
+		DisabledReason: chat.DisabledReason,
+	}
+	if chat.Disabled() {
+		at := chat.DisabledAt.UTC()
+		cr.DisabledAt = &at
+	}
+
+	for _, a := range chat.Accounts {
+		cr.Accounts = append(cr.Accounts, fromAccount(a))
+	}
+
+	return cr
+}
+
+func fromAccount(a repo.Account) accountRecord {
+	return accountRecord{
+		Label: a.Label,
+		Credentials: credentialsRecord{
+			User: a.Credentials.User,
+			Pass: a.Credentials.Pass,
+		},
+		LastNotifiedMessage: a.LastNotifiedMessage,
+		LoginFailures:       a.LoginFailures,
+	}
+}
+
+func (cr chatRecord) toChat() repo.Chat {
+	chat := repo.Chat{ID: cr.ID, MarkRead: cr.MarkRead, OnlyUnread: cr.OnlyUnread, DisabledReason: cr.DisabledReason}
+	if cr.DisabledAt != nil {
+		chat.DisabledAt = *cr.DisabledAt
+	}
+
+	for _, a := range cr.Accounts {
+		chat.Accounts = append(chat.Accounts, repo.Account{
+			Label: a.Label,
+			Credentials: repo.Credentials{
+				User: a.Credentials.User,
+				Pass: a.Credentials.Pass,
+			},
+			LastNotifiedMessage: a.LastNotifiedMessage,
+			LoginFailures:       a.LoginFailures,
+		})
+	}
+
+	return chat
+}
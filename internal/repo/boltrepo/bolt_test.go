@@ -0,0 +1,179 @@
+package boltrepo
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/volmedo/almendruco.git/internal/repo"
+	"github.com/volmedo/almendruco.git/internal/repo/repotest"
+)
+
+func newTestRepo(t *testing.T, path string) repo.Repo {
+	r, err := NewRepo(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { r.(io.Closer).Close() })
+
+	return r
+}
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repo.Repo {
+		return newTestRepo(t, filepath.Join(t.TempDir(), "almendruco.db"))
+	})
+}
+
+func TestDataSurvivesReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "almendruco.db")
+	chat := repo.Chat{
+		ID:       "42",
+		Accounts: []repo.Account{{Credentials: repo.Credentials{User: "user", Pass: "pass"}, LastNotifiedMessage: 7}},
+	}
+
+	r, err := NewRepo(path)
+	require.NoError(t, err)
+	require.NoError(t, r.SaveChat(context.Background(), chat))
+	require.NoError(t, r.(io.Closer).Close())
+
+	r = newTestRepo(t, path)
+	got, err := r.GetChat(context.Background(), "42")
+	require.NoError(t, err)
+	assert.Equal(t, chat, got)
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "almendruco.db")
+	newTestRepo(t, path).(io.Closer).Close()
+
+	db, err := bolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(metaBucket).Get(schemaVersionKey)
+		require.NotNil(t, v)
+		assert.Equal(t, uint64(len(migrations)), binary.BigEndian.Uint64(v))
+		assert.NotNil(t, tx.Bucket(chatsBucket))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "almendruco.db")
+
+	db, err := bolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(len(migrations)+1))
+
+		return meta.Put(schemaVersionKey, v)
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = NewRepo(path)
+	assert.Error(t, err)
+}
+
+func TestMigrateKeepsData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "almendruco.db")
+	chat := repo.Chat{
+		ID:       "42",
+		Accounts: []repo.Account{{Credentials: repo.Credentials{User: "user", Pass: "pass"}, LastNotifiedMessage: 7}},
+	}
+
+	// Create a database with the first version of the schema
+	db, err := bolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, 1)
+		if err := meta.Put(schemaVersionKey, v); err != nil {
+			return err
+		}
+
+		if err := migrations[0](tx); err != nil {
+			return err
+		}
+
+		return putChat(tx, fromChat(chat))
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	r := newTestRepo(t, path)
+
+	got, err := r.GetChat(context.Background(), "42")
+	require.NoError(t, err)
+	assert.Equal(t, chat, got)
+
+	require.NoError(t, r.RecordDelivery(context.Background(), "42", "user", repo.Delivery{MessageID: 8}))
+}
+
+func TestMigrateKeepsDeliveries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "almendruco.db")
+	chat := repo.Chat{
+		ID:       "42",
+		Accounts: []repo.Account{{Credentials: repo.Credentials{User: "user", Pass: "pass"}, LastNotifiedMessage: 7}},
+	}
+
+	// Create a database with the third version of the schema, whose delivery keys end
+	// with the message and attachment IDs
+	db, err := bolt.Open(path, 0600, nil)
+	require.NoError(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, 3)
+		if err := meta.Put(schemaVersionKey, v); err != nil {
+			return err
+		}
+
+		for _, m := range migrations[:3] {
+			if err := m(tx); err != nil {
+				return err
+			}
+		}
+
+		k := accountPrefix("42", "user")
+		k = append(k, make([]byte, 16)...)
+		binary.BigEndian.PutUint64(k[len(k)-16:], 8)
+		binary.BigEndian.PutUint64(k[len(k)-8:], 3)
+		if err := tx.Bucket(deliveriesBucket).Put(k, []byte{}); err != nil {
+			return err
+		}
+
+		return putChat(tx, fromChat(chat))
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	r := newTestRepo(t, path)
+
+	deliveries, err := r.GetDeliveries(context.Background(), "42", "user")
+	require.NoError(t, err)
+	assert.Equal(t, []repo.Delivery{{MessageID: 8, AttachmentID: 3}}, deliveries)
+}
@@ -0,0 +1,92 @@
+package credcipher
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+const aesGCMPrefix = "aesgcm:v1:"
+
+type aesGCMCipher struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCM returns a CredentialCipher that encrypts values with AES-GCM using a local key.
+// key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func NewAESGCM(key []byte) (repo.CredentialCipher, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return &aesGCMCipher{}, err
+	}
+
+	return &aesGCMCipher{aead: aead}, nil
+}
+
+func (ac *aesGCMCipher) Encrypt(ctx context.Context, plaintext string) (string, error) {
+	sealed, err := seal(ac.aead, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return aesGCMPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (ac *aesGCMCipher) Decrypt(ctx context.Context, ciphertext string) (string, error) {
+	if !strings.HasPrefix(ciphertext, aesGCMPrefix) {
+		return "", repo.ErrNotEncrypted
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, aesGCMPrefix))
+	if err != nil {
+		return "", fmt.Errorf("bad ciphertext encoding: %w", err)
+	}
+
+	plaintext, err := open(ac.aead, sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("bad key: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce that is prepended to the result
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open reverses seal
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+
+	return plaintext, nil
+}
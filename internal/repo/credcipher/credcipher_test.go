@@ -0,0 +1,128 @@
+package credcipher
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, 32)
+
+func TestAESGCM(t *testing.T) {
+	c, err := NewAESGCM(testKey)
+	require.NoError(t, err)
+
+	encrypted, err := c.Encrypt(context.Background(), "s0m3p4ss")
+	require.NoError(t, err)
+	assert.NotContains(t, encrypted, "s0m3p4ss")
+
+	decrypted, err := c.Decrypt(context.Background(), encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "s0m3p4ss", decrypted)
+}
+
+func TestAESGCMWrongKey(t *testing.T) {
+	c, err := NewAESGCM(testKey)
+	require.NoError(t, err)
+
+	encrypted, err := c.Encrypt(context.Background(), "s0m3p4ss")
+	require.NoError(t, err)
+
+	other, err := NewAESGCM(bytes.Repeat([]byte{0x24}, 32))
+	require.NoError(t, err)
+
+	_, err = other.Decrypt(context.Background(), encrypted)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, repo.ErrNotEncrypted)
+}
+
+func TestNotEncrypted(t *testing.T) {
+	ks, err := NewLocalKeyService(testKey)
+	require.NoError(t, err)
+
+	aesGCM, err := NewAESGCM(testKey)
+	require.NoError(t, err)
+
+	for _, c := range []repo.CredentialCipher{aesGCM, NewEnvelope(ks)} {
+		_, err := c.Decrypt(context.Background(), "s0m3p4ss")
+		assert.ErrorIs(t, err, repo.ErrNotEncrypted)
+	}
+}
+
+func TestEnvelopeWithLocalKeyService(t *testing.T) {
+	ks, err := NewLocalKeyService(testKey)
+	require.NoError(t, err)
+
+	c := NewEnvelope(ks)
+
+	encrypted, err := c.Encrypt(context.Background(), "s0m3p4ss")
+	require.NoError(t, err)
+
+	// A new cipher has an empty data key cache, so it has to go through the key service
+	decrypted, err := NewEnvelope(ks).Decrypt(context.Background(), encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "s0m3p4ss", decrypted)
+}
+
+type kmsClientMock struct {
+	kmsiface.KMSAPI
+	generateCalls int
+	decryptCalls  int
+}
+
+func (m *kmsClientMock) GenerateDataKeyWithContext(ctx aws.Context, input *kms.GenerateDataKeyInput, opts ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+	m.generateCalls++
+	return &kms.GenerateDataKeyOutput{
+		Plaintext:      testKey,
+		CiphertextBlob: []byte("wrapped:" + *input.KeyId),
+	}, nil
+}
+
+func (m *kmsClientMock) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	m.decryptCalls++
+	return &kms.DecryptOutput{Plaintext: testKey}, nil
+}
+
+func TestEnvelopeWithKMS(t *testing.T) {
+	mockClient := &kmsClientMock{}
+	c := NewEnvelope(NewKMSKeyService(mockClient, "some-key"))
+
+	encrypted, err := c.Encrypt(context.Background(), "s0m3p4ss")
+	require.NoError(t, err)
+
+	// Another cipher, as in a later run, only knows the data key in its encrypted form
+	other := NewEnvelope(NewKMSKeyService(mockClient, "some-key"))
+	for i := 0; i < 3; i++ {
+		decrypted, err := other.Decrypt(context.Background(), encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "s0m3p4ss", decrypted)
+	}
+
+	assert.Equal(t, 1, mockClient.decryptCalls, "Expected decrypted data keys to be cached")
+}
+
+func TestEnvelopeReusesDataKey(t *testing.T) {
+	mockClient := &kmsClientMock{}
+	c := NewEnvelope(NewKMSKeyService(mockClient, "some-key"))
+
+	for _, pass := range []string{"s0m3p4ss", "0th3rp4ss", "c00k13"} {
+		encrypted, err := c.Encrypt(context.Background(), pass)
+		require.NoError(t, err)
+
+		decrypted, err := c.Decrypt(context.Background(), encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, pass, decrypted)
+	}
+
+	assert.Equal(t, 1, mockClient.generateCalls, "Expected a single data key to be generated")
+	assert.Zero(t, mockClient.decryptCalls, "Expected the data key to be known without decrypting it")
+}
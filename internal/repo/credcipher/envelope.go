@@ -0,0 +1,137 @@
+package credcipher
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+const envelopePrefix = "envelope:v1:"
+
+// KeyService generates data keys and decrypts them back. Data keys are returned both in plain
+// text, to be used right away, and encrypted with a master key that never leaves the service.
+type KeyService interface {
+	GenerateDataKey(ctx context.Context) (plaintext []byte, encrypted []byte, err error)
+	DecryptDataKey(ctx context.Context, encrypted []byte) ([]byte, error)
+}
+
+type envelopeCipher struct {
+	keys KeyService
+
+	mu sync.Mutex
+	// key is the data key values are encrypted with, it is generated on the first Encrypt
+	key, encryptedKey []byte
+	// Decrypted data keys are cached to avoid calling the key service for every chat
+	cache map[string][]byte
+}
+
+// NewEnvelope returns a CredentialCipher that uses envelope encryption: values are encrypted
+// with a data key generated once per cipher, which is stored encrypted alongside each value
+func NewEnvelope(ks KeyService) repo.CredentialCipher {
+	return &envelopeCipher{
+		keys:  ks,
+		cache: map[string][]byte{},
+	}
+}
+
+func (ec *envelopeCipher) Encrypt(ctx context.Context, plaintext string) (string, error) {
+	key, encryptedKey, err := ec.newDataKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := seal(aead, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return envelopePrefix +
+		base64.StdEncoding.EncodeToString(encryptedKey) + ":" +
+		base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (ec *envelopeCipher) Decrypt(ctx context.Context, ciphertext string) (string, error) {
+	if !strings.HasPrefix(ciphertext, envelopePrefix) {
+		return "", repo.ErrNotEncrypted
+	}
+
+	parts := strings.Split(strings.TrimPrefix(ciphertext, envelopePrefix), ":")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("bad ciphertext format")
+	}
+
+	encryptedKey, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("bad data key encoding: %w", err)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("bad ciphertext encoding: %w", err)
+	}
+
+	key, err := ec.dataKey(ctx, encryptedKey)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(aead, sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// newDataKey returns the data key to encrypt values with, along with its encrypted form,
+// generating it the first time
+func (ec *envelopeCipher) newDataKey(ctx context.Context) ([]byte, []byte, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ec.key != nil {
+		return ec.key, ec.encryptedKey, nil
+	}
+
+	key, encrypted, err := ec.keys.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to generate data key: %w", err)
+	}
+
+	ec.key, ec.encryptedKey = key, encrypted
+	ec.cache[string(encrypted)] = key
+
+	return key, encrypted, nil
+}
+
+func (ec *envelopeCipher) dataKey(ctx context.Context, encrypted []byte) ([]byte, error) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if key, ok := ec.cache[string(encrypted)]; ok {
+		return key, nil
+	}
+
+	key, err := ec.keys.DecryptDataKey(ctx, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt data key: %w", err)
+	}
+
+	ec.cache[string(encrypted)] = key
+
+	return key, nil
+}
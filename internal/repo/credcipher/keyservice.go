@@ -0,0 +1,82 @@
+package credcipher
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+const dataKeySize = 32
+
+type kmsKeyService struct {
+	kms   kmsiface.KMSAPI
+	keyID string
+}
+
+// NewKMSKeyService returns a KeyService backed by the AWS KMS key identified by keyID
+func NewKMSKeyService(client kmsiface.KMSAPI, keyID string) KeyService {
+	return &kmsKeyService{kms: client, keyID: keyID}
+}
+
+func (ks *kmsKeyService) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	out, err := ks.kms.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(ks.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+func (ks *kmsKeyService) DecryptDataKey(ctx context.Context, encrypted []byte) ([]byte, error) {
+	out, err := ks.kms.DecryptWithContext(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(ks.keyID),
+		CiphertextBlob: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Plaintext, nil
+}
+
+type localKeyService struct {
+	master cipher.AEAD
+}
+
+// NewLocalKeyService returns a KeyService that stands in for KMS by wrapping data keys with
+// a local master key, for environments where KMS is not available
+func NewLocalKeyService(masterKey []byte) (KeyService, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return &localKeyService{}, err
+	}
+
+	return &localKeyService{master: aead}, nil
+}
+
+func (ks *localKeyService) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, fmt.Errorf("unable to generate data key: %w", err)
+	}
+
+	encrypted, err := seal(ks.master, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, encrypted, nil
+}
+
+func (ks *localKeyService) DecryptDataKey(ctx context.Context, encrypted []byte) ([]byte, error) {
+	return open(ks.master, encrypted)
+}
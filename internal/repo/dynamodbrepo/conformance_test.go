@@ -0,0 +1,74 @@
+package dynamodbrepo
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/require"
+
+	"github.com/volmedo/almendruco.git/internal/repo"
+	"github.com/volmedo/almendruco.git/internal/repo/repotest"
+)
+
+// localEndpointEnv holds the endpoint of a DynamoDB Local instance to run the conformance
+// suite against, e.g. http://localhost:8000. The suite is skipped if it is not set, except
+// in CI, where it must always run.
+const localEndpointEnv = "DYNAMODB_LOCAL_ENDPOINT"
+
+var tableCount int64
+
+func TestConformance(t *testing.T) {
+	endpoint := os.Getenv(localEndpointEnv)
+	if endpoint == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatalf("%s must be set in CI", localEndpointEnv)
+		}
+		t.Skipf("%s not set", localEndpointEnv)
+	}
+
+	s, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(endpoint),
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("local", "local", ""),
+	})
+	require.NoError(t, err)
+	db := dynamodb.New(s)
+
+	repotest.Run(t, func(t *testing.T) repo.Repo {
+		suffix := fmt.Sprintf("test-%d-%d", time.Now().UnixNano(), atomic.AddInt64(&tableCount, 1))
+		table := createTable(t, db, tableName+"-"+suffix, "id")
+		sessionsTable := createTable(t, db, sessionsTableName+"-"+suffix, "user")
+
+		return &dynamoDBRepo{db: db, table: table, sessionsTable: sessionsTable, scanSegments: 2}
+	})
+}
+
+// createTable creates a table whose hash key is the string attribute key, and deletes it
+// when the test finishes
+func createTable(t *testing.T, db *dynamodb.DynamoDB, table, key string) string {
+	_, err := db.CreateTable(&dynamodb.CreateTableInput{
+		TableName:   aws.String(table),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(key), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(key), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String(table)}))
+
+	t.Cleanup(func() {
+		_, _ = db.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)})
+	})
+
+	return table
+}
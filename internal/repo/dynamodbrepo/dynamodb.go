@@ -1,10 +1,17 @@
 package dynamodbrepo
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -13,13 +20,72 @@ import (
 	"github.com/volmedo/almendruco.git/internal/repo"
 )
 
-const tableName = "almendruco-chats"
+const (
+	tableName = "almendruco-chats"
+
+	// saveAccountAttempts bounds the attempts of SaveAccount, which only need to be repeated
+	// when the chat is created or its account added by someone else in the meantime
+	saveAccountAttempts = 3
+
+	// sessionsTableName is the table where Raíces sessions are kept, keyed by user. It is only
+	// needed if sessions are persisted.
+	sessionsTableName = "almendruco-sessions"
+)
 
 type dynamoDBRepo struct {
-	db dynamodbiface.DynamoDBAPI
+	db            dynamodbiface.DynamoDBAPI
+	table         string
+	sessionsTable string
+	scanSegments  int
+}
+
+// chatItem mirrors the layout of the items stored in the chats table. Accounts are
+// stored in a map keyed by user so that their cursors can be updated individually.
+//
+// Items created before chats could subscribe to several accounts hold a single
+// account in the top-level credentials and lastNotifiedMessage attributes. They are
+// upgraded to the current layout the first time they are read by GetChats.
+type chatItem struct {
+	ID       string                 `dynamodbav:"id"`
+	Accounts map[string]accountItem `dynamodbav:"accounts,omitempty"`
+
+	MarkRead   bool `dynamodbav:"markRead,omitempty"`
+	OnlyUnread bool `dynamodbav:"onlyUnread,omitempty"`
+
+	// DisabledAt is a Unix timestamp in seconds, 0 if the chat is enabled
+	DisabledAt     int64  `dynamodbav:"disabledAt,omitempty"`
+	DisabledReason string `dynamodbav:"disabledReason,omitempty"`
+
+	Credentials         *credentialsItem `dynamodbav:"credentials,omitempty"`
+	LastNotifiedMessage uint64           `dynamodbav:"lastNotifiedMessage,omitempty"`
+}
+
+type accountItem struct {
+	Label               string          `dynamodbav:"label,omitempty"`
+	Credentials         credentialsItem `dynamodbav:"credentials"`
+	LastNotifiedMessage uint64          `dynamodbav:"lastNotifiedMessage"`
+	LoginFailures       int             `dynamodbav:"loginFailures,omitempty"`
+
+	// Delivered is the delivery ledger of the account, a set of deliveries formatted with
+	// formatDelivery. It is not part of repo.Chat, so saving a chat clears it.
+	Delivered []string `dynamodbav:"delivered,stringset,omitempty"`
+}
+
+type credentialsItem struct {
+	User string `dynamodbav:"user"`
+	Pass string `dynamodbav:"pass"`
+}
+
+// sessionItem mirrors the layout of the items stored in the sessions table
+type sessionItem struct {
+	User     string            `dynamodbav:"user"`
+	PassHash string            `dynamodbav:"passHash,omitempty"`
+	Cookies  map[string]string `dynamodbav:"cookies"`
 }
 
-func NewRepo() (repo.Repo, error) {
+// NewRepo returns a repository backed by the chats table. GetChats splits the scan of the
+// table in scanSegments segments that are scanned in parallel, which speeds up large tables.
+func NewRepo(scanSegments int) (repo.Repo, error) {
 	s, err := session.NewSession()
 	if err != nil {
 		return &dynamoDBRepo{}, fmt.Errorf("session creation failed: %s", err)
@@ -27,52 +93,731 @@ func NewRepo() (repo.Repo, error) {
 
 	db := dynamodb.New(s)
 
-	return &dynamoDBRepo{db: db}, nil
+	return NewRepoWithClient(db, scanSegments), nil
 }
 
-func NewRepoWithClient(client dynamodbiface.DynamoDBAPI) repo.Repo {
-	return &dynamoDBRepo{db: client}
+func NewRepoWithClient(client dynamodbiface.DynamoDBAPI, scanSegments int) repo.Repo {
+	if scanSegments < 1 {
+		scanSegments = 1
+	}
+
+	return &dynamoDBRepo{db: client, table: tableName, sessionsTable: sessionsTableName, scanSegments: scanSegments}
 }
 
-func (dr *dynamoDBRepo) GetChats() ([]repo.Chat, error) {
-	out, err := dr.db.Scan(&dynamodb.ScanInput{TableName: aws.String(tableName)})
-	if err != nil {
-		return []repo.Chat{}, fmt.Errorf("unable to fetch chats from DB: %w", err)
+// GetChats scans the whole table, following pagination and splitting the scan in as
+// many segments as configured, which are scanned in parallel
+func (dr *dynamoDBRepo) GetChats(ctx context.Context) ([]repo.Chat, error) {
+	segments := make([][]repo.Chat, dr.scanSegments)
+	errs := make([]error, dr.scanSegments)
+
+	var wg sync.WaitGroup
+	for i := 0; i < dr.scanSegments; i++ {
+		wg.Add(1)
+		go func(segment int) {
+			defer wg.Done()
+			segments[segment], errs[segment] = dr.scanSegment(ctx, segment)
+		}(i)
 	}
+	wg.Wait()
 
-	chats := make([]repo.Chat, 0, *out.Count)
-	for _, item := range out.Items {
-		chat := repo.Chat{}
-		if err := dynamodbattribute.UnmarshalMap(item, &chat); err != nil {
-			return []repo.Chat{}, fmt.Errorf("failed to unmarshal record: %w", err)
+	chats := []repo.Chat{}
+	for i := range segments {
+		if errs[i] != nil {
+			return []repo.Chat{}, errs[i]
 		}
 
-		chats = append(chats, chat)
+		chats = append(chats, segments[i]...)
 	}
 
 	return chats, nil
 }
 
-func (dr *dynamoDBRepo) UpdateLastNotifiedMessage(chatID string, lastNotifiedMessage uint64) error {
+func (dr *dynamoDBRepo) scanSegment(ctx context.Context, segment int) ([]repo.Chat, error) {
+	input := &dynamodb.ScanInput{TableName: aws.String(dr.table)}
+	if dr.scanSegments > 1 {
+		input.Segment = aws.Int64(int64(segment))
+		input.TotalSegments = aws.Int64(int64(dr.scanSegments))
+	}
+
+	chats := []repo.Chat{}
+	for {
+		out, err := dr.db.ScanWithContext(ctx, input)
+		if err != nil {
+			return []repo.Chat{}, fmt.Errorf("unable to fetch chats from DB: %w", err)
+		}
+
+		for _, item := range out.Items {
+			ci := chatItem{}
+			if err := dynamodbattribute.UnmarshalMap(item, &ci); err != nil {
+				return []repo.Chat{}, fmt.Errorf("failed to unmarshal record: %w", err)
+			}
+
+			chat := ci.toChat()
+			if ci.isLegacy() {
+				if err := dr.upgrade(ctx, chat); err != nil {
+					return []repo.Chat{}, err
+				}
+			}
+
+			chats = append(chats, chat)
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return chats, nil
+		}
+
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (dr *dynamoDBRepo) GetChat(ctx context.Context, chatID string) (repo.Chat, error) {
+	input := &dynamodb.GetItemInput{
+		Key:            chatKey(chatID),
+		TableName:      aws.String(dr.table),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	out, err := dr.db.GetItemWithContext(ctx, input)
+	if err != nil {
+		return repo.Chat{}, fmt.Errorf("unable to fetch chat from DB: %w", err)
+	}
+
+	if len(out.Item) == 0 {
+		return repo.Chat{}, repo.ErrChatNotFound
+	}
+
+	ci := chatItem{}
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &ci); err != nil {
+		return repo.Chat{}, fmt.Errorf("failed to unmarshal record: %w", err)
+	}
+
+	return ci.toChat(), nil
+}
+
+func (dr *dynamoDBRepo) SaveChat(ctx context.Context, chat repo.Chat) error {
+	input, err := dr.putChatInput(chat)
+	if err != nil {
+		return err
+	}
+
+	if _, err := dr.db.PutItemWithContext(ctx, input); err != nil {
+		return fmt.Errorf("save chat failed: %w", err)
+	}
+
+	return nil
+}
+
+// upgrade rewrites a chat stored with the legacy single-account layout, unless it has
+// been upgraded by someone else in the meantime
+func (dr *dynamoDBRepo) upgrade(ctx context.Context, chat repo.Chat) error {
+	input, err := dr.putChatInput(chat)
+	if err != nil {
+		return err
+	}
+
+	input.ConditionExpression = aws.String("attribute_not_exists(accounts)")
+
+	_, err = dr.db.PutItemWithContext(ctx, input)
+	if err != nil && !isConditionalCheckFailed(err) {
+		return fmt.Errorf("upgrade of chat %s failed: %w", chat.ID, err)
+	}
+
+	return nil
+}
+
+func (dr *dynamoDBRepo) DeleteChat(ctx context.Context, chatID string) error {
+	input := &dynamodb.DeleteItemInput{
+		Key:          chatKey(chatID),
+		TableName:    aws.String(dr.table),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	}
+
+	out, err := dr.db.DeleteItemWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("delete chat failed: %w", err)
+	}
+
+	if len(out.Attributes) == 0 {
+		return repo.ErrChatNotFound
+	}
+
+	return nil
+}
+
+// SaveAccount updates an existing account in place, so that its cursor and ledger are kept.
+// New accounts are added to the accounts of the chat, and chats that do not exist yet or that
+// still have the legacy layout are written whole.
+func (dr *dynamoDBRepo) SaveAccount(ctx context.Context, chatID string, a repo.Account) error {
+	for i := 0; i < saveAccountAttempts; i++ {
+		for _, save := range []func(context.Context, string, repo.Account) (bool, error){dr.updateAccount, dr.addAccount, dr.putAccount} {
+			saved, err := save(ctx, chatID, a)
+			if err != nil {
+				return fmt.Errorf("save account failed: %w", err)
+			}
+			if saved {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("save account failed: chat %s kept changing", chatID)
+}
+
+// updateAccount sets the label, credentials and login failures of an existing account. It
+// reports false if the chat has no account for the user.
+func (dr *dynamoDBRepo) updateAccount(ctx context.Context, chatID string, a repo.Account) (bool, error) {
+	creds, err := dynamodbattribute.Marshal(fromAccount(a).Credentials)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	values := map[string]*dynamodb.AttributeValue{
+		":creds":    creds,
+		":failures": {N: aws.String(strconv.Itoa(a.LoginFailures))},
+	}
+	update := "SET accounts.#user.credentials = :creds, accounts.#user.loginFailures = :failures"
+	if a.Label != "" {
+		values[":label"] = &dynamodb.AttributeValue{S: aws.String(a.Label)}
+		update += ", accounts.#user.label = :label"
+	} else {
+		update += " REMOVE accounts.#user.label"
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames:  map[string]*string{"#user": aws.String(a.Credentials.User)},
+		ExpressionAttributeValues: values,
+		Key:                       chatKey(chatID),
+		TableName:                 aws.String(dr.table),
+		ConditionExpression:       aws.String("attribute_exists(accounts.#user)"),
+		UpdateExpression:          aws.String(update),
+	}
+
+	return dr.conditionalUpdate(ctx, input)
+}
+
+// addAccount adds a new account to a chat. It reports false if the chat does not exist, has
+// the legacy layout or already has an account for the user.
+func (dr *dynamoDBRepo) addAccount(ctx context.Context, chatID string, a repo.Account) (bool, error) {
+	account, err := dynamodbattribute.Marshal(fromAccount(a))
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames:  map[string]*string{"#user": aws.String(a.Credentials.User)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":account": account},
+		Key:                       chatKey(chatID),
+		TableName:                 aws.String(dr.table),
+		ConditionExpression:       aws.String("attribute_exists(accounts) AND attribute_not_exists(accounts.#user)"),
+		UpdateExpression:          aws.String("SET accounts.#user = :account"),
+	}
+
+	return dr.conditionalUpdate(ctx, input)
+}
+
+// putAccount writes a chat that does not exist yet, has the legacy layout or has no
+// accounts, along with a. It reports false if the chat got accounts in the meantime.
+func (dr *dynamoDBRepo) putAccount(ctx context.Context, chatID string, a repo.Account) (bool, error) {
+	chat, err := dr.GetChat(ctx, chatID)
+	if errors.Is(err, repo.ErrChatNotFound) {
+		chat = repo.Chat{ID: chatID}
+	} else if err != nil {
+		return false, err
+	}
+
+	if old, ok := chat.Account(a.Credentials.User); ok {
+		a.LastNotifiedMessage = old.LastNotifiedMessage
+	}
+	chat.SetAccount(a)
+
+	input, err := dr.putChatInput(chat)
+	if err != nil {
+		return false, err
+	}
+	input.ConditionExpression = aws.String("attribute_not_exists(accounts)")
+
+	_, err = dr.db.PutItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (dr *dynamoDBRepo) DeleteAccount(ctx context.Context, chatID, user string) error {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{"#user": aws.String(user)},
+		Key:                      chatKey(chatID),
+		TableName:                aws.String(dr.table),
+		ConditionExpression:      aws.String("attribute_exists(accounts.#user)"),
+		UpdateExpression:         aws.String("REMOVE accounts.#user"),
+	}
+
+	deleted, err := dr.conditionalUpdate(ctx, input)
+	if err != nil {
+		return fmt.Errorf("delete account failed: %w", err)
+	}
+	if !deleted {
+		return repo.ErrAccountNotFound
+	}
+
+	return nil
+}
+
+// conditionalUpdate runs an update and reports false if its condition did not hold
+func (dr *dynamoDBRepo) conditionalUpdate(ctx context.Context, input *dynamodb.UpdateItemInput) (bool, error) {
+	_, err := dr.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// UpdateLastNotifiedMessage only moves the cursor forward. Updates to a message that is not
+// newer than the current one are ignored, so that overlapping runs cannot make it go back.
+func (dr *dynamoDBRepo) UpdateLastNotifiedMessage(ctx context.Context, chatID, user string, lastNotifiedMessage uint64) error {
 	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#user": aws.String(user),
+		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":last": {
 				N: aws.String(strconv.FormatUint(lastNotifiedMessage, 10)),
 			},
 		},
-		Key: map[string]*dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(chatID),
+		Key:                 chatKey(chatID),
+		TableName:           aws.String(dr.table),
+		ConditionExpression: aws.String("attribute_exists(accounts.#user) AND accounts.#user.lastNotifiedMessage < :last"),
+		UpdateExpression:    aws.String("SET accounts.#user.lastNotifiedMessage = :last"),
+	}
+
+	_, err := dr.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		// Either the account does not exist or the cursor is already past lastNotifiedMessage
+		chat, err := dr.GetChat(ctx, chatID)
+		if errors.Is(err, repo.ErrChatNotFound) {
+			return repo.ErrAccountNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("update last notified message failed: %w", err)
+		}
+
+		if _, ok := chat.Account(user); !ok {
+			return repo.ErrAccountNotFound
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("update last notified message failed: %s", err)
+	}
+
+	return nil
+}
+
+func (dr *dynamoDBRepo) SetLastNotifiedMessage(ctx context.Context, chatID, user string, lastNotifiedMessage uint64) error {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#user": aws.String(user),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":last": {
+				N: aws.String(strconv.FormatUint(lastNotifiedMessage, 10)),
 			},
 		},
-		TableName:        aws.String(tableName),
-		UpdateExpression: aws.String("SET lastNotifiedMessage = :last"),
+		Key:                 chatKey(chatID),
+		TableName:           aws.String(dr.table),
+		ConditionExpression: aws.String("attribute_exists(accounts.#user)"),
+		UpdateExpression:    aws.String("SET accounts.#user.lastNotifiedMessage = :last"),
+	}
+
+	_, err := dr.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return repo.ErrAccountNotFound
 	}
 
-	_, err := dr.db.UpdateItem(input)
 	if err != nil {
-		return fmt.Errorf("update last notified message failed: %s", err)
+		return fmt.Errorf("set last notified message failed: %s", err)
 	}
 
 	return nil
 }
+
+func (dr *dynamoDBRepo) UpdateLoginFailures(ctx context.Context, chatID, user string, failures int) error {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#user": aws.String(user),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":failures": {
+				N: aws.String(strconv.Itoa(failures)),
+			},
+		},
+		Key:                 chatKey(chatID),
+		TableName:           aws.String(dr.table),
+		ConditionExpression: aws.String("attribute_exists(accounts.#user)"),
+		UpdateExpression:    aws.String("SET accounts.#user.loginFailures = :failures"),
+	}
+
+	_, err := dr.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return repo.ErrAccountNotFound
+	}
+
+	if err != nil {
+		return fmt.Errorf("update login failures failed: %s", err)
+	}
+
+	return nil
+}
+
+func (dr *dynamoDBRepo) DisableChat(ctx context.Context, chatID, reason string, at time.Time) error {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":at":     {N: aws.String(strconv.FormatInt(at.Unix(), 10))},
+			":reason": {S: aws.String(reason)},
+		},
+		Key:                 chatKey(chatID),
+		TableName:           aws.String(dr.table),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		UpdateExpression:    aws.String("SET disabledAt = :at, disabledReason = :reason"),
+	}
+
+	return dr.updateChat(ctx, input)
+}
+
+func (dr *dynamoDBRepo) EnableChat(ctx context.Context, chatID string) error {
+	input := &dynamodb.UpdateItemInput{
+		Key:                 chatKey(chatID),
+		TableName:           aws.String(dr.table),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		UpdateExpression:    aws.String("REMOVE disabledAt, disabledReason"),
+	}
+
+	return dr.updateChat(ctx, input)
+}
+
+func (dr *dynamoDBRepo) SetMarkRead(ctx context.Context, chatID string, on bool) error {
+	return dr.setOption(ctx, chatID, "markRead", on)
+}
+
+func (dr *dynamoDBRepo) SetOnlyUnread(ctx context.Context, chatID string, on bool) error {
+	return dr.setOption(ctx, chatID, "onlyUnread", on)
+}
+
+// setOption sets the attribute of an option of a chat, or removes it if the option is off,
+// which is how options that are off are stored
+func (dr *dynamoDBRepo) setOption(ctx context.Context, chatID, attribute string, on bool) error {
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{"#option": aws.String(attribute)},
+		Key:                      chatKey(chatID),
+		TableName:                aws.String(dr.table),
+		ConditionExpression:      aws.String("attribute_exists(id)"),
+		UpdateExpression:         aws.String("REMOVE #option"),
+	}
+	if on {
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":on": {BOOL: aws.Bool(true)}}
+		input.UpdateExpression = aws.String("SET #option = :on")
+	}
+
+	return dr.updateChat(ctx, input)
+}
+
+// updateChat runs an update conditioned to the existence of the chat
+func (dr *dynamoDBRepo) updateChat(ctx context.Context, input *dynamodb.UpdateItemInput) error {
+	_, err := dr.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return repo.ErrChatNotFound
+	}
+
+	if err != nil {
+		return fmt.Errorf("update of chat failed: %w", err)
+	}
+
+	return nil
+}
+
+func (dr *dynamoDBRepo) GetDeliveries(ctx context.Context, chatID, user string) ([]repo.Delivery, error) {
+	input := &dynamodb.GetItemInput{
+		Key:                      chatKey(chatID),
+		TableName:                aws.String(dr.table),
+		ConsistentRead:           aws.Bool(true),
+		ProjectionExpression:     aws.String("accounts.#user"),
+		ExpressionAttributeNames: map[string]*string{"#user": aws.String(user)},
+	}
+
+	out, err := dr.db.GetItemWithContext(ctx, input)
+	if err != nil {
+		return []repo.Delivery{}, fmt.Errorf("unable to fetch deliveries from DB: %w", err)
+	}
+
+	ci := chatItem{}
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &ci); err != nil {
+		return []repo.Delivery{}, fmt.Errorf("failed to unmarshal record: %w", err)
+	}
+
+	a, ok := ci.Accounts[user]
+	if !ok {
+		return []repo.Delivery{}, repo.ErrAccountNotFound
+	}
+
+	deliveries := make([]repo.Delivery, 0, len(a.Delivered))
+	for _, s := range a.Delivered {
+		d, err := parseDelivery(s)
+		if err != nil {
+			return []repo.Delivery{}, err
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, nil
+}
+
+func (dr *dynamoDBRepo) RecordDelivery(ctx context.Context, chatID, user string, d repo.Delivery) error {
+	return dr.updateDeliveries(ctx, chatID, user, "ADD", []repo.Delivery{d})
+}
+
+func (dr *dynamoDBRepo) PruneDeliveries(ctx context.Context, chatID, user string, upTo uint64) error {
+	deliveries, err := dr.GetDeliveries(ctx, chatID, user)
+	if err != nil {
+		return err
+	}
+
+	pruned := []repo.Delivery{}
+	for _, d := range deliveries {
+		if d.MessageID <= upTo {
+			pruned = append(pruned, d)
+		}
+	}
+
+	if len(pruned) == 0 {
+		return nil
+	}
+
+	return dr.updateDeliveries(ctx, chatID, user, "DELETE", pruned)
+}
+
+// updateDeliveries adds deliveries to or deletes them from the ledger of an account,
+// depending on action
+func (dr *dynamoDBRepo) updateDeliveries(ctx context.Context, chatID, user, action string, deliveries []repo.Delivery) error {
+	set := make([]*string, 0, len(deliveries))
+	for _, d := range deliveries {
+		set = append(set, aws.String(formatDelivery(d)))
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#user": aws.String(user),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":deliveries": {SS: set},
+		},
+		Key:                 chatKey(chatID),
+		TableName:           aws.String(dr.table),
+		ConditionExpression: aws.String("attribute_exists(accounts.#user)"),
+		UpdateExpression:    aws.String(action + " accounts.#user.delivered :deliveries"),
+	}
+
+	_, err := dr.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return repo.ErrAccountNotFound
+	}
+
+	if err != nil {
+		return fmt.Errorf("update of deliveries failed: %w", err)
+	}
+
+	return nil
+}
+
+func (dr *dynamoDBRepo) GetSession(ctx context.Context, user string) (repo.Session, error) {
+	input := &dynamodb.GetItemInput{
+		Key:            sessionKey(user),
+		TableName:      aws.String(dr.sessionsTable),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	out, err := dr.db.GetItemWithContext(ctx, input)
+	if err != nil {
+		return repo.Session{}, fmt.Errorf("unable to fetch session from DB: %w", err)
+	}
+
+	if len(out.Item) == 0 {
+		return repo.Session{}, repo.ErrSessionNotFound
+	}
+
+	si := sessionItem{}
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &si); err != nil {
+		return repo.Session{}, fmt.Errorf("failed to unmarshal record: %w", err)
+	}
+
+	return repo.Session{User: si.User, PassHash: si.PassHash, Cookies: si.Cookies}, nil
+}
+
+func (dr *dynamoDBRepo) SaveSession(ctx context.Context, s repo.Session) error {
+	item, err := dynamodbattribute.MarshalMap(sessionItem{User: s.User, PassHash: s.PassHash, Cookies: s.Cookies})
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(dr.sessionsTable),
+	}
+
+	if _, err := dr.db.PutItemWithContext(ctx, input); err != nil {
+		return fmt.Errorf("save session failed: %w", err)
+	}
+
+	return nil
+}
+
+func (dr *dynamoDBRepo) DeleteSession(ctx context.Context, user string) error {
+	input := &dynamodb.DeleteItemInput{
+		Key:       sessionKey(user),
+		TableName: aws.String(dr.sessionsTable),
+	}
+
+	if _, err := dr.db.DeleteItemWithContext(ctx, input); err != nil {
+		return fmt.Errorf("delete session failed: %w", err)
+	}
+
+	return nil
+}
+
+// formatDelivery formats d as message/attachment, followed by /part for the parts of a text
+func formatDelivery(d repo.Delivery) string {
+	if d.Part != 0 {
+		return fmt.Sprintf("%d/%d/%d", d.MessageID, d.AttachmentID, d.Part)
+	}
+
+	return fmt.Sprintf("%d/%d", d.MessageID, d.AttachmentID)
+}
+
+func parseDelivery(s string) (repo.Delivery, error) {
+	d := repo.Delivery{}
+	if strings.Count(s, "/") == 2 {
+		if _, err := fmt.Sscanf(s, "%d/%d/%d", &d.MessageID, &d.AttachmentID, &d.Part); err != nil {
+			return repo.Delivery{}, fmt.Errorf("bad delivery %q: %w", s, err)
+		}
+
+		return d, nil
+	}
+
+	if _, err := fmt.Sscanf(s, "%d/%d", &d.MessageID, &d.AttachmentID); err != nil {
+		return repo.Delivery{}, fmt.Errorf("bad delivery %q: %w", s, err)
+	}
+
+	return d, nil
+}
+
+func chatKey(chatID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id": {
+			S: aws.String(chatID),
+		},
+	}
+}
+
+func sessionKey(user string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"user": {
+			S: aws.String(user),
+		},
+	}
+}
+
+func (dr *dynamoDBRepo) putChatInput(chat repo.Chat) (*dynamodb.PutItemInput, error) {
+	ci := chatItem{
+		ID:             chat.ID,
+		Accounts:       make(map[string]accountItem, len(chat.Accounts)),
+		MarkRead:       chat.MarkRead,
+		OnlyUnread:     chat.OnlyUnread,
+		DisabledReason: chat.DisabledReason,
+	}
+	if chat.Disabled() {
+		ci.DisabledAt = chat.DisabledAt.Unix()
+	}
+
+	for _, a := range chat.Accounts {
+		ci.Accounts[a.Credentials.User] = fromAccount(a)
+	}
+
+	item, err := dynamodbattribute.MarshalMap(ci)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	return &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(dr.table),
+	}, nil
+}
+
+func fromAccount(a repo.Account) accountItem {
+	return accountItem{
+		Label: a.Label,
+		Credentials: credentialsItem{
+			User: a.Credentials.User,
+			Pass: a.Credentials.Pass,
+		},
+		LastNotifiedMessage: a.LastNotifiedMessage,
+		LoginFailures:       a.LoginFailures,
+	}
+}
+
+func (ci chatItem) isLegacy() bool {
+	return ci.Accounts == nil && ci.Credentials != nil
+}
+
+func (ci chatItem) toChat() repo.Chat {
+	chat := repo.Chat{
+		ID:             ci.ID,
+		Accounts:       make([]repo.Account, 0, len(ci.Accounts)),
+		MarkRead:       ci.MarkRead,
+		OnlyUnread:     ci.OnlyUnread,
+		DisabledReason: ci.DisabledReason,
+	}
+	if ci.DisabledAt != 0 {
+		chat.DisabledAt = time.Unix(ci.DisabledAt, 0).UTC()
+	}
+
+	if ci.isLegacy() {
+		chat.Accounts = append(chat.Accounts, repo.Account{
+			Credentials: repo.Credentials{
+				User: ci.Credentials.User,
+				Pass: ci.Credentials.Pass,
+			},
+			LastNotifiedMessage: ci.LastNotifiedMessage,
+		})
+
+		return chat
+	}
+
+	for _, a := range ci.Accounts {
+		chat.Accounts = append(chat.Accounts, repo.Account{
+			Label: a.Label,
+			Credentials: repo.Credentials{
+				User: a.Credentials.User,
+				Pass: a.Credentials.Pass,
+			},
+			LastNotifiedMessage: a.LastNotifiedMessage,
+			LoginFailures:       a.LoginFailures,
+		})
+	}
+
+	// Map iteration order is random, sort accounts to keep it stable
+	sort.Slice(chat.Accounts, func(i, j int) bool {
+		return chat.Accounts[i].Credentials.User < chat.Accounts[j].Credentials.User
+	})
+
+	return chat
+}
+
+func isConditionalCheckFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
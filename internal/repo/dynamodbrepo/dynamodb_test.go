@@ -1,14 +1,22 @@
 package dynamodbrepo
 
 import (
+	"context"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/volmedo/almendruco.git/internal/repo"
 )
@@ -16,60 +24,166 @@ import (
 var (
 	chat1 = repo.Chat{
 		ID: "chat1",
-		Credentials: repo.Credentials{
-			User: "user1",
-			Pass: "pass1",
+		Accounts: []repo.Account{
+			{
+				Label: "Child 1",
+				Credentials: repo.Credentials{
+					User: "user1",
+					Pass: "pass1",
+				},
+				LastNotifiedMessage: 1,
+			},
+			{
+				Label: "Child 2",
+				Credentials: repo.Credentials{
+					User: "user3",
+					Pass: "pass3",
+				},
+				LastNotifiedMessage: 3,
+			},
 		},
-		LastNotifiedMessage: 1,
 	}
 
 	chat2 = repo.Chat{
 		ID: "chat2",
-		Credentials: repo.Credentials{
-			User: "user2",
-			Pass: "pass2",
+		Accounts: []repo.Account{
+			{
+				Credentials: repo.Credentials{
+					User: "user2",
+					Pass: "pass2",
+				},
+				LastNotifiedMessage: 2,
+			},
 		},
-		LastNotifiedMessage: 2,
+	}
+
+	// legacyChat2 is chat2 stored with the single-account layout
+	legacyChat2 = struct {
+		ID                  string
+		Credentials         repo.Credentials
+		LastNotifiedMessage uint64
+	}{
+		ID:                  chat2.ID,
+		Credentials:         chat2.Accounts[0].Credentials,
+		LastNotifiedMessage: chat2.Accounts[0].LastNotifiedMessage,
 	}
 )
 
+func chatToItem(chat repo.Chat) map[string]*dynamodb.AttributeValue {
+	input, _ := (&dynamoDBRepo{table: tableName}).putChatInput(chat)
+	return input.Item
+}
+
 type dynamoDBClientMock struct {
 	dynamodbiface.DynamoDBAPI
+	sync.Mutex
+	puts    []*dynamodb.PutItemInput
+	updates []*dynamodb.UpdateItemInput
+	scans   int
 }
 
-func (m *dynamoDBClientMock) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
-	item1, _ := dynamodbattribute.MarshalMap(chat1)
-	item2, _ := dynamodbattribute.MarshalMap(chat2)
+// ScanWithContext returns the items of the table one per page. When the scan is split in
+// segments, items are assigned to segments in a round robin fashion.
+func (m *dynamoDBClientMock) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	item2, _ := dynamodbattribute.MarshalMap(legacyChat2)
+	table := []map[string]*dynamodb.AttributeValue{chatToItem(chat1), item2}
+
+	items := table
+	if input.TotalSegments != nil {
+		items = nil
+		for i := range table {
+			if int64(i)%*input.TotalSegments == *input.Segment {
+				items = append(items, table[i])
+			}
+		}
+	}
+
+	// Instead of the key of the last item, the position of the next one is used as LastEvaluatedKey
+	start := 0
+	if input.ExclusiveStartKey != nil {
+		start, _ = strconv.Atoi(*input.ExclusiveStartKey["next"].N)
+	}
+
+	m.Lock()
+	m.scans++
+	m.Unlock()
 
-	items := []map[string]*dynamodb.AttributeValue{item1, item2}
-	count := int64(len(items))
+	if start >= len(items) {
+		return &dynamodb.ScanOutput{Count: aws.Int64(0)}, nil
+	}
 
 	return &dynamodb.ScanOutput{
-		Count: &count,
-		Items: items,
+		Count:            aws.Int64(1),
+		Items:            items[start : start+1],
+		LastEvaluatedKey: map[string]*dynamodb.AttributeValue{"next": {N: aws.String(strconv.Itoa(start + 1))}},
 	}, nil
 }
 
-func (m *dynamoDBClientMock) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+func (m *dynamoDBClientMock) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if _, ok := input.ExpressionAttributeValues[":deliveries"]; ok {
+		m.Lock()
+		defer m.Unlock()
+
+		m.updates = append(m.updates, input)
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+
+	if *input.ConditionExpression == "attribute_exists(id)" {
+		if *input.Key["id"].S != chat1.ID {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil)
+		}
+
+		m.Lock()
+		defer m.Unlock()
+
+		m.updates = append(m.updates, input)
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+
+	// Conditions on the existence of accounts are evaluated against chat1, the only chat in the table
+	switch cond := *input.ConditionExpression; cond {
+	case "attribute_exists(accounts.#user)", "attribute_exists(accounts) AND attribute_not_exists(accounts.#user)":
+		_, exists := chat1.Account(*input.ExpressionAttributeNames["#user"])
+		if strings.Contains(cond, "attribute_not_exists") {
+			exists = !exists
+		}
+		if *input.Key["id"].S != chat1.ID || !exists {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil)
+		}
+
+		m.Lock()
+		defer m.Unlock()
+
+		m.updates = append(m.updates, input)
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+
 	lastStr := input.ExpressionAttributeValues[":last"].N
 	last, err := strconv.ParseUint(*lastStr, 10, 64)
 	if err != nil {
 		return nil, fmt.Errorf("bad lastNotifiedMessage value: %s", *lastStr)
 	}
 
-	expectedLast := uint64(11)
-	if last != expectedLast {
-		return nil, fmt.Errorf("expected last to be %d, but got %d", expectedLast, last)
+	condExp := input.ConditionExpression
+	expectedCond := "attribute_exists(accounts.#user) AND accounts.#user.lastNotifiedMessage < :last"
+	if *condExp != expectedCond {
+		return nil, fmt.Errorf("expected condition exp to be \"%s\" but got \"%s\"", expectedCond, *condExp)
 	}
 
+	// Evaluate the condition against chat1, the only chat in the table
 	key := input.Key["id"].S
-	expectedKey := "some_chat"
-	if *key != expectedKey {
-		return nil, fmt.Errorf("expected key to be %s but got %s", expectedKey, *key)
+	user := input.ExpressionAttributeNames["#user"]
+	if *key != chat1.ID {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil)
+	}
+
+	account, ok := chat1.Account(*user)
+	if !ok || account.LastNotifiedMessage >= last {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", nil)
 	}
 
 	updateExp := input.UpdateExpression
-	expectedExp := "SET lastNotifiedMessage = :last"
+	expectedExp := "SET accounts.#user.lastNotifiedMessage = :last"
 	if *updateExp != expectedExp {
 		return nil, fmt.Errorf("expected update exp to be \"%s\" but got \"%s\"", expectedExp, *updateExp)
 	}
@@ -77,11 +191,40 @@ func (m *dynamoDBClientMock) UpdateItem(input *dynamodb.UpdateItemInput) (*dynam
 	return &dynamodb.UpdateItemOutput{}, nil
 }
 
+func (m *dynamoDBClientMock) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	key := input.Key["id"].S
+	if *key != chat1.ID {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+
+	item := chatToItem(chat1)
+	item["accounts"].M["user1"].M["delivered"] = &dynamodb.AttributeValue{SS: aws.StringSlice([]string{"1/0", "1/7", "2/0", "3/0/2"})}
+
+	return &dynamodb.GetItemOutput{Item: item}, nil
+}
+
+func (m *dynamoDBClientMock) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.puts = append(m.puts, input)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (m *dynamoDBClientMock) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	key := input.Key["id"].S
+	if *key != chat1.ID {
+		return &dynamodb.DeleteItemOutput{}, nil
+	}
+
+	return &dynamodb.DeleteItemOutput{Attributes: chatToItem(chat1)}, nil
+}
+
 func TestGetChats(t *testing.T) {
 	mockClient := &dynamoDBClientMock{}
-	dynamoRepo := NewRepoWithClient(mockClient)
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
 
-	chats, err := dynamoRepo.GetChats()
+	chats, err := dynamoRepo.GetChats(context.Background())
 
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(chats))
@@ -89,11 +232,282 @@ func TestGetChats(t *testing.T) {
 	assert.Equal(t, chat2, chats[1])
 }
 
+func TestGetChatsFollowsPagination(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	chats, err := dynamoRepo.GetChats(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, []repo.Chat{chat1, chat2}, chats)
+	assert.Equal(t, 3, mockClient.scans)
+}
+
+func TestGetChatsParallelSegments(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 3)
+
+	chats, err := dynamoRepo.GetChats(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, []repo.Chat{chat1, chat2}, chats)
+	assert.Equal(t, 5, mockClient.scans)
+}
+
+func TestGetChatsUpgradesLegacyChats(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	_, err := dynamoRepo.GetChats(context.Background())
+	require.NoError(t, err)
+
+	require.Len(t, mockClient.puts, 1)
+	put := mockClient.puts[0]
+	assert.Equal(t, "attribute_not_exists(accounts)", *put.ConditionExpression)
+
+	ci := chatItem{}
+	require.NoError(t, dynamodbattribute.UnmarshalMap(put.Item, &ci))
+	assert.False(t, ci.isLegacy())
+	assert.Equal(t, chat2, ci.toChat())
+}
+
 func TestUpdateLastNotifiedMessage(t *testing.T) {
 	mockClient := &dynamoDBClientMock{}
-	dynamoRepo := NewRepoWithClient(mockClient)
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	err := dynamoRepo.UpdateLastNotifiedMessage(context.Background(), "chat1", "user1", 11)
+
+	assert.NoError(t, err)
+}
+
+func TestUpdateLastNotifiedMessageIgnoresOlderMessages(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	err := dynamoRepo.UpdateLastNotifiedMessage(context.Background(), "chat1", "user3", 2)
+
+	assert.NoError(t, err)
+}
+
+func TestUpdateLastNotifiedMessageUnknownAccount(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	err := dynamoRepo.UpdateLastNotifiedMessage(context.Background(), "chat1", "other_user", 11)
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+
+	err = dynamoRepo.UpdateLastNotifiedMessage(context.Background(), "other_chat", "user1", 11)
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+}
+
+func TestGetChat(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
 
-	err := dynamoRepo.UpdateLastNotifiedMessage("some_chat", 11)
+	chat, err := dynamoRepo.GetChat(context.Background(), "chat1")
 
 	assert.NoError(t, err)
+	assert.Equal(t, chat1, chat)
+}
+
+func TestGetChatNotFound(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	_, err := dynamoRepo.GetChat(context.Background(), "unknown")
+
+	assert.ErrorIs(t, err, repo.ErrChatNotFound)
+}
+
+func TestSaveChat(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	err := dynamoRepo.SaveChat(context.Background(), chat1)
+	require.NoError(t, err)
+
+	require.Len(t, mockClient.puts, 1)
+	item := mockClient.puts[0].Item
+	assert.Equal(t, "chat1", *item["id"].S)
+
+	account := item["accounts"].M["user3"].M
+	assert.Equal(t, "Child 2", *account["label"].S)
+	assert.Equal(t, "pass3", *account["credentials"].M["pass"].S)
+	assert.Equal(t, "3", *account["lastNotifiedMessage"].N)
+}
+
+func TestDeleteChat(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	assert.NoError(t, dynamoRepo.DeleteChat(context.Background(), "chat1"))
+	assert.ErrorIs(t, dynamoRepo.DeleteChat(context.Background(), "unknown"), repo.ErrChatNotFound)
+}
+
+func TestSaveAccount(t *testing.T) {
+	tests := map[string]struct {
+		chatID  string
+		account repo.Account
+		updates []string
+		put     bool
+	}{
+		"existing account": {
+			chatID:  "chat1",
+			account: repo.Account{Label: "Child 1", Credentials: repo.Credentials{User: "user1", Pass: "new"}},
+			updates: []string{"SET accounts.#user.credentials = :creds, accounts.#user.loginFailures = :failures, accounts.#user.label = :label"},
+		},
+		"existing account without label": {
+			chatID:  "chat1",
+			account: repo.Account{Credentials: repo.Credentials{User: "user1", Pass: "new"}},
+			updates: []string{"SET accounts.#user.credentials = :creds, accounts.#user.loginFailures = :failures REMOVE accounts.#user.label"},
+		},
+		"new account": {
+			chatID:  "chat1",
+			account: repo.Account{Credentials: repo.Credentials{User: "user4", Pass: "pass4"}},
+			updates: []string{"SET accounts.#user = :account"},
+		},
+		"new chat": {
+			chatID:  "chat4",
+			account: repo.Account{Credentials: repo.Credentials{User: "user4", Pass: "pass4"}},
+			put:     true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mockClient := &dynamoDBClientMock{}
+			dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+			require.NoError(t, dynamoRepo.SaveAccount(context.Background(), tc.chatID, tc.account))
+
+			updates := []string{}
+			for _, u := range mockClient.updates {
+				updates = append(updates, *u.UpdateExpression)
+			}
+			if tc.updates == nil {
+				tc.updates = []string{}
+			}
+			assert.Equal(t, tc.updates, updates)
+
+			if !tc.put {
+				assert.Empty(t, mockClient.puts)
+				return
+			}
+
+			require.Len(t, mockClient.puts, 1)
+			put := mockClient.puts[0]
+			assert.Equal(t, "attribute_not_exists(accounts)", *put.ConditionExpression)
+			assert.Equal(t, tc.chatID, *put.Item["id"].S)
+			assert.Equal(t, "pass4", *put.Item["accounts"].M["user4"].M["credentials"].M["pass"].S)
+		})
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	require.NoError(t, dynamoRepo.DeleteAccount(context.Background(), "chat1", "user3"))
+	require.Len(t, mockClient.updates, 1)
+	assert.Equal(t, "REMOVE accounts.#user", *mockClient.updates[0].UpdateExpression)
+
+	assert.ErrorIs(t, dynamoRepo.DeleteAccount(context.Background(), "chat1", "user2"), repo.ErrAccountNotFound)
+	assert.ErrorIs(t, dynamoRepo.DeleteAccount(context.Background(), "unknown", "user1"), repo.ErrAccountNotFound)
+}
+
+func TestSetLastNotifiedMessage(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	// Unlike UpdateLastNotifiedMessage, the cursor can be set to any value
+	require.NoError(t, dynamoRepo.SetLastNotifiedMessage(context.Background(), "chat1", "user1", 0))
+	require.Len(t, mockClient.updates, 1)
+	assert.Equal(t, "SET accounts.#user.lastNotifiedMessage = :last", *mockClient.updates[0].UpdateExpression)
+	assert.Equal(t, "0", *mockClient.updates[0].ExpressionAttributeValues[":last"].N)
+
+	assert.ErrorIs(t, dynamoRepo.SetLastNotifiedMessage(context.Background(), "chat1", "user2", 0), repo.ErrAccountNotFound)
+	assert.ErrorIs(t, dynamoRepo.SetLastNotifiedMessage(context.Background(), "unknown", "user1", 0), repo.ErrAccountNotFound)
+}
+
+func TestSetChatOptions(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	require.NoError(t, dynamoRepo.SetMarkRead(context.Background(), "chat1", true))
+	require.NoError(t, dynamoRepo.SetOnlyUnread(context.Background(), "chat1", false))
+
+	require.Len(t, mockClient.updates, 2)
+	assert.Equal(t, "SET #option = :on", *mockClient.updates[0].UpdateExpression)
+	assert.Equal(t, "markRead", *mockClient.updates[0].ExpressionAttributeNames["#option"])
+	assert.Equal(t, "REMOVE #option", *mockClient.updates[1].UpdateExpression)
+	assert.Equal(t, "onlyUnread", *mockClient.updates[1].ExpressionAttributeNames["#option"])
+
+	assert.ErrorIs(t, dynamoRepo.SetMarkRead(context.Background(), "unknown", true), repo.ErrChatNotFound)
+}
+
+func TestGetDeliveries(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	deliveries, err := dynamoRepo.GetDeliveries(context.Background(), "chat1", "user1")
+	require.NoError(t, err)
+	assert.Equal(t, []repo.Delivery{{MessageID: 1}, {MessageID: 1, AttachmentID: 7}, {MessageID: 2}, {MessageID: 3, Part: 2}}, deliveries)
+
+	deliveries, err = dynamoRepo.GetDeliveries(context.Background(), "chat1", "user3")
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+
+	_, err = dynamoRepo.GetDeliveries(context.Background(), "unknown", "user1")
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+}
+
+func TestRecordAndPruneDeliveries(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	require.NoError(t, dynamoRepo.RecordDelivery(context.Background(), "chat1", "user1", repo.Delivery{MessageID: 3, AttachmentID: 9}))
+	require.NoError(t, dynamoRepo.RecordDelivery(context.Background(), "chat1", "user1", repo.Delivery{MessageID: 4, Part: 2}))
+	require.NoError(t, dynamoRepo.PruneDeliveries(context.Background(), "chat1", "user1", 1))
+
+	require.Len(t, mockClient.updates, 3)
+
+	record := mockClient.updates[0]
+	assert.Equal(t, "ADD accounts.#user.delivered :deliveries", *record.UpdateExpression)
+	assert.Equal(t, []string{"3/9"}, aws.StringValueSlice(record.ExpressionAttributeValues[":deliveries"].SS))
+	assert.Equal(t, []string{"4/0/2"}, aws.StringValueSlice(mockClient.updates[1].ExpressionAttributeValues[":deliveries"].SS))
+
+	prune := mockClient.updates[2]
+	assert.Equal(t, "DELETE accounts.#user.delivered :deliveries", *prune.UpdateExpression)
+	assert.Equal(t, []string{"1/0", "1/7"}, aws.StringValueSlice(prune.ExpressionAttributeValues[":deliveries"].SS))
+}
+
+func TestDisableAndEnableChat(t *testing.T) {
+	mockClient := &dynamoDBClientMock{}
+	dynamoRepo := NewRepoWithClient(mockClient, 1)
+
+	at := time.Date(2021, time.November, 11, 10, 30, 0, 0, time.UTC)
+	require.NoError(t, dynamoRepo.DisableChat(context.Background(), "chat1", "bot blocked by the user", at))
+	require.NoError(t, dynamoRepo.EnableChat(context.Background(), "chat1"))
+
+	require.Len(t, mockClient.updates, 2)
+
+	disable := mockClient.updates[0]
+	assert.Equal(t, "SET disabledAt = :at, disabledReason = :reason", *disable.UpdateExpression)
+	assert.Equal(t, strconv.FormatInt(at.Unix(), 10), *disable.ExpressionAttributeValues[":at"].N)
+	assert.Equal(t, "bot blocked by the user", *disable.ExpressionAttributeValues[":reason"].S)
+
+	assert.Equal(t, "REMOVE disabledAt, disabledReason", *mockClient.updates[1].UpdateExpression)
+
+	err := dynamoRepo.DisableChat(context.Background(), "unknown", "chat not found", at)
+	assert.ErrorIs(t, err, repo.ErrChatNotFound)
+}
+
+func TestDisabledChatRoundTrip(t *testing.T) {
+	chat := chat1
+	chat.DisabledAt = time.Date(2021, time.November, 11, 10, 30, 0, 0, time.UTC)
+	chat.DisabledReason = "chat not found"
+
+	ci := chatItem{}
+	require.NoError(t, dynamodbattribute.UnmarshalMap(chatToItem(chat), &ci))
+	assert.Equal(t, chat, ci.toChat())
 }
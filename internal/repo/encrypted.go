@@ -0,0 +1,190 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotEncrypted is returned by a CredentialCipher when asked to decrypt a value it did not encrypt
+var ErrNotEncrypted = errors.New("value is not encrypted")
+
+// CredentialCipher encrypts and decrypts secrets before they are stored in a repository
+type CredentialCipher interface {
+	Encrypt(ctx context.Context, plaintext string) (string, error)
+	Decrypt(ctx context.Context, ciphertext string) (string, error)
+}
+
+type encryptedRepo struct {
+	Repo
+	cipher CredentialCipher
+}
+
+// NewEncryptedRepo wraps r so that passwords and session cookies are encrypted with c before
+// being stored and decrypted after being read. Passwords stored in plain text before encryption was enabled
+// are returned as they are, so they keep working until they are migrated. The returned repository
+// implements io.Closer, closing r if it implements it too.
+func NewEncryptedRepo(r Repo, c CredentialCipher) Repo {
+	return &encryptedRepo{Repo: r, cipher: c}
+}
+
+func (er *encryptedRepo) Close() error {
+	if c, ok := er.Repo.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func (er *encryptedRepo) GetChats(ctx context.Context) ([]Chat, error) {
+	chats, err := er.Repo.GetChats(ctx)
+	if err != nil {
+		return []Chat{}, err
+	}
+
+	for i := range chats {
+		if err := er.decrypt(ctx, &chats[i]); err != nil {
+			return []Chat{}, err
+		}
+	}
+
+	return chats, nil
+}
+
+func (er *encryptedRepo) GetChat(ctx context.Context, chatID string) (Chat, error) {
+	chat, err := er.Repo.GetChat(ctx, chatID)
+	if err != nil {
+		return Chat{}, err
+	}
+
+	if err := er.decrypt(ctx, &chat); err != nil {
+		return Chat{}, err
+	}
+
+	return chat, nil
+}
+
+func (er *encryptedRepo) SaveChat(ctx context.Context, chat Chat) error {
+	accounts := make([]Account, len(chat.Accounts))
+	for i, a := range chat.Accounts {
+		encrypted, err := er.cipher.Encrypt(ctx, a.Credentials.Pass)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt credentials for chat %s: %w", chat.ID, err)
+		}
+
+		a.Credentials.Pass = encrypted
+		accounts[i] = a
+	}
+
+	chat.Accounts = accounts
+
+	return er.Repo.SaveChat(ctx, chat)
+}
+
+func (er *encryptedRepo) SaveAccount(ctx context.Context, chatID string, a Account) error {
+	encrypted, err := er.cipher.Encrypt(ctx, a.Credentials.Pass)
+	if err != nil {
+		return fmt.Errorf("unable to encrypt credentials for chat %s: %w", chatID, err)
+	}
+	a.Credentials.Pass = encrypted
+
+	return er.Repo.SaveAccount(ctx, chatID, a)
+}
+
+func (er *encryptedRepo) GetSession(ctx context.Context, user string) (Session, error) {
+	s, err := er.Repo.GetSession(ctx, user)
+	if err != nil {
+		return Session{}, err
+	}
+
+	cookies := make(map[string]string, len(s.Cookies))
+	for name, value := range s.Cookies {
+		decrypted, err := er.cipher.Decrypt(ctx, value)
+		if errors.Is(err, ErrNotEncrypted) {
+			// Sessions saved before encryption was enabled are simply discarded
+			return Session{}, ErrSessionNotFound
+		}
+		if err != nil {
+			return Session{}, fmt.Errorf("unable to decrypt session of user %s: %w", user, err)
+		}
+
+		cookies[name] = decrypted
+	}
+	s.Cookies = cookies
+
+	return s, nil
+}
+
+func (er *encryptedRepo) SaveSession(ctx context.Context, s Session) error {
+	cookies := make(map[string]string, len(s.Cookies))
+	for name, value := range s.Cookies {
+		encrypted, err := er.cipher.Encrypt(ctx, value)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt session of user %s: %w", s.User, err)
+		}
+
+		cookies[name] = encrypted
+	}
+	s.Cookies = cookies
+
+	return er.Repo.SaveSession(ctx, s)
+}
+
+func (er *encryptedRepo) decrypt(ctx context.Context, chat *Chat) error {
+	accounts := make([]Account, len(chat.Accounts))
+	for i, a := range chat.Accounts {
+		decrypted, err := er.cipher.Decrypt(ctx, a.Credentials.Pass)
+		if err != nil && !errors.Is(err, ErrNotEncrypted) {
+			return fmt.Errorf("unable to decrypt credentials for chat %s: %w", chat.ID, err)
+		}
+
+		if err == nil {
+			a.Credentials.Pass = decrypted
+		}
+
+		accounts[i] = a
+	}
+
+	chat.Accounts = accounts
+
+	return nil
+}
+
+// EncryptPlaintextCredentials encrypts with c every password in r that is still stored in
+// plain text and returns the number of chats that were updated. r must be the repository
+// where data is stored, not one returned by NewEncryptedRepo. Accounts are saved one by one,
+// so that their cursors and delivery ledgers are kept and it can run alongside a run.
+func EncryptPlaintextCredentials(ctx context.Context, r Repo, c CredentialCipher) (int, error) {
+	chats, err := r.GetChats(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	er := &encryptedRepo{Repo: r, cipher: c}
+	migrated := 0
+	for _, chat := range chats {
+		updated := false
+		for _, a := range chat.Accounts {
+			if !isPlaintext(ctx, a.Credentials.Pass, c) {
+				continue
+			}
+
+			if err := er.SaveAccount(ctx, chat.ID, a); err != nil {
+				return migrated, err
+			}
+			updated = true
+		}
+
+		if updated {
+			migrated++
+		}
+	}
+
+	return migrated, nil
+}
+
+func isPlaintext(ctx context.Context, pass string, c CredentialCipher) bool {
+	_, err := c.Decrypt(ctx, pass)
+	return errors.Is(err, ErrNotEncrypted)
+}
@@ -0,0 +1,190 @@
+package repo
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reverseCipher "encrypts" values by reversing them and adding a prefix
+type reverseCipher struct{}
+
+func (reverseCipher) Encrypt(ctx context.Context, plaintext string) (string, error) {
+	return "enc:" + reverseString(plaintext), nil
+}
+
+func (reverseCipher) Decrypt(ctx context.Context, ciphertext string) (string, error) {
+	if !strings.HasPrefix(ciphertext, "enc:") {
+		return "", ErrNotEncrypted
+	}
+
+	return reverseString(strings.TrimPrefix(ciphertext, "enc:")), nil
+}
+
+func reverseString(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+
+	return string(r)
+}
+
+type memRepo struct {
+	Repo
+	chats map[string]Chat
+}
+
+func (mr *memRepo) GetChats(ctx context.Context) ([]Chat, error) {
+	chats := []Chat{}
+	for _, c := range mr.chats {
+		chats = append(chats, c)
+	}
+
+	return chats, nil
+}
+
+func (mr *memRepo) GetChat(ctx context.Context, chatID string) (Chat, error) {
+	c, ok := mr.chats[chatID]
+	if !ok {
+		return Chat{}, ErrChatNotFound
+	}
+
+	return c, nil
+}
+
+func (mr *memRepo) SaveChat(ctx context.Context, chat Chat) error {
+	mr.chats[chat.ID] = chat
+	return nil
+}
+
+func (mr *memRepo) SaveAccount(ctx context.Context, chatID string, a Account) error {
+	chat := mr.chats[chatID]
+	chat.ID = chatID
+	chat.SetAccount(a)
+	mr.chats[chatID] = chat
+	return nil
+}
+
+func TestEncryptedRepo(t *testing.T) {
+	mr := &memRepo{chats: map[string]Chat{}}
+	er := NewEncryptedRepo(mr, reverseCipher{})
+
+	chat := Chat{ID: "chat1", Accounts: []Account{{Credentials: Credentials{User: "user1", Pass: "pass1"}}}}
+	require.NoError(t, er.SaveChat(context.Background(), chat))
+
+	assert.Equal(t, "enc:1ssap", mr.chats["chat1"].Accounts[0].Credentials.Pass)
+	assert.Equal(t, "pass1", chat.Accounts[0].Credentials.Pass, "Expected saved chat to be left untouched")
+
+	got, err := er.GetChat(context.Background(), "chat1")
+	require.NoError(t, err)
+	assert.Equal(t, chat, got)
+}
+
+func TestEncryptedRepoSaveAccount(t *testing.T) {
+	mr := &memRepo{chats: map[string]Chat{}}
+	er := NewEncryptedRepo(mr, reverseCipher{})
+
+	a := Account{Credentials: Credentials{User: "user1", Pass: "pass1"}}
+	require.NoError(t, er.SaveAccount(context.Background(), "chat1", a))
+	assert.Equal(t, "enc:1ssap", mr.chats["chat1"].Accounts[0].Credentials.Pass)
+
+	got, err := er.GetChat(context.Background(), "chat1")
+	require.NoError(t, err)
+	assert.Equal(t, []Account{a}, got.Accounts)
+}
+
+func TestEncryptedRepoReadsPlaintext(t *testing.T) {
+	chat := Chat{ID: "chat1", Accounts: []Account{{Credentials: Credentials{User: "user1", Pass: "pass1"}}}}
+	mr := &memRepo{chats: map[string]Chat{"chat1": chat}}
+	er := NewEncryptedRepo(mr, reverseCipher{})
+
+	chats, err := er.GetChats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []Chat{chat}, chats)
+}
+
+func TestEncryptPlaintextCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	// Only the accounts in plain text are saved, the chats are not rewritten
+	mr := &MockRepo{}
+	mr.On("GetChats", ctx).Return([]Chat{
+		{ID: "chat1", Accounts: []Account{
+			{Credentials: Credentials{User: "user1", Pass: "pass1"}, LastNotifiedMessage: 7},
+			{Credentials: Credentials{User: "user3", Pass: "enc:3ssap"}},
+		}},
+		{ID: "chat2", Accounts: []Account{
+			{Credentials: Credentials{User: "user2", Pass: "enc:2ssap"}},
+		}},
+	}, nil)
+	mr.On("SaveAccount", ctx, "chat1", Account{Credentials: Credentials{User: "user1", Pass: "enc:1ssap"}, LastNotifiedMessage: 7}).Return(nil)
+
+	migrated, err := EncryptPlaintextCredentials(ctx, mr, reverseCipher{})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, migrated)
+	mr.AssertExpectations(t)
+}
+
+func TestEncryptedRepoPassesThroughCursorUpdates(t *testing.T) {
+	ctx := context.Background()
+
+	mr := &MockRepo{}
+	mr.On("UpdateLastNotifiedMessage", ctx, "chat1", "user1", uint64(42)).Return(nil)
+	mr.On("DeleteChat", ctx, "chat2").Return(ErrChatNotFound)
+
+	er := NewEncryptedRepo(mr, reverseCipher{})
+
+	assert.NoError(t, er.UpdateLastNotifiedMessage(ctx, "chat1", "user1", 42))
+	assert.ErrorIs(t, er.DeleteChat(ctx, "chat2"), ErrChatNotFound)
+	mr.AssertExpectations(t)
+}
+
+func TestEncryptedRepoSessions(t *testing.T) {
+	ctx := context.Background()
+
+	mr := &MockRepo{}
+	mr.On("SaveSession", ctx, Session{User: "user1", Cookies: map[string]string{"JSESSIONID": "enc:dcba"}}).Return(nil)
+	mr.On("GetSession", ctx, "user1").Return(Session{User: "user1", Cookies: map[string]string{"JSESSIONID": "enc:dcba"}}, nil)
+	mr.On("GetSession", ctx, "user2").Return(Session{User: "user2", Cookies: map[string]string{"JSESSIONID": "efgh"}}, nil)
+
+	er := NewEncryptedRepo(mr, reverseCipher{})
+
+	s := Session{User: "user1", Cookies: map[string]string{"JSESSIONID": "abcd"}}
+	require.NoError(t, er.SaveSession(ctx, s))
+
+	got, err := er.GetSession(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, s, got)
+
+	// Sessions saved in plain text are discarded
+	_, err = er.GetSession(ctx, "user2")
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+	mr.AssertExpectations(t)
+}
+
+type closingRepo struct {
+	Repo
+	closed bool
+}
+
+func (cr *closingRepo) Close() error {
+	cr.closed = true
+	return nil
+}
+
+func TestEncryptedRepoClose(t *testing.T) {
+	cr := &closingRepo{}
+	er := NewEncryptedRepo(cr, reverseCipher{})
+
+	require.NoError(t, er.(io.Closer).Close())
+	assert.True(t, cr.closed)
+
+	// Repositories with nothing to close are fine too
+	require.NoError(t, NewEncryptedRepo(&memRepo{}, reverseCipher{}).(io.Closer).Close())
+}
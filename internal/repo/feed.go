@@ -0,0 +1,71 @@
+package repo
+
+// Feed is a Raíces account together with the chats subscribed to it. It separates the
+// account, whose messages need to be fetched only once, from the destinations those
+// messages are delivered to, each one with its own cursor.
+type Feed struct {
+	Credentials   Credentials
+	Subscriptions []Subscription
+}
+
+// Subscription is the delivery of the messages of a Feed to a chat, with the options of the chat
+type Subscription struct {
+	ChatID              string
+	Label               string
+	LastNotifiedMessage uint64
+	LoginFailures       int
+	MarkRead            bool
+	OnlyUnread          bool
+}
+
+// Feeds groups the accounts of chats into feeds. Accounts are grouped by their full
+// credentials and not only by user, so that a chat holding an outdated password does
+// not prevent the chats with the right one from receiving messages.
+// Feeds and subscriptions keep the order in which they appear in chats.
+func Feeds(chats []Chat) []Feed {
+	feeds := []Feed{}
+	index := map[Credentials]int{}
+	for _, c := range chats {
+		for _, a := range c.Accounts {
+			i, ok := index[a.Credentials]
+			if !ok {
+				i = len(feeds)
+				index[a.Credentials] = i
+				feeds = append(feeds, Feed{Credentials: a.Credentials})
+			}
+
+			feeds[i].Subscriptions = append(feeds[i].Subscriptions, Subscription{
+				ChatID:              c.ID,
+				Label:               a.Label,
+				LastNotifiedMessage: a.LastNotifiedMessage,
+				LoginFailures:       a.LoginFailures,
+				MarkRead:            c.MarkRead,
+				OnlyUnread:          c.OnlyUnread,
+			})
+		}
+	}
+
+	return feeds
+}
+
+// Suspended reports whether the account of the subscription has failed to log in too many times
+func (s Subscription) Suspended() bool {
+	return s.LoginFailures >= MaxLoginFailures
+}
+
+// LastNotifiedMessage returns the oldest cursor among the subscriptions of the feed,
+// which is the point messages need to be fetched from to serve all of them
+func (f Feed) LastNotifiedMessage() uint64 {
+	if len(f.Subscriptions) == 0 {
+		return 0
+	}
+
+	last := f.Subscriptions[0].LastNotifiedMessage
+	for _, s := range f.Subscriptions[1:] {
+		if s.LastNotifiedMessage < last {
+			last = s.LastNotifiedMessage
+		}
+	}
+
+	return last
+}
@@ -0,0 +1,55 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeds(t *testing.T) {
+	shared := Credentials{User: "shared", Pass: "pass"}
+	chats := []Chat{
+		{
+			ID: "mum",
+			Accounts: []Account{
+				{Label: "Lucía", Credentials: shared, LastNotifiedMessage: 10},
+				{Credentials: Credentials{User: "own", Pass: "pass"}, LastNotifiedMessage: 5},
+			},
+		},
+		{
+			ID: "dad",
+			Accounts: []Account{
+				{Label: "Lu", Credentials: shared, LastNotifiedMessage: 7},
+			},
+		},
+		{
+			ID: "grandma",
+			Accounts: []Account{
+				{Credentials: Credentials{User: "shared", Pass: "outdated"}, LastNotifiedMessage: 3},
+			},
+		},
+	}
+
+	expected := []Feed{
+		{
+			Credentials: shared,
+			Subscriptions: []Subscription{
+				{ChatID: "mum", Label: "Lucía", LastNotifiedMessage: 10},
+				{ChatID: "dad", Label: "Lu", LastNotifiedMessage: 7},
+			},
+		},
+		{
+			Credentials:   Credentials{User: "own", Pass: "pass"},
+			Subscriptions: []Subscription{{ChatID: "mum", LastNotifiedMessage: 5}},
+		},
+		{
+			Credentials:   Credentials{User: "shared", Pass: "outdated"},
+			Subscriptions: []Subscription{{ChatID: "grandma", LastNotifiedMessage: 3}},
+		},
+	}
+
+	feeds := Feeds(chats)
+
+	assert.Equal(t, expected, feeds)
+	assert.Equal(t, uint64(7), feeds[0].LastNotifiedMessage())
+}
@@ -0,0 +1,23 @@
+package repo
+
+import "context"
+
+// Delivery identifies something sent to a chat: the text of the message MessageID or,
+// if AttachmentID is not 0, one of its attachments. Texts split in several parts are also
+// recorded part by part, numbered from 1 in Part, until all of them are delivered.
+type Delivery struct {
+	MessageID    uint64
+	AttachmentID uint64
+	Part         uint64
+}
+
+// Ledger records what has been delivered to each chat for each of its accounts, so that
+// a notification that stopped halfway can be resumed without sending anything twice.
+// Saving or deleting a chat clears the deliveries of its accounts.
+type Ledger interface {
+	GetDeliveries(ctx context.Context, chatID, user string) ([]Delivery, error)
+	RecordDelivery(ctx context.Context, chatID, user string, d Delivery) error
+	// PruneDeliveries deletes the deliveries of the messages up to upTo, which are no longer
+	// needed once the cursor of the account has moved past them
+	PruneDeliveries(ctx context.Context, chatID, user string, upTo uint64) error
+}
@@ -2,27 +2,126 @@
 
 package repo
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	context "context"
+
+	mock "github.com/stretchr/testify/mock"
+
+	time "time"
+)
 
 // MockRepo is an autogenerated mock type for the Repo type
 type MockRepo struct {
 	mock.Mock
 }
 
-// GetLastNotifiedMessage provides a mock function with given fields: userName
-func (_m *MockRepo) GetLastNotifiedMessage(userName string) (uint64, error) {
-	ret := _m.Called(userName)
+// DeleteAccount provides a mock function with given fields: ctx, chatID, user
+func (_m *MockRepo) DeleteAccount(ctx context.Context, chatID string, user string) error {
+	ret := _m.Called(ctx, chatID, user)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) error); ok {
+		r0 = rf(ctx, chatID, user)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteChat provides a mock function with given fields: ctx, chatID
+func (_m *MockRepo) DeleteChat(ctx context.Context, chatID string) error {
+	ret := _m.Called(ctx, chatID)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, chatID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DeleteSession provides a mock function with given fields: ctx, user
+func (_m *MockRepo) DeleteSession(ctx context.Context, user string) error {
+	ret := _m.Called(ctx, user)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, user)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// DisableChat provides a mock function with given fields: ctx, chatID, reason, at
+func (_m *MockRepo) DisableChat(ctx context.Context, chatID string, reason string, at time.Time) error {
+	ret := _m.Called(ctx, chatID, reason, at)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, time.Time) error); ok {
+		r0 = rf(ctx, chatID, reason, at)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// EnableChat provides a mock function with given fields: ctx, chatID
+func (_m *MockRepo) EnableChat(ctx context.Context, chatID string) error {
+	ret := _m.Called(ctx, chatID)
 
-	var r0 uint64
-	if rf, ok := ret.Get(0).(func(string) uint64); ok {
-		r0 = rf(userName)
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, chatID)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetChat provides a mock function with given fields: ctx, chatID
+func (_m *MockRepo) GetChat(ctx context.Context, chatID string) (Chat, error) {
+	ret := _m.Called(ctx, chatID)
+
+	var r0 Chat
+	if rf, ok := ret.Get(0).(func(context.Context, string) Chat); ok {
+		r0 = rf(ctx, chatID)
+	} else {
+		r0 = ret.Get(0).(Chat)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, chatID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetChats provides a mock function with given fields: ctx
+func (_m *MockRepo) GetChats(ctx context.Context) ([]Chat, error) {
+	ret := _m.Called(ctx)
+
+	var r0 []Chat
+	if rf, ok := ret.Get(0).(func(context.Context) []Chat); ok {
+		r0 = rf(ctx)
 	} else {
-		r0 = ret.Get(0).(uint64)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]Chat)
+		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(userName)
+	if rf, ok := ret.Get(1).(func(context.Context) error); ok {
+		r1 = rf(ctx)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -30,20 +129,22 @@ func (_m *MockRepo) GetLastNotifiedMessage(userName string) (uint64, error) {
 	return r0, r1
 }
 
-// GetPassword provides a mock function with given fields: userName
-func (_m *MockRepo) GetPassword(userName string) (string, error) {
-	ret := _m.Called(userName)
+// GetDeliveries provides a mock function with given fields: ctx, chatID, user
+func (_m *MockRepo) GetDeliveries(ctx context.Context, chatID string, user string) ([]Delivery, error) {
+	ret := _m.Called(ctx, chatID, user)
 
-	var r0 string
-	if rf, ok := ret.Get(0).(func(string) string); ok {
-		r0 = rf(userName)
+	var r0 []Delivery
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) []Delivery); ok {
+		r0 = rf(ctx, chatID, user)
 	} else {
-		r0 = ret.Get(0).(string)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]Delivery)
+		}
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(userName)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, chatID, user)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -51,13 +152,160 @@ func (_m *MockRepo) GetPassword(userName string) (string, error) {
 	return r0, r1
 }
 
-// SetLastNotifiedMessage provides a mock function with given fields: userName, id
-func (_m *MockRepo) SetLastNotifiedMessage(userName string, id uint64) error {
-	ret := _m.Called(userName, id)
+// GetSession provides a mock function with given fields: ctx, user
+func (_m *MockRepo) GetSession(ctx context.Context, user string) (Session, error) {
+	ret := _m.Called(ctx, user)
+
+	var r0 Session
+	if rf, ok := ret.Get(0).(func(context.Context, string) Session); ok {
+		r0 = rf(ctx, user)
+	} else {
+		r0 = ret.Get(0).(Session)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, user)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// PruneDeliveries provides a mock function with given fields: ctx, chatID, user, upTo
+func (_m *MockRepo) PruneDeliveries(ctx context.Context, chatID string, user string, upTo uint64) error {
+	ret := _m.Called(ctx, chatID, user, upTo)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, uint64) error); ok {
+		r0 = rf(ctx, chatID, user, upTo)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RecordDelivery provides a mock function with given fields: ctx, chatID, user, d
+func (_m *MockRepo) RecordDelivery(ctx context.Context, chatID string, user string, d Delivery) error {
+	ret := _m.Called(ctx, chatID, user, d)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, Delivery) error); ok {
+		r0 = rf(ctx, chatID, user, d)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SaveAccount provides a mock function with given fields: ctx, chatID, a
+func (_m *MockRepo) SaveAccount(ctx context.Context, chatID string, a Account) error {
+	ret := _m.Called(ctx, chatID, a)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, Account) error); ok {
+		r0 = rf(ctx, chatID, a)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SaveChat provides a mock function with given fields: ctx, chat
+func (_m *MockRepo) SaveChat(ctx context.Context, chat Chat) error {
+	ret := _m.Called(ctx, chat)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, Chat) error); ok {
+		r0 = rf(ctx, chat)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SaveSession provides a mock function with given fields: ctx, s
+func (_m *MockRepo) SaveSession(ctx context.Context, s Session) error {
+	ret := _m.Called(ctx, s)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, Session) error); ok {
+		r0 = rf(ctx, s)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetLastNotifiedMessage provides a mock function with given fields: ctx, chatID, user, lastNotifiedMessage
+func (_m *MockRepo) SetLastNotifiedMessage(ctx context.Context, chatID string, user string, lastNotifiedMessage uint64) error {
+	ret := _m.Called(ctx, chatID, user, lastNotifiedMessage)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, uint64) error); ok {
+		r0 = rf(ctx, chatID, user, lastNotifiedMessage)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetMarkRead provides a mock function with given fields: ctx, chatID, on
+func (_m *MockRepo) SetMarkRead(ctx context.Context, chatID string, on bool) error {
+	ret := _m.Called(ctx, chatID, on)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, bool) error); ok {
+		r0 = rf(ctx, chatID, on)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetOnlyUnread provides a mock function with given fields: ctx, chatID, on
+func (_m *MockRepo) SetOnlyUnread(ctx context.Context, chatID string, on bool) error {
+	ret := _m.Called(ctx, chatID, on)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, bool) error); ok {
+		r0 = rf(ctx, chatID, on)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdateLastNotifiedMessage provides a mock function with given fields: ctx, chatID, user, lastNotifiedMessage
+func (_m *MockRepo) UpdateLastNotifiedMessage(ctx context.Context, chatID string, user string, lastNotifiedMessage uint64) error {
+	ret := _m.Called(ctx, chatID, user, lastNotifiedMessage)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, uint64) error); ok {
+		r0 = rf(ctx, chatID, user, lastNotifiedMessage)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdateLoginFailures provides a mock function with given fields: ctx, chatID, user, failures
+func (_m *MockRepo) UpdateLoginFailures(ctx context.Context, chatID string, user string, failures int) error {
+	ret := _m.Called(ctx, chatID, user, failures)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, uint64) error); ok {
-		r0 = rf(userName, id)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, int) error); ok {
+		r0 = rf(ctx, chatID, user, failures)
 	} else {
 		r0 = ret.Error(0)
 	}
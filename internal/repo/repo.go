@@ -1,18 +1,129 @@
 package repo
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// MaxLoginFailures is the number of consecutive logins rejected because of bad credentials
+// after which an account is suspended, so that Raíces does not lock it
+const MaxLoginFailures = 3
+
+var (
+	// ErrChatNotFound is returned when the requested chat does not exist in the repository
+	ErrChatNotFound = errors.New("chat not found")
+
+	// ErrAccountNotFound is returned when the requested chat is not subscribed to the given account
+	ErrAccountNotFound = errors.New("account not found")
+)
+
+// Repo stores the chats and the Raíces accounts they are subscribed to. Updates only touch
+// what they change, so that they do not undo those made meanwhile by a run.
+//
 //go:generate mockery --case underscore --inpkg --name Repo
 type Repo interface {
-	GetChats() ([]Chat, error)
-	UpdateLastNotifiedMessage(chatID string, lastNotifiedMessage uint64) error
+	Ledger
+	SessionStore
+
+	GetChats(ctx context.Context) ([]Chat, error)
+	GetChat(ctx context.Context, chatID string) (Chat, error)
+	// SaveChat rewrites the whole chat and clears its delivery ledger
+	SaveChat(ctx context.Context, chat Chat) error
+	DeleteChat(ctx context.Context, chatID string) error
+	// SaveAccount adds an account to a chat, creating the chat if it does not exist, or sets
+	// the label, credentials and login failures of the account of the same user, keeping its
+	// cursor and ledger
+	SaveAccount(ctx context.Context, chatID string, a Account) error
+	// DeleteAccount removes an account and its ledger from a chat, leaving the chat in place
+	DeleteAccount(ctx context.Context, chatID, user string) error
+	// UpdateLastNotifiedMessage only moves the cursor of an account forward, updates to a
+	// message that is not newer than the current one are ignored
+	UpdateLastNotifiedMessage(ctx context.Context, chatID, user string, lastNotifiedMessage uint64) error
+	// SetLastNotifiedMessage sets the cursor of an account to any message, e.g. to rewind it,
+	// keeping its ledger
+	SetLastNotifiedMessage(ctx context.Context, chatID, user string, lastNotifiedMessage uint64) error
+	// UpdateLoginFailures sets the count of failed logins of an account
+	UpdateLoginFailures(ctx context.Context, chatID, user string, failures int) error
+	DisableChat(ctx context.Context, chatID, reason string, at time.Time) error
+	EnableChat(ctx context.Context, chatID string) error
+	SetMarkRead(ctx context.Context, chatID string, on bool) error
+	SetOnlyUnread(ctx context.Context, chatID string, on bool) error
 }
 
+// Chat is a Telegram chat subscribed to the messages of one or more Raíces accounts.
+// Chats that cannot be reached, e.g. because the user blocked the bot, are disabled at
+// DisabledAt for DisabledReason. If MarkRead is true, messages are marked as read in Raíces
+// once they are delivered to the chat. If OnlyUnread is true, messages that have already
+// been read in Raíces are not delivered.
 type Chat struct {
-	ID                  string
+	ID       string
+	Accounts []Account
+
+	MarkRead   bool
+	OnlyUnread bool
+
+	DisabledAt     time.Time
+	DisabledReason string
+}
+
+// Account is a Raíces account a chat is subscribed to. The user in its credentials
+// identifies the account within the chat. LoginFailures counts the consecutive logins
+// rejected because of bad credentials, it is reset when they succeed again.
+type Account struct {
+	Label               string
 	Credentials         Credentials
 	LastNotifiedMessage uint64
+	LoginFailures       int
 }
 
 type Credentials struct {
 	User string
 	Pass string
 }
+
+// Disabled reports whether the chat is disabled
+func (c Chat) Disabled() bool {
+	return !c.DisabledAt.IsZero()
+}
+
+// Suspended reports whether the account has failed to log in too many times, in which case
+// no more logins should be tried until its credentials are updated
+func (a Account) Suspended() bool {
+	return a.LoginFailures >= MaxLoginFailures
+}
+
+// Account returns the account of the chat whose credentials belong to user
+func (c Chat) Account(user string) (Account, bool) {
+	for _, a := range c.Accounts {
+		if a.Credentials.User == user {
+			return a, true
+		}
+	}
+
+	return Account{}, false
+}
+
+// SetAccount adds a to the chat accounts, replacing the account with the same user if there is one
+func (c *Chat) SetAccount(a Account) {
+	for i := range c.Accounts {
+		if c.Accounts[i].Credentials.User == a.Credentials.User {
+			c.Accounts[i] = a
+			return
+		}
+	}
+
+	c.Accounts = append(c.Accounts, a)
+}
+
+// RemoveAccount removes the account whose credentials belong to user and reports whether it existed
+func (c *Chat) RemoveAccount(user string) bool {
+	for i := range c.Accounts {
+		if c.Accounts[i].Credentials.User == user {
+			c.Accounts = append(c.Accounts[:i], c.Accounts[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
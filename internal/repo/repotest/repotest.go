@@ -0,0 +1,603 @@
+// Package repotest provides a conformance test suite for repo.Repo implementations
+package repotest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/volmedo/almendruco.git/internal/repo"
+)
+
+// concurrency is the number of goroutines used by the tests that access the repository concurrently
+const concurrency = 10
+
+// Run checks that the repositories returned by newRepo behave as the repo.Repo contract
+// expects: chats can be created, listed, replaced and deleted, accounts can be saved and
+// deleted on their own, cursors can only move forward, also when updated concurrently, login
+// failures are kept per account, chats keep their options and can be disabled and enabled,
+// deliveries are recorded per account, sessions are kept per user, and missing chats and
+// accounts are reported with the repo errors.
+// newRepo is called once per test and must return an empty repository.
+func Run(t *testing.T, newRepo func(t *testing.T) repo.Repo) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, r repo.Repo)
+	}{
+		{"SaveAndGetChat", testSaveAndGetChat},
+		{"GetChats", testGetChats},
+		{"SaveChatReplaces", testSaveChatReplaces},
+		{"DeleteChat", testDeleteChat},
+		{"SaveAccount", testSaveAccount},
+		{"DeleteAccount", testDeleteAccount},
+		{"UpdateLastNotifiedMessage", testUpdateLastNotifiedMessage},
+		{"CursorOnlyMovesForward", testCursorOnlyMovesForward},
+		{"SetLastNotifiedMessage", testSetLastNotifiedMessage},
+		{"UpdateLoginFailures", testUpdateLoginFailures},
+		{"NotFound", testNotFound},
+		{"DisableChat", testDisableChat},
+		{"ChatOptions", testChatOptions},
+		{"Deliveries", testDeliveries},
+		{"Sessions", testSessions},
+		{"ConcurrentSaves", testConcurrentSaves},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+		{"ConcurrentUpdatesSameAccount", testConcurrentUpdatesSameAccount},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepo(t))
+		})
+	}
+}
+
+func chat(id string, accounts ...repo.Account) repo.Chat {
+	return repo.Chat{ID: id, Accounts: accounts}
+}
+
+func account(label, user string, last uint64) repo.Account {
+	return repo.Account{
+		Label:               label,
+		Credentials:         repo.Credentials{User: user, Pass: "pass-" + user},
+		LastNotifiedMessage: last,
+	}
+}
+
+// assertChat compares chats regardless of the order of their accounts, which
+// implementations are not required to preserve
+func assertChat(t *testing.T, expected, actual repo.Chat) {
+	t.Helper()
+
+	assert.Equal(t, expected.ID, actual.ID)
+	assert.ElementsMatch(t, expected.Accounts, actual.Accounts)
+}
+
+func testSaveAndGetChat(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+	c := chat("1", account("Lucía", "user1", 10), account("", "user2", 20))
+
+	require.NoError(t, r.SaveChat(ctx, c))
+
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, c, got)
+}
+
+func testGetChats(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	chats, err := r.GetChats(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, chats)
+
+	c1 := chat("1", account("", "user1", 10))
+	c2 := chat("2", account("", "user1", 5), account("", "user2", 20))
+	require.NoError(t, r.SaveChat(ctx, c1))
+	require.NoError(t, r.SaveChat(ctx, c2))
+
+	chats, err = r.GetChats(ctx)
+	require.NoError(t, err)
+	require.Len(t, chats, 2)
+
+	byID := map[string]repo.Chat{}
+	for _, c := range chats {
+		byID[c.ID] = c
+	}
+	assertChat(t, c1, byID["1"])
+	assertChat(t, c2, byID["2"])
+}
+
+func testSaveChatReplaces(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 10), account("", "user2", 20))))
+
+	replacement := chat("1", account("Lucía", "user2", 30))
+	require.NoError(t, r.SaveChat(ctx, replacement))
+
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, replacement, got)
+}
+
+func testDeleteChat(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 10))))
+	require.NoError(t, r.SaveChat(ctx, chat("2", account("", "user2", 20))))
+
+	require.NoError(t, r.DeleteChat(ctx, "1"))
+
+	_, err := r.GetChat(ctx, "1")
+	assert.ErrorIs(t, err, repo.ErrChatNotFound)
+
+	chats, err := r.GetChats(ctx)
+	require.NoError(t, err)
+	require.Len(t, chats, 1)
+	assert.Equal(t, "2", chats[0].ID)
+}
+
+func testSaveAccount(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	// Saving an account creates its chat if needed
+	require.NoError(t, r.SaveAccount(ctx, "1", account("Lucía", "user1", 5)))
+
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, chat("1", account("Lucía", "user1", 5)), got)
+
+	require.NoError(t, r.SaveAccount(ctx, "1", account("", "user2", 0)))
+	require.NoError(t, r.UpdateLastNotifiedMessage(ctx, "1", "user1", 10))
+	require.NoError(t, r.UpdateLoginFailures(ctx, "1", "user1", repo.MaxLoginFailures))
+	require.NoError(t, r.RecordDelivery(ctx, "1", "user1", repo.Delivery{MessageID: 11}))
+
+	// Saving an existing account replaces its label, credentials and login failures, but
+	// keeps its cursor and ledger, and leaves the rest of the accounts alone
+	updated := repo.Account{Credentials: repo.Credentials{User: "user1", Pass: "new"}}
+	require.NoError(t, r.SaveAccount(ctx, "1", updated))
+
+	got, err = r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	updated.LastNotifiedMessage = 10
+	assertChat(t, chat("1", updated, account("", "user2", 0)), got)
+
+	deliveries, err := r.GetDeliveries(ctx, "1", "user1")
+	require.NoError(t, err)
+	assert.Equal(t, []repo.Delivery{{MessageID: 11}}, deliveries)
+
+	// Chats left without accounts get them back
+	require.NoError(t, r.SaveChat(ctx, chat("2")))
+	require.NoError(t, r.SaveAccount(ctx, "2", account("", "user1", 3)))
+
+	got, err = r.GetChat(ctx, "2")
+	require.NoError(t, err)
+	assertChat(t, chat("2", account("", "user1", 3)), got)
+}
+
+func testDeleteAccount(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 10), account("", "user2", 20))))
+	require.NoError(t, r.RecordDelivery(ctx, "1", "user1", repo.Delivery{MessageID: 11}))
+	require.NoError(t, r.RecordDelivery(ctx, "1", "user2", repo.Delivery{MessageID: 21}))
+
+	require.NoError(t, r.DeleteAccount(ctx, "1", "user1"))
+
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, chat("1", account("", "user2", 20)), got)
+
+	deliveries, err := r.GetDeliveries(ctx, "1", "user2")
+	require.NoError(t, err)
+	assert.Equal(t, []repo.Delivery{{MessageID: 21}}, deliveries)
+
+	// The ledger of a deleted account is not inherited if it is saved again
+	require.NoError(t, r.SaveAccount(ctx, "1", account("", "user1", 0)))
+
+	deliveries, err = r.GetDeliveries(ctx, "1", "user1")
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+}
+
+func testUpdateLastNotifiedMessage(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("Lucía", "user1", 10), account("", "user2", 20))))
+
+	require.NoError(t, r.UpdateLastNotifiedMessage(ctx, "1", "user1", 15))
+
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, chat("1", account("Lucía", "user1", 15), account("", "user2", 20)), got)
+}
+
+func testCursorOnlyMovesForward(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 10))))
+
+	require.NoError(t, r.UpdateLastNotifiedMessage(ctx, "1", "user1", 15))
+	require.NoError(t, r.UpdateLastNotifiedMessage(ctx, "1", "user1", 12))
+	require.NoError(t, r.UpdateLastNotifiedMessage(ctx, "1", "user1", 15))
+
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, chat("1", account("", "user1", 15)), got)
+
+	// SaveChat is not restricted, so that cursors can be rewound on purpose
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 5))))
+
+	got, err = r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, chat("1", account("", "user1", 5)), got)
+}
+
+func testSetLastNotifiedMessage(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	failing := account("", "user2", 20)
+	failing.LoginFailures = 2
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("Lucía", "user1", 10), failing)))
+	require.NoError(t, r.RecordDelivery(ctx, "1", "user1", repo.Delivery{MessageID: 11}))
+	require.NoError(t, r.RecordDelivery(ctx, "1", "user2", repo.Delivery{MessageID: 21}))
+
+	// The cursor can be rewound, without touching the rest of the chat
+	require.NoError(t, r.SetLastNotifiedMessage(ctx, "1", "user1", 5))
+
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, chat("1", account("Lucía", "user1", 5), failing), got)
+
+	deliveries, err := r.GetDeliveries(ctx, "1", "user1")
+	require.NoError(t, err)
+	assert.Equal(t, []repo.Delivery{{MessageID: 11}}, deliveries)
+
+	deliveries, err = r.GetDeliveries(ctx, "1", "user2")
+	require.NoError(t, err)
+	assert.Equal(t, []repo.Delivery{{MessageID: 21}}, deliveries)
+}
+
+func testUpdateLoginFailures(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 10), account("", "user2", 20))))
+
+	require.NoError(t, r.UpdateLoginFailures(ctx, "1", "user1", 2))
+
+	expected := account("", "user1", 10)
+	expected.LoginFailures = 2
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, chat("1", expected, account("", "user2", 20)), got)
+
+	// The count is kept when the cursor moves and can be reset
+	require.NoError(t, r.UpdateLastNotifiedMessage(ctx, "1", "user1", 15))
+	expected.LastNotifiedMessage = 15
+
+	got, err = r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, chat("1", expected, account("", "user2", 20)), got)
+
+	require.NoError(t, r.UpdateLoginFailures(ctx, "1", "user1", 0))
+
+	got, err = r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, chat("1", account("", "user1", 15), account("", "user2", 20)), got)
+}
+
+func testDisableChat(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+	c := chat("1", account("", "user1", 10))
+	require.NoError(t, r.SaveChat(ctx, c))
+
+	// Timestamps are only required to be kept with a precision of seconds
+	at := time.Date(2021, time.November, 11, 10, 30, 0, 0, time.UTC)
+	require.NoError(t, r.DisableChat(ctx, "1", "bot blocked by the user", at))
+
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, got.Disabled())
+	assert.True(t, at.Equal(got.DisabledAt), "Expected chat to be disabled at %s, got %s", at, got.DisabledAt)
+	assert.Equal(t, "bot blocked by the user", got.DisabledReason)
+	assertChat(t, c, got)
+
+	chats, err := r.GetChats(ctx)
+	require.NoError(t, err)
+	require.Len(t, chats, 1)
+	assert.True(t, chats[0].Disabled())
+
+	require.NoError(t, r.EnableChat(ctx, "1"))
+
+	got, err = r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assert.False(t, got.Disabled())
+	assert.Empty(t, got.DisabledReason)
+
+	// The disabled state is kept when a chat is saved
+	got.DisabledAt = at
+	got.DisabledReason = "chat not found"
+	require.NoError(t, r.SaveChat(ctx, got))
+
+	got, err = r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, at.Equal(got.DisabledAt))
+	assert.Equal(t, "chat not found", got.DisabledReason)
+}
+
+func testChatOptions(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 10))))
+	require.NoError(t, r.RecordDelivery(ctx, "1", "user1", repo.Delivery{MessageID: 11}))
+
+	require.NoError(t, r.SetMarkRead(ctx, "1", true))
+	require.NoError(t, r.SetOnlyUnread(ctx, "1", true))
+
+	// Setting options leaves the rest of the chat alone
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, chat("1", account("", "user1", 10)), got)
+
+	deliveries, err := r.GetDeliveries(ctx, "1", "user1")
+	require.NoError(t, err)
+	assert.Equal(t, []repo.Delivery{{MessageID: 11}}, deliveries)
+
+	// Options are kept when the chat is updated in any other way
+	require.NoError(t, r.UpdateLastNotifiedMessage(ctx, "1", "user1", 15))
+	require.NoError(t, r.DisableChat(ctx, "1", "chat not found", time.Now()))
+	require.NoError(t, r.EnableChat(ctx, "1"))
+	require.NoError(t, r.SaveAccount(ctx, "1", account("", "user2", 0)))
+
+	got, err = r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, got.MarkRead)
+	assert.True(t, got.OnlyUnread)
+
+	chats, err := r.GetChats(ctx)
+	require.NoError(t, err)
+	require.Len(t, chats, 1)
+	assert.True(t, chats[0].MarkRead)
+	assert.True(t, chats[0].OnlyUnread)
+
+	require.NoError(t, r.SetOnlyUnread(ctx, "1", false))
+
+	got, err = r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, got.MarkRead)
+	assert.False(t, got.OnlyUnread)
+
+	got.MarkRead = false
+	require.NoError(t, r.SaveChat(ctx, got))
+
+	got, err = r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assert.False(t, got.MarkRead)
+	assert.False(t, got.OnlyUnread)
+}
+
+func testNotFound(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	_, err := r.GetChat(ctx, "1")
+	assert.ErrorIs(t, err, repo.ErrChatNotFound)
+
+	err = r.DeleteChat(ctx, "1")
+	assert.ErrorIs(t, err, repo.ErrChatNotFound)
+
+	err = r.UpdateLastNotifiedMessage(ctx, "1", "user1", 10)
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+
+	err = r.SetLastNotifiedMessage(ctx, "1", "user1", 10)
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+
+	err = r.UpdateLoginFailures(ctx, "1", "user1", 1)
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+
+	err = r.DisableChat(ctx, "1", "chat not found", time.Now())
+	assert.ErrorIs(t, err, repo.ErrChatNotFound)
+
+	err = r.EnableChat(ctx, "1")
+	assert.ErrorIs(t, err, repo.ErrChatNotFound)
+
+	err = r.SetMarkRead(ctx, "1", true)
+	assert.ErrorIs(t, err, repo.ErrChatNotFound)
+
+	err = r.SetOnlyUnread(ctx, "1", true)
+	assert.ErrorIs(t, err, repo.ErrChatNotFound)
+
+	err = r.DeleteAccount(ctx, "1", "user1")
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 10))))
+
+	err = r.DeleteAccount(ctx, "1", "user2")
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+
+	err = r.UpdateLastNotifiedMessage(ctx, "1", "user2", 10)
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+
+	err = r.SetLastNotifiedMessage(ctx, "1", "user2", 10)
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+
+	err = r.UpdateLoginFailures(ctx, "1", "user2", 1)
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+}
+
+func testDeliveries(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 0), account("", "user2", 0))))
+
+	deliveries, err := r.GetDeliveries(ctx, "1", "user1")
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+
+	recorded := []repo.Delivery{{MessageID: 1}, {MessageID: 1, AttachmentID: 5}, {MessageID: 2}, {MessageID: 3, Part: 1}}
+	for _, d := range recorded {
+		require.NoError(t, r.RecordDelivery(ctx, "1", "user1", d))
+	}
+	require.NoError(t, r.RecordDelivery(ctx, "1", "user2", repo.Delivery{MessageID: 1}))
+
+	// Recording a delivery twice has no effect
+	require.NoError(t, r.RecordDelivery(ctx, "1", "user1", repo.Delivery{MessageID: 2}))
+
+	deliveries, err = r.GetDeliveries(ctx, "1", "user1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, recorded, deliveries)
+
+	require.NoError(t, r.PruneDeliveries(ctx, "1", "user1", 1))
+
+	deliveries, err = r.GetDeliveries(ctx, "1", "user1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []repo.Delivery{{MessageID: 2}, {MessageID: 3, Part: 1}}, deliveries)
+
+	deliveries, err = r.GetDeliveries(ctx, "1", "user2")
+	require.NoError(t, err)
+	assert.Equal(t, []repo.Delivery{{MessageID: 1}}, deliveries)
+
+	_, err = r.GetDeliveries(ctx, "1", "user3")
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+	err = r.RecordDelivery(ctx, "2", "user1", repo.Delivery{MessageID: 1})
+	assert.ErrorIs(t, err, repo.ErrAccountNotFound)
+
+	// Saving or deleting a chat clears its deliveries
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 0), account("", "user2", 0))))
+
+	deliveries, err = r.GetDeliveries(ctx, "1", "user2")
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+
+	require.NoError(t, r.RecordDelivery(ctx, "1", "user1", repo.Delivery{MessageID: 3}))
+	require.NoError(t, r.DeleteChat(ctx, "1"))
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 0))))
+
+	deliveries, err = r.GetDeliveries(ctx, "1", "user1")
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+}
+
+func testSessions(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	_, err := r.GetSession(ctx, "user1")
+	assert.ErrorIs(t, err, repo.ErrSessionNotFound)
+
+	s := repo.Session{User: "user1", PassHash: "0123abcd", Cookies: map[string]string{"JSESSIONID": "abcd", "other": "efgh"}}
+	require.NoError(t, r.SaveSession(ctx, s))
+	require.NoError(t, r.SaveSession(ctx, repo.Session{User: "user2", Cookies: map[string]string{"JSESSIONID": "ijkl"}}))
+
+	got, err := r.GetSession(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, s, got)
+
+	// Saving a session replaces the previous one
+	s.Cookies = map[string]string{"JSESSIONID": "mnop"}
+	require.NoError(t, r.SaveSession(ctx, s))
+
+	got, err = r.GetSession(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, s, got)
+
+	require.NoError(t, r.DeleteSession(ctx, "user1"))
+	require.NoError(t, r.DeleteSession(ctx, "user1"))
+
+	_, err = r.GetSession(ctx, "user1")
+	assert.ErrorIs(t, err, repo.ErrSessionNotFound)
+
+	got, err = r.GetSession(ctx, "user2")
+	require.NoError(t, err)
+	assert.Equal(t, "ijkl", got.Cookies["JSESSIONID"])
+}
+
+func testConcurrentSaves(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- r.SaveChat(ctx, chat(fmt.Sprint(i), account("", "user", uint64(i))))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	chats, err := r.GetChats(ctx)
+	require.NoError(t, err)
+	assert.Len(t, chats, concurrency)
+}
+
+// testConcurrentUpdates checks that updating the cursors of different accounts of the same
+// chat at the same time does not make any of the updates get lost
+func testConcurrentUpdates(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	expected := chat("1")
+	for i := 0; i < concurrency; i++ {
+		expected.Accounts = append(expected.Accounts, account("", fmt.Sprintf("user%d", i), 0))
+	}
+	require.NoError(t, r.SaveChat(ctx, expected))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		expected.Accounts[i].LastNotifiedMessage = uint64(100 + i)
+
+		wg.Add(1)
+		go func(a repo.Account) {
+			defer wg.Done()
+			errs <- r.UpdateLastNotifiedMessage(ctx, "1", a.Credentials.User, a.LastNotifiedMessage)
+		}(expected.Accounts[i])
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, expected, got)
+}
+
+// testConcurrentUpdatesSameAccount checks that the newest message wins when the cursor of
+// an account is updated by several overlapping runs
+func testConcurrentUpdatesSameAccount(t *testing.T, r repo.Repo) {
+	ctx := context.Background()
+
+	require.NoError(t, r.SaveChat(ctx, chat("1", account("", "user1", 0))))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+	for i := 1; i <= concurrency; i++ {
+		wg.Add(1)
+		go func(last uint64) {
+			defer wg.Done()
+			errs <- r.UpdateLastNotifiedMessage(ctx, "1", "user1", last)
+		}(uint64(i))
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	got, err := r.GetChat(ctx, "1")
+	require.NoError(t, err)
+	assertChat(t, chat("1", account("", "user1", concurrency)), got)
+}
@@ -0,0 +1,28 @@
+package repo
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrSessionNotFound is returned when there is no session stored for the requested user
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a logged in Raíces session, made of the cookies set by Raíces at login. PassHash
+// is a hash of the password the session was logged in with, so that it is only reused along
+// with that same password.
+type Session struct {
+	User     string
+	PassHash string
+	Cookies  map[string]string
+}
+
+// SessionStore keeps the Raíces session of each account, so that it can be reused across
+// runs instead of logging in every time. Sessions are keyed by user, regardless of the
+// chats subscribed to the account, and the last login replaces the session of the user.
+type SessionStore interface {
+	GetSession(ctx context.Context, user string) (Session, error)
+	SaveSession(ctx context.Context, s Session) error
+	// DeleteSession deletes the session of user, if there is one
+	DeleteSession(ctx context.Context, user string) error
+}